@@ -2,6 +2,8 @@
 package api
 
 import (
+	"net/http"
+
 	"github.com/gorilla/mux"
 	"example.com/levo_app/controller"
 )
@@ -9,11 +11,41 @@ import (
 // RegisterRoutes registers the API routes
 func RegisterRoutes(handler *controller.APIHandler) *mux.Router {
 	r := mux.NewRouter()
+	r.Use(handler.RequestMiddleware)
+	// The router only runs its middlewares for the matched routes, the other requests are logged
+	// and counted by wrapping the handlers of their errors
+	r.NotFoundHandler = handler.RequestMiddleware(http.NotFoundHandler())
+	r.MethodNotAllowedHandler = handler.RequestMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+	}))
 
 	r.HandleFunc("/upload/schema", handler.UploadSchemaHandler).Methods("POST")
+	r.HandleFunc("/upload/schema/{name}", handler.UploadSchemaHandler).Methods("POST")
+	r.HandleFunc("/schemas/{name}/versions", handler.UploadRawSchemaHandler).Methods("POST", "PUT")
+	r.HandleFunc("/schemas/{name}/uploads", handler.CreateUploadHandler).Methods("POST")
+	r.HandleFunc("/uploads/{id}", handler.GetUploadHandler).Methods("GET", "HEAD")
+	r.HandleFunc("/uploads/{id}", handler.AppendUploadHandler).Methods("PATCH")
+	r.HandleFunc("/uploads/{id}", handler.DeleteUploadHandler).Methods("DELETE")
+	r.HandleFunc("/uploads/{id}/finalize", handler.FinalizeUploadHandler).Methods("POST")
 	r.HandleFunc("/getSchemaByVersion/{filename}/{version}", handler.GetSchemaHandler).Methods("GET")
 	r.HandleFunc("/getLatestSchema/{filename}", handler.GetLatestSchemaHandler).Methods("GET")
 	r.HandleFunc("/getAllVersions/{filename}", handler.GetAllVersionsHandler).Methods("GET")
+	r.HandleFunc("/schemas/by-digest/{sha256}", handler.GetSchemaByDigestHandler).Methods("GET")
+
+	r.HandleFunc("/healthz", handler.HealthHandler).Methods("GET")
+	r.HandleFunc("/readyz", handler.ReadyHandler).Methods("GET")
+	r.HandleFunc("/metrics", handler.MetricsHandler).Methods("GET")
+
+	// The admin API can rewrite the database and the storage, it is only served when a token is configured
+	if handler.AdminToken != "" {
+		admin := r.PathPrefix("/admin").Subrouter()
+		admin.Use(handler.AdminMiddleware)
+		admin.HandleFunc("/fsck", handler.FsckHandler).Methods("GET")
+		admin.HandleFunc("/fsck/rebuild", handler.RebuildMetadataHandler).Methods("POST")
+		admin.HandleFunc("/fsck/normalize-names", handler.NormalizeNamesHandler).Methods("POST")
+		admin.HandleFunc("/storage/usage", handler.StorageUsageHandler).Methods("GET")
+		admin.HandleFunc("/keys/rotate", handler.RotateKeysHandler).Methods("POST")
+	}
 
 	return r
 }
@@ -0,0 +1,214 @@
+package api
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"example.com/levo_app/controller"
+	"example.com/levo_app/db"
+	"example.com/levo_app/logging"
+	"example.com/levo_app/metrics"
+	"example.com/levo_app/storage"
+)
+
+func TestRegisterRoutes(t *testing.T) {
+	apiHandler := controller.NewAPIHandler(storage.NewMemoryStore(), db.NewMemoryRepository())
+	apiHandler.Metrics = controller.NewMetrics(metrics.NewRegistry())
+	server := httptest.NewServer(RegisterRoutes(apiHandler))
+	defer server.Close()
+
+	for _, uploadPath := range []string{"/upload/schema", "/upload/schema/petstore"} {
+		bodyBuf := &bytes.Buffer{}
+		writer := multipart.NewWriter(bodyBuf)
+		fileWriter, err := writer.CreateFormFile("file", "openapi.yaml")
+		if err != nil {
+			t.Fatal(err)
+		}
+		fileWriter.Write([]byte("openapi: 3.0.1\ninfo:\n  title: test\n"))
+		writer.Close()
+
+		resp, err := http.Post(server.URL+uploadPath, writer.FormDataContentType(), bodyBuf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("expected status %d for upload to %s but got %d", http.StatusOK, uploadPath, resp.StatusCode)
+		}
+	}
+
+	resp, err := http.Post(server.URL+"/schemas/orders/versions", "application/yaml", strings.NewReader("openapi: 3.0.1\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected status %d for raw upload but got %d", http.StatusOK, resp.StatusCode)
+	}
+
+	for path, expectedStatus := range map[string]int{
+		"/getSchemaByVersion/openapi.yaml/1":        http.StatusOK,
+		"/getSchemaByVersion/openapi.yaml/x":        http.StatusBadRequest,
+		"/getLatestSchema/openapi.yaml":             http.StatusOK,
+		"/getAllVersions/openapi.yaml":              http.StatusOK,
+		"/getLatestSchema/petstore":                 http.StatusOK,
+		"/getLatestSchema/orders":                   http.StatusOK,
+		"/uploads/0123456789abcdef0123456789abcdef": http.StatusNotImplemented,
+		"/healthz": http.StatusOK,
+		"/readyz":  http.StatusOK,
+		"/unknown": http.StatusNotFound,
+	} {
+		resp, err := http.Get(server.URL + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+
+		if resp.StatusCode != expectedStatus {
+			t.Errorf("%s: expected status %d but got %d", path, expectedStatus, resp.StatusCode)
+		}
+	}
+
+	// The requests are counted by route template, the unknown paths have no route
+	resp, err = http.Get(server.URL + "/metrics")
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	for _, expected := range []string{
+		`levo_http_requests_total{route="/upload/schema/{name}",method="POST",code="200"} 1`,
+		`levo_http_requests_total{route="/getSchemaByVersion/{filename}/{version}",method="GET",code="400"} 1`,
+		`levo_http_requests_total{route="/getLatestSchema/{filename}",method="GET",code="200"} 3`,
+		`levo_http_request_duration_seconds_count{route="/healthz",method="GET"} 1`,
+		`levo_upload_size_bytes_count 3`,
+	} {
+		if !strings.Contains(string(body), expected) {
+			t.Errorf("expected '%s' in the metrics\n%s", expected, body)
+		}
+	}
+	if strings.Contains(string(body), "/unknown") {
+		t.Errorf("expected the unknown paths not to be counted\n%s", body)
+	}
+}
+
+func TestUnmatchedRoutes(t *testing.T) {
+	var logs bytes.Buffer
+	logger, err := logging.New(&logs, logging.LevelInfo, logging.FormatText)
+	if err != nil {
+		t.Fatal(err)
+	}
+	apiHandler := controller.NewAPIHandler(storage.NewMemoryStore(), db.NewMemoryRepository())
+	apiHandler.Logger = logger
+	apiHandler.Metrics = controller.NewMetrics(metrics.NewRegistry())
+	server := httptest.NewServer(RegisterRoutes(apiHandler))
+	defer server.Close()
+
+	// Unknown paths and methods are answered with a request ID, logged and counted without a route
+	for _, test := range []struct {
+		method string
+		path   string
+		status int
+	}{
+		{"GET", "/unknown", http.StatusNotFound},
+		{"DELETE", "/healthz", http.StatusMethodNotAllowed},
+	} {
+		logs.Reset()
+		req, err := http.NewRequest(test.method, server.URL+test.path, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != test.status {
+			t.Errorf("%s %s: expected status %d but got %d", test.method, test.path, test.status, resp.StatusCode)
+		}
+
+		id := resp.Header.Get(controller.RequestIDHeader)
+		if id == "" {
+			t.Errorf("%s %s: expected a request ID", test.method, test.path)
+		}
+		expected := fmt.Sprintf("request_id=%s method=%s path=%s status=%d", id, test.method, test.path, test.status)
+		if !strings.Contains(logs.String(), expected) {
+			t.Errorf("%s %s: expected '%s' in the logs but got '%s'", test.method, test.path, expected, logs.String())
+		}
+	}
+
+	var metricsText bytes.Buffer
+	if err := apiHandler.Metrics.Registry.WriteText(&metricsText); err != nil {
+		t.Fatal(err)
+	}
+	for _, expected := range []string{
+		`levo_http_requests_total{route="unmatched",method="GET",code="404"} 1`,
+		`levo_http_requests_total{route="unmatched",method="DELETE",code="405"} 1`,
+	} {
+		if !strings.Contains(metricsText.String(), expected) {
+			t.Errorf("expected '%s' in the metrics\n%s", expected, metricsText.String())
+		}
+	}
+}
+
+func TestAdminRoutes(t *testing.T) {
+	apiHandler := controller.NewAPIHandler(storage.NewMemoryStore(), db.NewMemoryRepository())
+	server := httptest.NewServer(RegisterRoutes(apiHandler))
+	if status := adminRequest(t, "GET", server.URL+"/admin/fsck", ""); status != http.StatusNotFound {
+		t.Errorf("expected the admin API to be disabled without a token but got status %d", status)
+	}
+	server.Close()
+
+	apiHandler.AdminToken = "s3cret"
+	server = httptest.NewServer(RegisterRoutes(apiHandler))
+	defer server.Close()
+	for token, expectedStatus := range map[string]int{
+		"":        http.StatusUnauthorized,
+		"wrong":   http.StatusUnauthorized,
+		"s3cret":  http.StatusOK,
+		"s3cret2": http.StatusUnauthorized,
+	} {
+		if status := adminRequest(t, "GET", server.URL+"/admin/fsck", token); status != expectedStatus {
+			t.Errorf("token '%s': expected status %d but got %d", token, expectedStatus, status)
+		}
+	}
+
+	if status := adminRequest(t, "POST", server.URL+"/admin/fsck/normalize-names", "s3cret"); status != http.StatusOK {
+		t.Errorf("expected the names to be normalized with the token but got status %d", status)
+	}
+
+	// The memory store is not encrypted, the rotation is only reached with the token
+	if status := adminRequest(t, "POST", server.URL+"/admin/keys/rotate", ""); status != http.StatusUnauthorized {
+		t.Errorf("expected the key rotation to require the token but got status %d", status)
+	}
+	if status := adminRequest(t, "POST", server.URL+"/admin/keys/rotate", "s3cret"); status != http.StatusNotImplemented {
+		t.Errorf("expected the key rotation of an unencrypted store to be unsupported but got status %d", status)
+	}
+}
+
+// adminRequest calls an admin API with the given bearer token and returns the status
+func adminRequest(t *testing.T, method string, url string, token string) int {
+	t.Helper()
+
+	req, err := http.NewRequest(method, url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	return resp.StatusCode
+}
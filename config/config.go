@@ -0,0 +1,409 @@
+// Package config loads the runtime configuration of the server. Every setting has a default, and
+// can be set in an optional YAML config file, by an environment variable and by a command line
+// flag, in increasing order of precedence: a flag overrides the environment, which overrides the
+// config file.
+package config
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"example.com/levo_app/logging"
+
+	yaml "gopkg.in/yaml.v2"
+)
+
+// EnvPrefix starts the names of the environment variables of the settings, the rest of the name is
+// the flag name in upper case with "_" for "-", e.g. LEVO_STORAGE_PATH for -storage-path
+const EnvPrefix = "LEVO_"
+
+// ConfigEnv is the environment variable naming the config file when the -config flag is not given
+const ConfigEnv = EnvPrefix + "CONFIG"
+
+// Config is the runtime configuration of the server
+type Config struct {
+	// ListenAddress is the address the server listens on, e.g. ":8080" or "127.0.0.1:8080"
+	ListenAddress string `yaml:"listen_address"`
+	// ShutdownTimeout is how long the requests in flight are waited for when the server is stopped
+	ShutdownTimeout time.Duration `yaml:"shutdown_timeout"`
+	// ShutdownDelay is how long the server keeps serving after it is stopped, with the readiness API
+	// failing, before it stops accepting connections
+	ShutdownDelay time.Duration `yaml:"shutdown_delay"`
+	Database      Database      `yaml:"database"`
+	Storage       Storage       `yaml:"storage"`
+	Limits        Limits        `yaml:"limits"`
+	Uploads       Uploads       `yaml:"uploads"`
+	Log           Log           `yaml:"log"`
+	// AdminToken is the bearer token of the admin API, the admin API is disabled if it is empty
+	AdminToken string `yaml:"admin_token"`
+}
+
+// Database configures the metadata database
+type Database struct {
+	// Driver is "postgres" or "sqlite"
+	Driver string `yaml:"driver"`
+	// DSN is the connection string of the postgres database, it has no default so that no credential is built in
+	DSN string `yaml:"dsn"`
+	// SQLitePath is the database file when Driver is "sqlite"
+	SQLitePath string `yaml:"sqlite_path"`
+	// MaxOpenConns limits the open connections to postgres, 0 means no limit
+	MaxOpenConns int `yaml:"max_open_conns"`
+	// MaxIdleConns is the number of idle connections to postgres kept for reuse
+	MaxIdleConns int `yaml:"max_idle_conns"`
+	// ConnMaxLifetime closes the connections to postgres after this time, 0 keeps them open
+	ConnMaxLifetime time.Duration `yaml:"conn_max_lifetime"`
+}
+
+// Storage configures the storage of the schema files
+type Storage struct {
+	// Backend is "file", "blob", "s3" or "git"
+	Backend string `yaml:"backend"`
+	// Path is the base directory of the file and blob backends
+	Path string `yaml:"path"`
+	// GitRepo is the bare repository of the git backend
+	GitRepo    string `yaml:"git_repo"`
+	S3Endpoint string `yaml:"s3_endpoint"`
+	S3Bucket   string `yaml:"s3_bucket"`
+	S3Prefix   string `yaml:"s3_prefix"`
+	// S3Region is the region requests to the s3 storage are signed for, empty reads AWS_REGION
+	S3Region string `yaml:"s3_region"`
+	// Keyring is the keyring file the versions are encrypted with, empty stores them unencrypted
+	Keyring string `yaml:"keyring"`
+	// Compression is "gzip" or "zstd", empty stores the versions uncompressed
+	Compression string `yaml:"compression"`
+	// DeltaSnapshotInterval enables the delta storage of the file backend, 0 stores every version in full
+	DeltaSnapshotInterval int64 `yaml:"delta_snapshot_interval"`
+}
+
+// Limits configures the limits of the uploads
+type Limits struct {
+	// MaxUploadSize is the maximum size of an uploaded schema file in bytes
+	MaxUploadSize int64 `yaml:"max_upload_size"`
+	// MultipartMemory is the size of a multipart upload kept in memory, in bytes
+	MultipartMemory int64 `yaml:"multipart_memory"`
+}
+
+// Uploads configures the resumable uploads
+type Uploads struct {
+	// Dir keeps the files of the uploads in progress
+	Dir string `yaml:"dir"`
+	// Expiry is the time after which an upload without new chunks is removed
+	Expiry time.Duration `yaml:"expiry"`
+	// MaxSessions is the maximum number of uploads in progress, zero means no limit
+	MaxSessions int `yaml:"max_sessions"`
+	// MaxBytes is the maximum size of all the uploads in progress in bytes, zero means no limit
+	MaxBytes int64 `yaml:"max_bytes"`
+}
+
+// Log configures the log lines of the server
+type Log struct {
+	// Level is "debug", "info", "warn" or "error", the lines below it are discarded
+	Level string `yaml:"level"`
+	// Format is "text" for key=value lines or "json" for one JSON object per line
+	Format string `yaml:"format"`
+}
+
+// Default returns the configuration used when nothing is set
+func Default() Config {
+	return Config{
+		ListenAddress:   ":8080",
+		ShutdownTimeout: 30 * time.Second,
+		Database: Database{
+			Driver:       "postgres",
+			SQLitePath:   "levo.db",
+			MaxIdleConns: 2,
+		},
+		Storage: Storage{
+			Backend:    "file",
+			Path:       "schema_uploads",
+			GitRepo:    "schemas.git",
+			S3Endpoint: "https://s3.amazonaws.com",
+		},
+		Limits: Limits{
+			MaxUploadSize:   10 << 20,
+			MultipartMemory: 1 << 20,
+		},
+		Uploads: Uploads{
+			Dir:         "upload_sessions",
+			Expiry:      24 * time.Hour,
+			MaxSessions: 100,
+			MaxBytes:    1 << 30,
+		},
+		Log: Log{
+			Level:  "info",
+			Format: logging.FormatText,
+		},
+	}
+}
+
+// setting is a configuration value that can be set by a flag and an environment variable
+type setting struct {
+	flag  string
+	usage string
+	// field returns a pointer to the value in a Config, a *string, *int, *int64 or *time.Duration
+	field func(cfg *Config) interface{}
+}
+
+// settings lists the flags and environment variables, the flag names of the first versions of the server are kept
+var settings = []setting{
+	{"listen", "address the server listens on", func(cfg *Config) interface{} { return &cfg.ListenAddress }},
+	{"shutdown-timeout", "time the requests in flight are waited for when the server is stopped", func(cfg *Config) interface{} { return &cfg.ShutdownTimeout }},
+	{"shutdown-delay", "time the server keeps serving when it is stopped, with /readyz failing, so load balancers stop routing to it", func(cfg *Config) interface{} { return &cfg.ShutdownDelay }},
+	{"db", "metadata database to use: postgres or sqlite", func(cfg *Config) interface{} { return &cfg.Database.Driver }},
+	{"db-dsn", "connection string of the postgres database", func(cfg *Config) interface{} { return &cfg.Database.DSN }},
+	{"sqlite-path", "path of the sqlite database file when -db=sqlite", func(cfg *Config) interface{} { return &cfg.Database.SQLitePath }},
+	{"db-max-open-conns", "maximum number of open connections to postgres (0 is unlimited)", func(cfg *Config) interface{} { return &cfg.Database.MaxOpenConns }},
+	{"db-max-idle-conns", "number of idle connections to postgres kept for reuse", func(cfg *Config) interface{} { return &cfg.Database.MaxIdleConns }},
+	{"db-conn-max-lifetime", "time after which connections to postgres are closed (0 keeps them open)", func(cfg *Config) interface{} { return &cfg.Database.ConnMaxLifetime }},
+	{"storage", "schema storage to use: file (one file per version), blob (content-addressed, deduplicated), s3 (S3-compatible bucket) or git (one commit per version)", func(cfg *Config) interface{} { return &cfg.Storage.Backend }},
+	{"storage-path", "base directory of the schema storage", func(cfg *Config) interface{} { return &cfg.Storage.Path }},
+	{"git-repo", "bare git repository of the schema files when -storage=git, created if it doesn't exist", func(cfg *Config) interface{} { return &cfg.Storage.GitRepo }},
+	{"s3-endpoint", "URL of the S3-compatible storage when -storage=s3, credentials are read from AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY", func(cfg *Config) interface{} { return &cfg.Storage.S3Endpoint }},
+	{"s3-bucket", "bucket of the schema files when -storage=s3", func(cfg *Config) interface{} { return &cfg.Storage.S3Bucket }},
+	{"s3-prefix", "prefix of the object keys of the schema files when -storage=s3", func(cfg *Config) interface{} { return &cfg.Storage.S3Prefix }},
+	{"s3-region", "region of the S3-compatible storage when -storage=s3 (empty reads AWS_REGION, us-east-1 by default)", func(cfg *Config) interface{} { return &cfg.Storage.S3Region }},
+	{"keyring", "encrypt the stored versions with the keys of this keyring file (empty stores them unencrypted)", func(cfg *Config) interface{} { return &cfg.Storage.Keyring }},
+	{"compression", "compress the stored versions with gzip or zstd (empty stores them uncompressed)", func(cfg *Config) interface{} { return &cfg.Storage.Compression }},
+	{"delta-snapshot-interval", "with -storage=file, store a full copy of every N-th version and line deltas in between (0 stores every version in full)", func(cfg *Config) interface{} { return &cfg.Storage.DeltaSnapshotInterval }},
+	{"max-upload-size", "maximum size of an uploaded schema file in bytes, larger uploads are rejected with 413", func(cfg *Config) interface{} { return &cfg.Limits.MaxUploadSize }},
+	{"multipart-memory", "bytes of a multipart upload kept in memory, the rest is buffered in temporary files", func(cfg *Config) interface{} { return &cfg.Limits.MultipartMemory }},
+	{"upload-dir", "directory of the files of the resumable uploads in progress", func(cfg *Config) interface{} { return &cfg.Uploads.Dir }},
+	{"upload-expiry", "time after which a resumable upload without new chunks is removed", func(cfg *Config) interface{} { return &cfg.Uploads.Expiry }},
+	{"upload-max-sessions", "maximum number of resumable uploads in progress, more are refused with 503, 0 for no limit", func(cfg *Config) interface{} { return &cfg.Uploads.MaxSessions }},
+	{"upload-max-bytes", "maximum size in bytes of all the resumable uploads in progress, more is refused with 503, 0 for no limit", func(cfg *Config) interface{} { return &cfg.Uploads.MaxBytes }},
+	{"admin-token", "bearer token required by the /admin API, which is disabled when empty; prefer the environment variable, flags are visible to other users", func(cfg *Config) interface{} { return &cfg.AdminToken }},
+	{"log-level", "lowest level of the logged lines: debug, info, warn or error", func(cfg *Config) interface{} { return &cfg.Log.Level }},
+	{"log-format", "format of the log lines: text (key=value) or json", func(cfg *Config) interface{} { return &cfg.Log.Format }},
+}
+
+// EnvName returns the environment variable of the setting of a flag
+func EnvName(flagName string) string {
+	return EnvPrefix + strings.ToUpper(strings.ReplaceAll(flagName, "-", "_"))
+}
+
+// Load parses the command line flags of the settings, and the -config flag, from args into fs and
+// returns the validated configuration. The arguments after the flags are left in fs.Args().
+// lookupEnv reads the environment, it is os.LookupEnv outside of tests.
+func Load(fs *flag.FlagSet, args []string, lookupEnv func(string) (string, bool)) (Config, error) {
+	// The flags are parsed into a separate copy of the defaults, only the flags that were given override the other sources
+	defaults := Default()
+	flagValues := Default()
+	configPath := fs.String("config", "", "YAML config file, also read from "+ConfigEnv+"; flags override the environment, which overrides the file")
+	for _, s := range settings {
+		usage := s.usage + " (" + EnvName(s.flag) + ")"
+		switch value := s.field(&flagValues).(type) {
+		case *string:
+			fs.StringVar(value, s.flag, *s.field(&defaults).(*string), usage)
+		case *int:
+			fs.IntVar(value, s.flag, *s.field(&defaults).(*int), usage)
+		case *int64:
+			fs.Int64Var(value, s.flag, *s.field(&defaults).(*int64), usage)
+		case *time.Duration:
+			fs.DurationVar(value, s.flag, *s.field(&defaults).(*time.Duration), usage)
+		}
+	}
+	err := fs.Parse(args)
+	if err != nil {
+		return Config{}, err
+	}
+
+	cfg := Default()
+	if *configPath == "" {
+		*configPath, _ = lookupEnv(ConfigEnv)
+	}
+	if *configPath != "" {
+		err = loadFile(&cfg, *configPath)
+		if err != nil {
+			return Config{}, err
+		}
+	}
+
+	for _, s := range settings {
+		value, ok := lookupEnv(EnvName(s.flag))
+		if !ok {
+			continue
+		}
+		err = setValue(s.field(&cfg), value)
+		if err != nil {
+			return Config{}, fmt.Errorf("invalid %s: %v", EnvName(s.flag), err)
+		}
+	}
+
+	fs.Visit(func(f *flag.Flag) {
+		for _, s := range settings {
+			if s.flag == f.Name {
+				// The flag package already parsed the value, it is copied as it is
+				copyValue(s.field(&cfg), s.field(&flagValues))
+			}
+		}
+	})
+
+	err = cfg.Validate()
+	if err != nil {
+		return Config{}, err
+	}
+
+	return cfg, nil
+}
+
+// loadFile reads a YAML config file over the configuration, the settings missing from the file keep their value
+func loadFile(cfg *Config, configPath string) error {
+	content, err := ioutil.ReadFile(configPath)
+	if err != nil {
+		return fmt.Errorf("failed to read config file: %v", err)
+	}
+
+	err = yaml.UnmarshalStrict(content, cfg)
+	if err != nil {
+		return fmt.Errorf("failed to parse config file '%s': %v", configPath, err)
+	}
+
+	return nil
+}
+
+// setValue parses a value from the environment into a field of the configuration
+func setValue(field interface{}, value string) error {
+	switch field := field.(type) {
+	case *string:
+		*field = value
+	case *int:
+		parsed, err := strconv.Atoi(value)
+		if err != nil {
+			return fmt.Errorf("'%s' is not an integer", value)
+		}
+		*field = parsed
+	case *int64:
+		parsed, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			return fmt.Errorf("'%s' is not an integer", value)
+		}
+		*field = parsed
+	case *time.Duration:
+		parsed, err := time.ParseDuration(value)
+		if err != nil {
+			return fmt.Errorf("'%s' is not a duration such as 30s or 24h", value)
+		}
+		*field = parsed
+	}
+
+	return nil
+}
+
+// copyValue copies the value of a field of a configuration to the same field of another one
+func copyValue(dst interface{}, src interface{}) {
+	switch dst := dst.(type) {
+	case *string:
+		*dst = *src.(*string)
+	case *int:
+		*dst = *src.(*int)
+	case *int64:
+		*dst = *src.(*int64)
+	case *time.Duration:
+		*dst = *src.(*time.Duration)
+	}
+}
+
+// Validate checks the configuration and reports all the invalid settings at once
+func (cfg Config) Validate() error {
+	var problems []string
+	invalid := func(format string, args ...interface{}) {
+		problems = append(problems, fmt.Sprintf(format, args...))
+	}
+
+	if _, _, err := net.SplitHostPort(cfg.ListenAddress); err != nil {
+		invalid("listen address '%s' must be host:port or :port", cfg.ListenAddress)
+	}
+
+	if cfg.ShutdownTimeout <= 0 {
+		invalid("shutdown timeout must be positive")
+	}
+	if cfg.ShutdownDelay < 0 {
+		invalid("shutdown delay can't be negative")
+	}
+
+	switch cfg.Database.Driver {
+	case "postgres":
+		if cfg.Database.DSN == "" {
+			invalid("database DSN is required with the postgres database, set -db-dsn, %s or database.dsn in the config file", EnvName("db-dsn"))
+		}
+	case "sqlite":
+		if cfg.Database.SQLitePath == "" {
+			invalid("sqlite path is required with the sqlite database")
+		}
+	default:
+		invalid("unsupported database '%s', expected postgres or sqlite", cfg.Database.Driver)
+	}
+	if cfg.Database.MaxOpenConns < 0 || cfg.Database.MaxIdleConns < 0 || cfg.Database.ConnMaxLifetime < 0 {
+		invalid("database pool settings can't be negative")
+	}
+
+	switch cfg.Storage.Backend {
+	case "file", "blob":
+		if cfg.Storage.Path == "" {
+			invalid("storage path is required with the %s storage", cfg.Storage.Backend)
+		}
+	case "s3":
+		if cfg.Storage.S3Bucket == "" {
+			invalid("s3 bucket is required with the s3 storage")
+		}
+	case "git":
+		if cfg.Storage.GitRepo == "" {
+			invalid("git repository is required with the git storage")
+		}
+	default:
+		invalid("unsupported storage '%s', expected file, blob, s3 or git", cfg.Storage.Backend)
+	}
+	if cfg.Storage.Compression != "" && cfg.Storage.Compression != "gzip" && cfg.Storage.Compression != "zstd" {
+		invalid("unsupported compression '%s', expected gzip or zstd", cfg.Storage.Compression)
+	}
+	if cfg.Storage.DeltaSnapshotInterval < 0 {
+		invalid("delta snapshot interval can't be negative")
+	}
+	// Encrypted versions never repeat and encrypted or compressed versions have no common lines,
+	// so these combinations would silently disable the deduplication, the deltas or the key rotation
+	if cfg.Storage.Keyring != "" && cfg.Storage.Backend == "blob" {
+		invalid("keyring can't be used with the blob storage, encrypted versions are never deduplicated")
+	}
+	if cfg.Storage.Keyring != "" && cfg.Storage.Backend == "git" {
+		invalid("keyring can't be used with the git storage, the git storage can't rewrite versions to rotate the keys")
+	}
+	if cfg.Storage.DeltaSnapshotInterval > 0 && (cfg.Storage.Keyring != "" || cfg.Storage.Compression != "") {
+		invalid("delta snapshot interval can't be used with a keyring or a compression, the deltas of encrypted or compressed versions are never smaller")
+	}
+
+	if cfg.Limits.MaxUploadSize <= 0 {
+		invalid("maximum upload size must be positive")
+	}
+	if cfg.Limits.MultipartMemory <= 0 {
+		invalid("multipart memory must be positive")
+	}
+	if cfg.Uploads.Dir == "" {
+		invalid("upload directory is required")
+	}
+	if cfg.Uploads.Expiry <= 0 {
+		invalid("upload expiry must be positive")
+	}
+	if cfg.Uploads.MaxSessions < 0 {
+		invalid("maximum number of uploads can't be negative")
+	}
+	if cfg.Uploads.MaxBytes < 0 {
+		invalid("maximum size of the uploads can't be negative")
+	}
+
+	if _, err := logging.ParseLevel(cfg.Log.Level); err != nil {
+		invalid("unsupported log level '%s', expected debug, info, warn or error", cfg.Log.Level)
+	}
+	if cfg.Log.Format != logging.FormatText && cfg.Log.Format != logging.FormatJSON {
+		invalid("unsupported log format '%s', expected text or json", cfg.Log.Format)
+	}
+
+	if len(problems) > 0 {
+		return fmt.Errorf("invalid configuration: %s", strings.Join(problems, "; "))
+	}
+	return nil
+}
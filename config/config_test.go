@@ -0,0 +1,173 @@
+package config
+
+import (
+	"flag"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// env returns a lookupEnv function reading the given variables
+func env(vars map[string]string) func(string) (string, bool) {
+	return func(name string) (string, bool) {
+		value, ok := vars[name]
+		return value, ok
+	}
+}
+
+// writeConfig writes a config file and returns its path
+func writeConfig(t *testing.T, content string) string {
+	t.Helper()
+
+	configPath := filepath.Join(t.TempDir(), "levo.yaml")
+	if err := ioutil.WriteFile(configPath, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return configPath
+}
+
+func TestLoadDefaults(t *testing.T) {
+	fs := flag.NewFlagSet("levo", flag.ContinueOnError)
+	cfg, err := Load(fs, []string{"-db-dsn", "postgres://localhost/levo", "fsck", "-rebuild"}, env(nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := Default()
+	expected.Database.DSN = "postgres://localhost/levo"
+	if cfg != expected {
+		t.Errorf("expected the default configuration but got %+v", cfg)
+	}
+	if strings.Join(fs.Args(), " ") != "fsck -rebuild" {
+		t.Errorf("expected the command to be left in the arguments but got %v", fs.Args())
+	}
+}
+
+func TestLoadPrecedence(t *testing.T) {
+	configPath := writeConfig(t, `
+listen_address: ":9000"
+database:
+  driver: sqlite
+  sqlite_path: file.db
+storage:
+  backend: blob
+  path: file-storage
+  s3_region: eu-west-1
+limits:
+  max_upload_size: 1000
+uploads:
+  expiry: 1h
+log:
+  level: debug
+`)
+
+	fs := flag.NewFlagSet("levo", flag.ContinueOnError)
+	cfg, err := Load(fs, []string{"-storage-path", "flag-storage", "-upload-expiry", "30m"}, env(map[string]string{
+		ConfigEnv:                configPath,
+		"LEVO_SQLITE_PATH":       "env.db",
+		"LEVO_STORAGE_PATH":      "env-storage",
+		"LEVO_MAX_UPLOAD_SIZE":   "2000",
+		"LEVO_DB_MAX_OPEN_CONNS": "5",
+		"LEVO_LOG_FORMAT":        "json",
+		"LEVO_S3_REGION":         "eu-central-1",
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := Default()
+	expected.ListenAddress = ":9000"
+	expected.Database.Driver = "sqlite"
+	expected.Database.SQLitePath = "env.db"
+	expected.Database.MaxOpenConns = 5
+	expected.Storage.Backend = "blob"
+	expected.Storage.Path = "flag-storage"
+	expected.Storage.S3Region = "eu-central-1"
+	expected.Limits.MaxUploadSize = 2000
+	expected.Uploads.Expiry = 30 * time.Minute
+	expected.Log.Level = "debug"
+	expected.Log.Format = "json"
+	if cfg != expected {
+		t.Errorf("expected\n%+v\nbut got\n%+v", expected, cfg)
+	}
+
+	// A flag set to its default value still overrides the other sources
+	fs = flag.NewFlagSet("levo", flag.ContinueOnError)
+	cfg, err = Load(fs, []string{"-config", configPath, "-storage", "file"}, env(nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.Storage.Backend != "file" || cfg.Storage.Path != "file-storage" {
+		t.Errorf("expected the file storage in 'file-storage' but got %+v", cfg.Storage)
+	}
+}
+
+func TestLoadErrors(t *testing.T) {
+	for name, test := range map[string]struct {
+		args     []string
+		env      map[string]string
+		config   string
+		expected string
+	}{
+		"invalid env value": {
+			env:      map[string]string{"LEVO_UPLOAD_EXPIRY": "tomorrow"},
+			expected: "invalid LEVO_UPLOAD_EXPIRY",
+		},
+		"unknown config key": {
+			config:   "storage:\n  bucket: schemas\n",
+			expected: "failed to parse config file",
+		},
+		"several invalid settings": {
+			args:     []string{"-listen", "8080", "-db", "sqlite", "-storage", "s3", "-compression", "lz4"},
+			expected: "invalid configuration: listen address '8080' must be host:port or :port; s3 bucket is required with the s3 storage; unsupported compression 'lz4'",
+		},
+		"invalid log settings": {
+			args:     []string{"-log-level", "verbose", "-log-format", "logfmt"},
+			expected: "unsupported log level 'verbose', expected debug, info, warn or error; unsupported log format 'logfmt', expected text or json",
+		},
+		"missing postgres DSN": {
+			expected: "database DSN is required with the postgres database",
+		},
+		"negative upload limits": {
+			args:     []string{"-db", "sqlite", "-upload-max-sessions", "-1", "-upload-max-bytes", "-1"},
+			expected: "maximum number of uploads can't be negative; maximum size of the uploads can't be negative",
+		},
+		"negative shutdown delay": {
+			args:     []string{"-db", "sqlite", "-shutdown-delay", "-5s"},
+			expected: "shutdown delay can't be negative",
+		},
+		"keyring with the blob storage": {
+			args:     []string{"-db", "sqlite", "-storage", "blob", "-keyring", "keys.json"},
+			expected: "keyring can't be used with the blob storage",
+		},
+		"keyring with the git storage": {
+			args:     []string{"-db", "sqlite", "-storage", "git", "-keyring", "keys.json"},
+			expected: "keyring can't be used with the git storage",
+		},
+		"deltas with a keyring": {
+			args:     []string{"-db", "sqlite", "-keyring", "keys.json", "-delta-snapshot-interval", "10"},
+			expected: "delta snapshot interval can't be used with a keyring or a compression",
+		},
+		"deltas with a compression": {
+			config:   "database:\n  driver: sqlite\nstorage:\n  compression: zstd\n  delta_snapshot_interval: 10\n",
+			expected: "delta snapshot interval can't be used with a keyring or a compression",
+		},
+		"invalid database": {
+			env:      map[string]string{"LEVO_DB": "mysql"},
+			expected: "unsupported database 'mysql'",
+		},
+	} {
+		args := test.args
+		if test.config != "" {
+			args = append([]string{"-config", writeConfig(t, test.config)}, args...)
+		}
+
+		fs := flag.NewFlagSet("levo", flag.ContinueOnError)
+		_, err := Load(fs, args, env(test.env))
+		if err == nil || !strings.Contains(err.Error(), test.expected) {
+			t.Errorf("%s: expected an error containing '%s' but got %v", name, test.expected, err)
+		}
+	}
+}
@@ -0,0 +1,124 @@
+package controller
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"net/http"
+	"strings"
+
+	"example.com/levo_app/service"
+	"example.com/levo_app/storage"
+)
+
+// AdminMiddleware only lets the requests with the admin token through, as "Authorization: Bearer <token>"
+func (ah *APIHandler) AdminMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if ah.AdminToken == "" {
+			http.Error(w, "the admin API is not enabled", http.StatusNotFound)
+			return
+		}
+
+		token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if subtle.ConstantTimeCompare([]byte(token), []byte(ah.AdminToken)) != 1 {
+			ah.logger(r.Context()).Warn("admin request rejected", "path", r.URL.Path)
+			w.Header().Set("WWW-Authenticate", `Bearer realm="admin"`)
+			http.Error(w, "a valid admin token is required", http.StatusUnauthorized)
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// FsckHandler handles the admin API reporting the differences between the database and the storage
+func (ah *APIHandler) FsckHandler(w http.ResponseWriter, r *http.Request) {
+	report, err := service.CheckConsistency(r.Context(), ah.Database, ah.Storage)
+	if err != nil {
+		ah.logger(r.Context()).Error("failed to check consistency", "error", err)
+		http.Error(w, "failed to check consistency", http.StatusInternalServerError)
+		return
+	}
+
+	writeJSON(w, report)
+}
+
+// RebuildMetadataHandler handles the admin API recreating the missing database records from the storage
+func (ah *APIHandler) RebuildMetadataHandler(w http.ResponseWriter, r *http.Request) {
+	report, err := service.RebuildMetadata(r.Context(), ah.Database, ah.Storage)
+	if err != nil {
+		ah.logger(r.Context()).Error("failed to rebuild metadata", "error", err)
+		http.Error(w, "failed to rebuild metadata", http.StatusInternalServerError)
+		return
+	}
+
+	writeJSON(w, report)
+}
+
+// NormalizeNamesHandler handles the admin API moving the schemas saved under names that are not
+// normalized to their normalized name
+func (ah *APIHandler) NormalizeNamesHandler(w http.ResponseWriter, r *http.Request) {
+	report, err := service.NormalizeNames(r.Context(), ah.Database, ah.Storage)
+	if err != nil {
+		ah.logger(r.Context()).Error("failed to normalize names", "error", err)
+		http.Error(w, "failed to normalize names", http.StatusInternalServerError)
+		return
+	}
+
+	writeJSON(w, report)
+}
+
+// StorageUsageHandler handles the admin API reporting the space saved by the storage, the usage is
+// reported by the first store of the chain of wrapped stores that can report it
+func (ah *APIHandler) StorageUsageHandler(w http.ResponseWriter, r *http.Request) {
+	var reporter storage.SpaceReporter
+	for store := ah.Storage; store != nil && reporter == nil; store = storage.Unwrap(store) {
+		reporter, _ = store.(storage.SpaceReporter)
+	}
+	if reporter == nil {
+		http.Error(w, "the storage doesn't report its space usage", http.StatusNotImplemented)
+		return
+	}
+
+	usage, err := reporter.SpaceUsage(r.Context())
+	if err != nil {
+		ah.logger(r.Context()).Error("failed to get storage usage", "error", err)
+		http.Error(w, "failed to get storage usage", http.StatusInternalServerError)
+		return
+	}
+
+	writeJSON(w, usage)
+}
+
+// RotateKeysHandler handles the admin API re-encrypting the stored versions with the primary key of the keyring
+func (ah *APIHandler) RotateKeysHandler(w http.ResponseWriter, r *http.Request) {
+	for store := ah.Storage; store != nil; store = storage.Unwrap(store) {
+		rotator, ok := store.(storage.KeyRotator)
+		if !ok {
+			continue
+		}
+
+		rotation, err := rotator.RotateKeys(r.Context())
+		if err != nil {
+			ah.logger(r.Context()).Error("failed to rotate keys", "error", err)
+			http.Error(w, "failed to rotate keys", http.StatusInternalServerError)
+			return
+		}
+
+		writeJSON(w, rotation)
+		return
+	}
+
+	http.Error(w, "the storage is not encrypted", http.StatusNotImplemented)
+}
+
+// writeJSON writes the value as a JSON response
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	respBytes, err := json.Marshal(v)
+	if err != nil {
+		http.Error(w, "failed to marshal response to JSON", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(respBytes)
+}
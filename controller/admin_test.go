@@ -0,0 +1,40 @@
+package controller
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"example.com/levo_app/db"
+	"example.com/levo_app/storage"
+)
+
+func TestStorageUsageHandler(t *testing.T) {
+	// The file store reports its usage even when the versions are compressed on top of it
+	store, err := storage.NewCompressedStore(storage.NewFileStore(t.TempDir()), storage.CompressionGzip)
+	if err != nil {
+		t.Fatal(err)
+	}
+	apiHandler := NewAPIHandler(store, db.NewMemoryRepository())
+	uploadSchema(t, apiHandler, "dummy.json", dummySchema)
+
+	rr := httptest.NewRecorder()
+	apiHandler.StorageUsageHandler(rr, httptest.NewRequest("GET", "/admin/storage/usage", nil))
+	if rr.Code != http.StatusOK {
+		t.Fatalf("expected status %d but got %d, body '%s'", http.StatusOK, rr.Code, rr.Body.String())
+	}
+	var usage storage.SpaceUsage
+	if err := json.Unmarshal(rr.Body.Bytes(), &usage); err != nil {
+		t.Fatal(err)
+	}
+	if usage.Versions != 1 {
+		t.Errorf("expected 1 version but got %+v", usage)
+	}
+
+	rr = httptest.NewRecorder()
+	newTestAPIHandler().StorageUsageHandler(rr, httptest.NewRequest("GET", "/admin/storage/usage", nil))
+	if rr.Code != http.StatusNotImplemented {
+		t.Errorf("expected status %d for the memory store but got %d", http.StatusNotImplemented, rr.Code)
+	}
+}
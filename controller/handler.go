@@ -1,9 +1,13 @@
 package controller
 
 import (
+	"context"
 	"encoding/json"
+	"bytes"
+	"errors"
 	"fmt"
-	"io/ioutil"
+	"io"
+	"mime"
 	"net/http"
 	"path"
 	"strconv"
@@ -11,6 +15,8 @@ import (
 	"time"
 
 	"example.com/levo_app/db"
+	"example.com/levo_app/logging"
+	"example.com/levo_app/schemaname"
 	"example.com/levo_app/storage"
 	"example.com/levo_app/service"
 
@@ -18,102 +24,262 @@ import (
 	yaml "gopkg.in/yaml.v2"
 )
 
+// Default limits of the uploads
+const (
+	// DefaultMaxUploadSize is the default maximum size of an uploaded schema file
+	DefaultMaxUploadSize = 10 << 20
+	// DefaultMultipartMemory is the default size of a multipart request kept in memory, the rest is
+	// buffered in temporary files until the request is handled
+	DefaultMultipartMemory = 1 << 20
+)
+
+// multipartOverhead is allowed on top of the maximum upload size for the other fields and the
+// boundaries of a multipart request
+const multipartOverhead = 64 << 10
+
 // APIHandler represents the API handler
 type APIHandler struct {
-	Storage  *storage.FileStore
-	Database *db.Database
+	Storage  storage.SchemaStore
+	Database db.Repository
+
+	// MaxUploadSize is the maximum size of an uploaded schema file in bytes, larger uploads are
+	// rejected with 413 Request Entity Too Large. Zero means DefaultMaxUploadSize.
+	MaxUploadSize int64
+	// MultipartMemory is the maximum size of a multipart request kept in memory while it is parsed.
+	// Zero means DefaultMultipartMemory.
+	MultipartMemory int64
+
+	// Uploads keeps the resumable upload sessions, resumable uploads are disabled if it is nil
+	Uploads *storage.UploadSessions
+
+	// AdminToken is the bearer token required by the admin API, the admin API is disabled if it is empty
+	AdminToken string
+
+	// Logger writes the log lines of the handlers, the lines of a request are tagged with its ID by
+	// RequestMiddleware. A nil Logger discards them.
+	Logger *logging.Logger
+	// Metrics records the requests, uploads and failures served on /metrics, metrics are disabled if it is nil
+	Metrics *Metrics
+
+	// shuttingDown is set to 1 by StartShutdown
+	shuttingDown int32
 }
 
 // NewAPIHandler creates a new API handler
-func NewAPIHandler(storage *storage.FileStore, database *db.Database) *APIHandler {
+func NewAPIHandler(storage storage.SchemaStore, database db.Repository) *APIHandler {
 	return &APIHandler{
 		Storage:  storage,
 		Database: database,
 	}
 }
 
+// logger returns the logger of the request, tagged with its ID, or the handler logger
+func (ah *APIHandler) logger(ctx context.Context) *logging.Logger {
+	return logging.FromContext(ctx, ah.Logger)
+}
+
 // UploadSchemaHandler handles the API for uploading a schema
 func (ah *APIHandler) UploadSchemaHandler(w http.ResponseWriter, r *http.Request) {
-	
-	
+	maxUploadSize := ah.maxUploadSize()
+	r.Body = maxBytesReader(w, r.Body, maxUploadSize+multipartOverhead)
+
+	multipartMemory := ah.MultipartMemory
+	if multipartMemory <= 0 {
+		multipartMemory = DefaultMultipartMemory
+	}
+	err := r.ParseMultipartForm(multipartMemory)
+	if err != nil {
+		ah.logger(r.Context()).Error("failed to parse multipart form", "error", err)
+		if isBodyTooLarge(err) {
+			uploadTooLarge(w, maxUploadSize)
+			return
+		}
+		http.Error(w, "failed to read file or 'file' field doesn't exist in request body", http.StatusBadRequest)
+		return
+	}
+	defer r.MultipartForm.RemoveAll()
+
 	file, fileHeaders, err := r.FormFile("file")
 	if err != nil {
-		fmt.Println("failed to read file", err)
+		ah.logger(r.Context()).Error("failed to read file", "error", err)
 		http.Error(w, "failed to read file or 'file' field doesn't exist in request body", http.StatusBadRequest)
 		return
 	}
 	defer file.Close()
 
-	
-
-	schemaFile, err := ioutil.ReadAll(file)
+	if fileHeaders.Size > maxUploadSize {
+		uploadTooLarge(w, maxUploadSize)
+		return
+	}
+	schemaFile, err := readUpload(file, fileHeaders.Size, maxUploadSize)
 	if err != nil {
-		fmt.Println("failed to read file", err)
+		ah.logger(r.Context()).Error("failed to read file", "error", err)
+		if errors.Is(err, errUploadTooLarge) {
+			uploadTooLarge(w, maxUploadSize)
+			return
+		}
 		http.Error(w, "failed to read file", http.StatusInternalServerError)
 		return
 	}
 
-	fmt.Println("File Read Succesfully")
-
-	// filename := r.FormValue("filename")
-	filename := fileHeaders.Filename
-	fileType := strings.ToLower(path.Ext(filename))
-	fileType = strings.TrimPrefix(fileType, ".")
+	// The schema is named by the path or the "name" field, or after the uploaded file for older clients
+	originalFilename := fileHeaders.Filename
+	name := mux.Vars(r)["name"]
+	if name == "" {
+		name = r.FormValue("name")
+	}
+	if name == "" {
+		name = originalFilename
+	}
+	filename, ok := normalizeSchemaName(w, name)
+	if !ok {
+		return
+	}
+	ah.saveSchemaVersion(w, r, schemaFile, filename, originalFilename, fileHeaders.Header.Get("Content-Type"))
+}
 
-	fmt.Println("File Type: ", fileType)
-	fmt.Println("File name: ", filename)
+// UploadRawSchemaHandler handles the API for uploading a schema sent as the request body, with a
+// JSON or YAML Content-Type, to the schema named in the path. Multipart requests are handled as
+// uploads of the "file" field.
+func (ah *APIHandler) UploadRawSchemaHandler(w http.ResponseWriter, r *http.Request) {
+	requestContentType := r.Header.Get("Content-Type")
+	if mediaType, _, _ := mime.ParseMediaType(requestContentType); mediaType == "multipart/form-data" {
+		ah.UploadSchemaHandler(w, r)
+		return
+	}
 
+	name, ok := mux.Vars(r)["name"]
+	if !ok {
+		http.Error(w, "name not found in request", http.StatusBadRequest)
+		return
+	}
+	filename, ok := normalizeSchemaName(w, name)
+	if !ok {
+		return
+	}
 
-	// Validate the schema file
-	err = service.ValidateSchema(schemaFile, fileType)
+	maxUploadSize := ah.maxUploadSize()
+	if r.ContentLength > maxUploadSize {
+		uploadTooLarge(w, maxUploadSize)
+		return
+	}
+	schemaFile, err := readUpload(maxBytesReader(w, r.Body, maxUploadSize), r.ContentLength, maxUploadSize)
 	if err != nil {
-		http.Error(w, fmt.Sprintf("INVALID SCHEMA: %v", err), http.StatusBadRequest)
+		ah.logger(r.Context()).Error("failed to read request body", "error", err)
+		if isBodyTooLarge(err) || errors.Is(err, errUploadTooLarge) {
+			uploadTooLarge(w, maxUploadSize)
+			return
+		}
+		http.Error(w, "failed to read request body", http.StatusBadRequest)
 		return
 	}
 
-	fmt.Println("File Validated Succesfully")
-
-	// Get the latest version number from the database
-	latestVersion, err := ah.Database.GetLatestSchemaVersion(filename)
-	if err != nil {
-		latestVersion = 0
+	// The original file name can be given by a header like "Content-Disposition: attachment; filename=api.json"
+	originalFilename := ""
+	if _, params, err := mime.ParseMediaType(r.Header.Get("Content-Disposition")); err == nil {
+		originalFilename = params["filename"]
 	}
 
-	fmt.Println("Latest version fetched Succesfully")
-	version := latestVersion + 1
+	ah.saveSchemaVersion(w, r, schemaFile, filename, originalFilename, requestContentType)
+}
 
-	err = ah.Storage.SaveSchema(schemaFile, filename, fileType, version)
+// saveSchemaVersion validates the uploaded schema file and saves it as the next version of the
+// schema, unless its content is the same as the latest version
+func (ah *APIHandler) saveSchemaVersion(w http.ResponseWriter, r *http.Request, schemaFile []byte, filename string, originalFilename string, fileContentType string) {
+	// Validate the schema file, its format is detected from the content and not from the file name
+	ah.Metrics.observeUpload(len(schemaFile))
+	fileType, err := service.DetectFormat(schemaFile, fileContentType)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusBadRequest)
+		ah.Metrics.validationFailed(err)
+		http.Error(w, fmt.Sprintf("INVALID SCHEMA: %v", err), http.StatusBadRequest)
 		return
 	}
 
-	fmt.Println("Schema saved succesfully in storage")
+	logger := ah.logger(r.Context()).With("name", filename)
+	logger.Debug("schema file validated", "format", fileType, "size", len(schemaFile), "original_filename", originalFilename)
 
-	timestamp := time.Now()
-	schema := db.Schema{
-		Version:   version,
-		Filename:  filename,
-		Timestamp: timestamp,
+	// Digest of the canonical form, so re-uploading the same content doesn't create a new version
+	contentDigest, err := service.CanonicalDigest(schemaFile, fileType)
+	if err != nil {
+		ah.Metrics.validationFailed(err)
+		http.Error(w, fmt.Sprintf("INVALID SCHEMA: %v", err), http.StatusBadRequest)
+		return
 	}
 
-	err = ah.Database.SaveSchema(schema)
-	if err != nil {
+	// Allocate the next version and save the file under it, the version is only recorded in the
+	// database once the file is stored so concurrent uploads can't get the same version
+	var storageErr error
+	var persistedVersion int64
+	schema, err := ah.Database.SaveNextSchemaVersion(r.Context(), db.Schema{
+		Filename:         filename,
+		Timestamp:        time.Now(),
+		Checksum:         service.Checksum(schemaFile),
+		ContentDigest:    contentDigest,
+		OriginalFilename: originalFilename,
+		Format:           fileType,
+	}, func(version int64) error {
+		storageErr = ah.Storage.SaveSchema(r.Context(), schemaFile, filename, fileType, version)
+		if errors.Is(storageErr, storage.ErrVersionExists) {
+			// The version was just allocated and has no record, so its file was left by an upload
+			// that crashed before its record was committed. Replace it, or no upload could succeed.
+			logger.Warn("replacing the orphaned file of an unrecorded version", "version", version)
+			storageErr = ah.Storage.DeleteSchema(r.Context(), filename, version)
+			if storageErr == nil {
+				storageErr = ah.Storage.SaveSchema(r.Context(), schemaFile, filename, fileType, version)
+			}
+		}
+		if storageErr != nil {
+			return storageErr
+		}
+		persistedVersion = version
+		logger.Debug("schema file stored", "version", version)
+		return nil
+	})
+	if storageErr != nil {
+		if errors.Is(storageErr, storage.ErrVersionExists) {
+			logger.Warn("schema version already stored", "error", storageErr)
+			http.Error(w, storageErr.Error(), http.StatusConflict)
+			return
+		}
+		if errors.Is(storageErr, schemaname.ErrInvalidName) {
+			logger.Warn("schema name rejected by the storage", "error", storageErr)
+			http.Error(w, storageErr.Error(), http.StatusBadRequest)
+			return
+		}
+		// The details of storage failures (paths, bucket names...) are only logged
+		logger.Error("failed to store schema file", "error", storageErr)
+		ah.Metrics.storageFailed("write", storageErr)
+		http.Error(w, "failed to store schema file", http.StatusInternalServerError)
+		return
+	}
+	unchanged := errors.Is(err, db.ErrSchemaUnchanged)
+	if err != nil && !unchanged {
+		logger.Error("failed to save schema", "error", err)
 		http.Error(w, "failed to save schema", http.StatusInternalServerError)
-		// remove from storage as well
-		err := ah.Storage.DeleteSchema(schema.Filename, schema.Version)
-		if err != nil {
-			fmt.Println("failed to delete schema from storage:", err)
+		if persistedVersion != 0 {
+			// remove from storage as well
+			err := ah.Storage.DeleteSchema(r.Context(), filename, persistedVersion)
+			if err != nil {
+				logger.Error("failed to delete schema from storage", "version", persistedVersion, "error", err)
+				ah.Metrics.storageFailed("delete", err)
+			}
 		}
 		return
 	}
 
-	fmt.Println("Schema saved succesfully in database")
-
 	// Give success response
 	resp := make(map[string]interface{})
-	resp["message"] = "Schema uploaded successfully"
+	if unchanged {
+		logger.Info("schema unchanged, latest version kept", "version", schema.Version)
+		resp["message"] = "Schema unchanged, latest version kept"
+	} else {
+		logger.Info("schema uploaded", "version", schema.Version, "format", fileType)
+		resp["message"] = "Schema uploaded successfully"
+	}
+	resp["name"] = filename
 	resp["version"] = schema.Version
+	resp["checksum"] = schema.Checksum
+	resp["unchanged"] = unchanged
 
 	respBytes, err := json.Marshal(resp)
 	if err != nil {
@@ -134,6 +300,10 @@ func (ah *APIHandler) GetSchemaHandler(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "filename not found in request", http.StatusBadRequest)
 		return
 	}
+	filename, ok = normalizeSchemaName(w, filename)
+	if !ok {
+		return
+	}
 
 	version, ok := vars["version"]
 	if !ok {
@@ -146,55 +316,317 @@ func (ah *APIHandler) GetSchemaHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	schema, err := ah.Database.GetSchema(filename, int64(versionInt))
+	schema, err := ah.Database.GetSchema(r.Context(), filename, int64(versionInt))
 	if err != nil {
-		fmt.Println("failed to get schema from database:", err)
+		ah.logger(r.Context()).Error("failed to get schema from database", "error", err)
 		http.Error(w, "schema not found", http.StatusNotFound)
 		return
 	}
 
-	schemaFile, err := ah.Storage.GetSchema(schema.Filename, schema.Version)
+	// Set before the conditional check, a 304 varies with the encoding as much as the body
+	if _, ok := ah.Storage.(storage.CompressedReader); ok {
+		w.Header().Set("Vary", "Accept-Encoding")
+	}
+	if setChecksumHeaders(w, r, schema.Checksum) {
+		return
+	}
+
+	if acceptsGzip(r) {
+		compressedFile, ok, err := ah.readGzipSchemaFile(r.Context(), schema)
+		if err != nil {
+			ah.logger(r.Context()).Error("failed to get schema from storage", "error", err)
+			http.Error(w, "failed to read schema file", http.StatusInternalServerError)
+			return
+		}
+		if ok {
+			// The Digest header is the checksum of the uncompressed file, and the ETag of the
+			// compressed body must differ from the ETag of the uncompressed one
+			w.Header().Del("Digest")
+			if schema.Checksum != "" {
+				w.Header().Set("ETag", gzipETag(schema.Checksum))
+			}
+			w.Header().Set("Content-Encoding", "gzip")
+			w.Header().Set("Content-Type", contentType(schemaFormat(schema)))
+			w.Write(compressedFile)
+			return
+		}
+	}
+
+	schemaFile, err := ah.readSchemaFile(r.Context(), schema)
 	if err != nil {
-		fmt.Println("failed to get schema from storage:", err)
+		ah.logger(r.Context()).Error("failed to get schema from storage", "error", err)
 		http.Error(w, "failed to read schema file", http.StatusInternalServerError)
 		return
 	}
 
-	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Content-Type", contentType(schemaFormat(schema)))
 	w.Write(schemaFile)
 }
 
-func (ah *APIHandler) GetLatestSchemaHandler(w http.ResponseWriter, r *http.Request) {
+// GetSchemaByDigestHandler handles the API for retrieving a schema file by the SHA-256 digest of its content
+func (ah *APIHandler) GetSchemaByDigestHandler(w http.ResponseWriter, r *http.Request) {
+	digest := strings.ToLower(mux.Vars(r)["sha256"])
+	if len(digest) != 64 || strings.Trim(digest, "0123456789abcdef") != "" {
+		http.Error(w, "sha256 must be a hex encoded SHA-256 digest", http.StatusBadRequest)
+		return
+	}
+
+	if setChecksumHeaders(w, r, digest) {
+		return
+	}
+
+	var schemaFile []byte
+	var format string
+	var err error
+	if digestStore, ok := ah.Storage.(storage.DigestStore); ok {
+		// Content-addressed stores serve the content directly, without a record to read the format from
+		schemaFile, err = digestStore.GetBlob(r.Context(), digest)
+		if err == nil {
+			err = service.VerifyChecksum(schemaFile, digest)
+		}
+		if err == nil {
+			format, _ = service.DetectFormat(schemaFile, "")
+		}
+		if err != nil && !errors.Is(err, storage.ErrSchemaNotFound) {
+			ah.Metrics.storageFailed("read", err)
+		}
+	} else {
+		var schema db.Schema
+		schema, err = ah.Database.GetSchemaByChecksum(r.Context(), digest)
+		if err == nil {
+			schemaFile, err = ah.readSchemaFile(r.Context(), schema)
+			format = schemaFormat(schema)
+		}
+	}
+	if err != nil {
+		if errors.Is(err, db.ErrSchemaNotFound) || errors.Is(err, storage.ErrSchemaNotFound) {
+			http.Error(w, "schema not found", http.StatusNotFound)
+			return
+		}
+		ah.logger(r.Context()).Error("failed to get schema by digest", "error", err)
+		http.Error(w, "failed to read schema file", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", contentType(format))
+	w.Write(schemaFile)
+}
+
+// maxUploadSize returns the maximum size of an uploaded schema file
+func (ah *APIHandler) maxUploadSize() int64 {
+	if ah.MaxUploadSize <= 0 {
+		return DefaultMaxUploadSize
+	}
+	return ah.MaxUploadSize
+}
+
+// errUploadTooLarge is returned by readUpload when the file exceeds the maximum upload size
+var errUploadTooLarge = errors.New("schema file is larger than the maximum upload size")
+
+// readUpload reads an uploaded schema file into a single buffer, allocated once when the size is
+// declared instead of being copied as it grows. The schema is validated as a whole document so it
+// has to be in memory, but never more than one copy of it, and reading stops past maxUploadSize.
+func readUpload(r io.Reader, size int64, maxUploadSize int64) ([]byte, error) {
+	var buf bytes.Buffer
+	if size > 0 && size <= maxUploadSize {
+		// ReadFrom needs bytes.MinRead bytes free to detect the end of the file without growing
+		buf.Grow(int(size) + bytes.MinRead)
+	}
+	_, err := buf.ReadFrom(io.LimitReader(r, maxUploadSize+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(buf.Len()) > maxUploadSize {
+		return nil, errUploadTooLarge
+	}
+	return buf.Bytes(), nil
+}
+
+// maxBytesReader is http.MaxBytesReader given the ResponseWriter of the server: the wrappers of
+// the middleware hide the method it calls to close the connection once the limit is exceeded
+func maxBytesReader(w http.ResponseWriter, body io.ReadCloser, n int64) io.ReadCloser {
+	for {
+		unwrapper, ok := w.(interface{ Unwrap() http.ResponseWriter })
+		if !ok {
+			break
+		}
+		w = unwrapper.Unwrap()
+	}
+	return http.MaxBytesReader(w, body, n)
+}
+
+// isBodyTooLarge reports whether reading a request body failed because it exceeded the limit of
+// http.MaxBytesReader, which doesn't return a typed error before Go 1.19
+func isBodyTooLarge(err error) bool {
+	return err != nil && strings.Contains(err.Error(), "http: request body too large")
+}
+
+// uploadTooLarge responds that the uploaded schema file exceeds the maximum upload size
+func uploadTooLarge(w http.ResponseWriter, maxUploadSize int64) {
+	http.Error(w, fmt.Sprintf("schema file is larger than the maximum upload size of %d bytes", maxUploadSize), http.StatusRequestEntityTooLarge)
+}
+
+// schemaFormat returns the format of a schema version, versions recorded without a format were
+// uploaded when schemas were named after their file
+func schemaFormat(schema db.Schema) string {
+	if schema.Format != "" {
+		return schema.Format
+	}
+	return strings.TrimPrefix(strings.ToLower(path.Ext(schema.Filename)), ".")
+}
+
+// contentType returns the media type of a schema file format
+func contentType(format string) string {
+	if format == "yaml" {
+		return "application/x-yaml"
+	}
+	return "application/json"
+}
+
+// normalizeSchemaName returns the normalized form of the schema name of a request, or answers
+// 400 Bad Request and returns false if the name is invalid
+func normalizeSchemaName(w http.ResponseWriter, name string) (string, bool) {
+	normalized, err := schemaname.Normalize(name)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return "", false
+	}
+
+	return normalized, true
+}
+
+// setChecksumHeaders sets the ETag and Digest headers of a schema version with the given checksum.
+// Versions are immutable, so it answers 304 Not Modified and returns true when the client already has it.
+func setChecksumHeaders(w http.ResponseWriter, r *http.Request, checksum string) bool {
+	if checksum == "" {
+		return false
+	}
+
+	etag := `"` + checksum + `"`
+	w.Header().Set("ETag", etag)
+	if digest, err := service.DigestHeader(checksum); err == nil {
+		w.Header().Set("Digest", digest)
+	}
+
+	// A client that got the gzip response has the same version, only compressed
+	ifNoneMatch := r.Header.Get("If-None-Match")
+	if ifNoneMatch == etag || (ifNoneMatch == gzipETag(checksum) && acceptsGzip(r)) {
+		w.Header().Set("ETag", ifNoneMatch)
+		w.WriteHeader(http.StatusNotModified)
+		return true
+	}
+
+	return false
+}
 
-	fmt.Println("Get Latest Schema Handler Called")
+// gzipETag returns the ETag of the gzip compressed body of a schema version with the given checksum
+func gzipETag(checksum string) string {
+	return `"` + checksum + `-gzip"`
+}
+
+// readSchemaFile reads the file of a schema version from the storage and verifies it against the
+// checksum recorded at upload, so that a corrupted file is never served
+func (ah *APIHandler) readSchemaFile(ctx context.Context, schema db.Schema) ([]byte, error) {
+	schemaFile, err := ah.Storage.GetSchema(ctx, schema.Filename, schema.Version)
+	if err != nil {
+		ah.Metrics.storageFailed("read", err)
+		return nil, err
+	}
+
+	err = service.VerifyChecksum(schemaFile, schema.Checksum)
+	if err != nil {
+		ah.Metrics.storageFailed("read", err)
+		return nil, fmt.Errorf("schema file '%s' version '%d' is corrupted: %v", schema.Filename, schema.Version, err)
+	}
+
+	return schemaFile, nil
+}
+
+// readGzipSchemaFile reads the file of a schema version as stored if the storage keeps it gzip
+// compressed, and reports false otherwise. The file is still decompressed and verified against its
+// checksum, only the compression is saved.
+func (ah *APIHandler) readGzipSchemaFile(ctx context.Context, schema db.Schema) ([]byte, bool, error) {
+	reader, ok := ah.Storage.(storage.CompressedReader)
+	if !ok {
+		return nil, false, nil
+	}
+
+	compressedFile, compression, err := reader.GetCompressedSchema(ctx, schema.Filename, schema.Version)
+	if err != nil {
+		ah.Metrics.storageFailed("read", err)
+		return nil, false, err
+	}
+	if compression != storage.CompressionGzip {
+		return nil, false, nil
+	}
+
+	schemaFile, err := storage.Decompress(compressedFile, ah.maxUploadSize())
+	if err == nil {
+		err = service.VerifyChecksum(schemaFile, schema.Checksum)
+	}
+	if err != nil {
+		ah.Metrics.storageFailed("read", err)
+		return nil, false, fmt.Errorf("schema file '%s' version '%d' is corrupted: %v", schema.Filename, schema.Version, err)
+	}
+
+	return compressedFile, true, nil
+}
+
+// acceptsGzip reports whether the Accept-Encoding header of the request allows a gzip response
+func acceptsGzip(r *http.Request) bool {
+	for _, value := range r.Header.Values("Accept-Encoding") {
+		for _, coding := range strings.Split(value, ",") {
+			params := strings.Split(coding, ";")
+			if !strings.EqualFold(strings.TrimSpace(params[0]), "gzip") {
+				continue
+			}
+			// "gzip;q=0" explicitly refuses gzip
+			for _, param := range params[1:] {
+				if q, err := strconv.ParseFloat(strings.TrimPrefix(strings.TrimSpace(param), "q="), 64); err == nil && q == 0 {
+					return false
+				}
+			}
+			return true
+		}
+	}
+
+	return false
+}
+
+func (ah *APIHandler) GetLatestSchemaHandler(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 	filename, ok := vars["filename"]
 	if !ok {
 		http.Error(w, "filename not found in request", http.StatusBadRequest)
 		return
 	}
-	fmt.Println("filename: ", filename)
-
-	latestVersion, err := ah.Database.GetLatestSchemaVersion(filename)
+	filename, ok = normalizeSchemaName(w, filename)
+	if !ok {
+		return
+	}
+	latestVersion, err := ah.Database.GetLatestSchemaVersion(r.Context(), filename)
 	if err != nil {
-		fmt.Println("failed to get latest schema version:", err)
+		ah.logger(r.Context()).Error("failed to get latest schema version", "error", err)
 		http.Error(w, "failed to get latest schema version", http.StatusInternalServerError)
 		return
 	}
 
-	schemaFile, err := ah.Storage.GetSchema(filename, latestVersion)
+	schema, err := ah.Database.GetSchema(r.Context(), filename, latestVersion)
 	if err != nil {
-		fmt.Println("failed to get schema from storage:", err)
-		http.Error(w, "failed to read schema file", http.StatusInternalServerError)
+		ah.logger(r.Context()).Error("failed to get schema from database", "error", err)
+		http.Error(w, "schema not found", http.StatusNotFound)
 		return
 	}
 
+	schemaFile, err := ah.readSchemaFile(r.Context(), schema)
+	if err != nil {
+		ah.logger(r.Context()).Error("failed to get schema from storage", "error", err)
+		http.Error(w, "failed to read schema file", http.StatusInternalServerError)
+		return
+	}
 
-	// Check the file type
-	fileType := strings.ToLower(path.Ext(filename))
-	fileType = strings.TrimPrefix(fileType, ".")
 
-	if fileType == "yaml" {
+	if schemaFormat(schema) == "yaml" {
 		resp := make(map[string]interface{})
 		resp["version"] = latestVersion
 
@@ -252,20 +684,36 @@ func (ah *APIHandler) GetAllVersionsHandler(w http.ResponseWriter, r *http.Reque
 		http.Error(w, "filename not found in request", http.StatusBadRequest)
 		return
 	}
+	filename, ok = normalizeSchemaName(w, filename)
+	if !ok {
+		return
+	}
 
 
-	fmt.Println("filename: ", filename)
-
-	// Call the storage method to retrieve the versions for the specified filename
-	versions, err := ah.Database.GetAllVersionsForSchema(filename)
+	// Call the database method to retrieve the versions for the specified filename
+	schemas, err := ah.Database.ListSchemaVersions(r.Context(), filename)
 	if err != nil {
-		fmt.Println("failed to get versions for schema:", err)
+		ah.logger(r.Context()).Error("failed to get versions for schema", "error", err)
 		http.Error(w, "failed to get versions for schema", http.StatusInternalServerError)
 		return
 	}
 
+	versions := []int64{}
+	details := []map[string]interface{}{}
+	for _, schema := range schemas {
+		versions = append(versions, schema.Version)
+		details = append(details, map[string]interface{}{
+			"version":           schema.Version,
+			"checksum":          schema.Checksum,
+			"created_on":        schema.Timestamp,
+			"format":            schemaFormat(schema),
+			"original_filename": schema.OriginalFilename,
+		})
+	}
+
 	resp := make(map[string]interface{})
 	resp["available_versions"] = versions
+	resp["versions"] = details
 
 	// Convert the versions to JSON
 	jsonVersions, err := json.Marshal(resp)
@@ -2,35 +2,70 @@ package controller
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
 	"mime/multipart"
 	"net/http"
 	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
 	"testing"
 
 	"example.com/levo_app/db"
+	"example.com/levo_app/service"
 	"example.com/levo_app/storage"
 	"github.com/gorilla/mux"
 )
 
-func TestUploadSchemaHandler(t *testing.T) {
-	// Create a mock HTTP request with a file
+var dummySchema = []byte(`{
+		"openapi": "3.0.1",
+		"info": {
+		  "title": "OWASP crAPI API",
+		  "version": "1.0"
+		}
+		}`)
+
+var dummySchemaV2 = []byte(`{
+		"openapi": "3.0.1",
+		"info": {
+		  "title": "OWASP crAPI API",
+		  "version": "2.0"
+		}
+		}`)
+
+// newTestAPIHandler creates an API handler backed by in-memory storage and metadata
+func newTestAPIHandler() *APIHandler {
+	return NewAPIHandler(storage.NewMemoryStore(), db.NewMemoryRepository())
+}
+
+// newUploadRequest creates a multipart upload request with the given file in the "file" field
+func newUploadRequest(t *testing.T, filename string, fileContents []byte) *http.Request {
+	t.Helper()
+
+	return newNamedUploadRequest(t, "", filename, fileContents)
+}
+
+// newNamedUploadRequest creates a multipart upload request with the schema name in the "name" field, if it is not empty
+func newNamedUploadRequest(t *testing.T, name string, filename string, fileContents []byte) *http.Request {
+	t.Helper()
+
 	// Create a buffer to store the request body
 	bodyBuf := &bytes.Buffer{}
 
 	// Create a new multipart writer
 	writer := multipart.NewWriter(bodyBuf)
+	if name != "" {
+		if err := writer.WriteField("name", name); err != nil {
+			t.Fatal(err)
+		}
+	}
 
 	// Create a file part with the desired content and filename
-	fileContents := []byte(`{
-		"openapi": "3.0.1",
-		"info": {
-		  "title": "OWASP crAPI API",
-		  "version": "1.0"
-		}
-		}`)
-	fileWriter, err := writer.CreateFormFile("file", "dummy.json")
+	fileWriter, err := writer.CreateFormFile("file", filename)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -48,67 +83,514 @@ func TestUploadSchemaHandler(t *testing.T) {
 	if err != nil {
 		t.Fatal(err)
 	}
-
-	// req.Header.Set("Content-Type", "multipart/form-data")
 	req.Header.Set("Content-Type", writer.FormDataContentType())
 
-	// Create a mock HTTP response recorder
+	return req
+}
+
+// uploadSchema uploads the given file and fails the test if the upload is not successful
+func uploadSchema(t *testing.T, apiHandler *APIHandler, filename string, fileContents []byte) {
+	t.Helper()
+
 	rr := httptest.NewRecorder()
+	apiHandler.UploadSchemaHandler(rr, newUploadRequest(t, filename, fileContents))
+	if rr.Code != http.StatusOK {
+		t.Fatalf("failed to upload '%s': status %d, body '%s'", filename, rr.Code, rr.Body.String())
+	}
+}
+
+func TestUploadSchemaHandler(t *testing.T) {
+	apiHandler := newTestAPIHandler()
+
+	for _, upload := range []struct {
+		fileContents     []byte
+		expectedResponse string
+	}{
+		{dummySchema, `{"checksum":"` + service.Checksum(dummySchema) + `","message":"Schema uploaded successfully","name":"dummy.json","unchanged":false,"version":1}`},
+		{dummySchemaV2, `{"checksum":"` + service.Checksum(dummySchemaV2) + `","message":"Schema uploaded successfully","name":"dummy.json","unchanged":false,"version":2}`},
+	} {
+		expectedResponse := upload.expectedResponse
+
+		// Create a mock HTTP response recorder
+		rr := httptest.NewRecorder()
+
+		// Call the handler function
+		apiHandler.UploadSchemaHandler(rr, newUploadRequest(t, "dummy.json", upload.fileContents))
+
+		// Check the response status code
+		if rr.Code != http.StatusOK {
+			t.Errorf("expected status %d but got %d", http.StatusOK, rr.Code)
+		}
+
+		// Check the response body
+		if rr.Body.String() != expectedResponse {
+			t.Errorf("expected response '%s' but got '%s'", expectedResponse, rr.Body.String())
+		}
+	}
+}
 
-	// Initialize the database connection
-	database, err := db.Initialize()
+func TestUploadSchemaHandlerOrphanedFile(t *testing.T) {
+	ctx := context.Background()
+	apiHandler := NewAPIHandler(storage.NewFileStore(t.TempDir()), db.NewMemoryRepository())
+	uploadSchema(t, apiHandler, "dummy.json", dummySchema)
+
+	// A crash between storing version 2 and committing its record leaves its file behind
+	orphan := []byte(`{"openapi": "3.0.0"}`)
+	if err := apiHandler.Storage.SaveSchema(ctx, orphan, "dummy.json", "json", 2); err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 2; i++ {
+		rr := httptest.NewRecorder()
+		apiHandler.UploadSchemaHandler(rr, newUploadRequest(t, "dummy.json", dummySchemaV2))
+		if rr.Code != http.StatusOK {
+			t.Fatalf("expected status %d after the orphaned file but got %d, body '%s'", http.StatusOK, rr.Code, rr.Body.String())
+		}
+	}
+
+	versions, err := apiHandler.Database.GetAllVersionsForSchema(ctx, "dummy.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(versions, []int64{1, 2}) {
+		t.Errorf("expected versions [1 2] but got %v", versions)
+	}
+	stored, err := apiHandler.Storage.GetSchema(ctx, "dummy.json", 2)
 	if err != nil {
-		fmt.Errorf("Failed to initialize database: %v", err)
+		t.Fatal(err)
+	}
+	if !bytes.Equal(stored, dummySchemaV2) {
+		t.Errorf("expected the orphaned file to be replaced but got '%s'", stored)
 	}
-	defer database.DB.Close()
+}
 
-	// Initialize the file storage
-	fileStore := storage.NewFileStore("test_dummy_directory")
+func TestUploadSchemaHandlerStorageError(t *testing.T) {
+	// A storage directory that is a file fails every write
+	dir := filepath.Join(t.TempDir(), "schemas")
+	if err := os.WriteFile(dir, nil, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	apiHandler := NewAPIHandler(storage.NewFileStore(dir), db.NewMemoryRepository())
 
-	apiHandler := NewAPIHandler(fileStore, database)
+	rr := httptest.NewRecorder()
+	apiHandler.UploadSchemaHandler(rr, newUploadRequest(t, "dummy.json", dummySchema))
+	if rr.Code != http.StatusInternalServerError {
+		t.Errorf("expected status %d but got %d", http.StatusInternalServerError, rr.Code)
+	}
+	if strings.Contains(rr.Body.String(), dir) {
+		t.Errorf("expected the storage details to be hidden but got '%s'", rr.Body.String())
+	}
+}
 
-	// Call the handler function
-	fmt.Println(req)
-	apiHandler.UploadSchemaHandler(rr, req)
+func TestUploadSchemaHandlerUnchanged(t *testing.T) {
+	apiHandler := newTestAPIHandler()
+	uploadSchema(t, apiHandler, "dummy.json", dummySchema)
+
+	// Same document with different formatting and key order
+	reformatted := []byte(`{"info": {"version": "1.0", "title": "OWASP crAPI API"}, "openapi": "3.0.1"}`)
+
+	rr := httptest.NewRecorder()
+	apiHandler.UploadSchemaHandler(rr, newUploadRequest(t, "dummy.json", reformatted))
 
-	// Check the response status code
 	if rr.Code != http.StatusOK {
-		t.Errorf("expected status %d but got %d", http.StatusOK, rr.Code)
+		t.Fatalf("expected status %d but got %d", http.StatusOK, rr.Code)
 	}
-
-	// Check the response body
-	expectedResponse := `{"message":"Schema uploaded successfully","version":5}` // CHANGE THIS EVERY TIME SINCE VERSION INCREMENTS
+	expectedResponse := `{"checksum":"` + service.Checksum(dummySchema) + `","message":"Schema unchanged, latest version kept","name":"dummy.json","unchanged":true,"version":1}`
 	if rr.Body.String() != expectedResponse {
 		t.Errorf("expected response '%s' but got '%s'", expectedResponse, rr.Body.String())
 	}
+
+	versions, err := apiHandler.Storage.ListVersions(context.Background(), "dummy.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(versions) != 1 {
+		t.Errorf("expected a single stored version but got %v", versions)
+	}
 }
 
+func TestUploadSchemaHandlerNamed(t *testing.T) {
+	apiHandler := newTestAPIHandler()
+
+	// Files with the same name from two services don't collide, and renaming a file keeps its history
+	for _, upload := range []struct {
+		name, filename string
+		fileContents   []byte
+		version        int64
+	}{
+		{"payments", "api.json", dummySchema, 1},
+		{"orders", "api.json", dummySchema, 1},
+		{"payments", "payments-api.json", dummySchemaV2, 2},
+	} {
+		rr := httptest.NewRecorder()
+		apiHandler.UploadSchemaHandler(rr, newNamedUploadRequest(t, upload.name, upload.filename, upload.fileContents))
+		if rr.Code != http.StatusOK {
+			t.Fatalf("failed to upload '%s': status %d, body '%s'", upload.name, rr.Code, rr.Body.String())
+		}
 
-func TestGetLatestSchemaHandler(t *testing.T) {
-	// Create a mock HTTP request with path variables
-	req, err := http.NewRequest("GET", "/getLatestSchema/dummy.json", nil)
+		var resp struct {
+			Name    string `json:"name"`
+			Version int64  `json:"version"`
+		}
+		if err := json.Unmarshal(rr.Body.Bytes(), &resp); err != nil {
+			t.Fatal(err)
+		}
+		if resp.Name != upload.name || resp.Version != upload.version {
+			t.Errorf("expected '%s' version %d but got %+v", upload.name, upload.version, resp)
+		}
+	}
+
+	schema, err := apiHandler.Database.GetSchema(context.Background(), "payments", 2)
 	if err != nil {
 		t.Fatal(err)
 	}
+	if schema.OriginalFilename != "payments-api.json" || schema.Format != "json" {
+		t.Errorf("expected the original filename and the format to be recorded but got %+v", schema)
+	}
+	if _, err := apiHandler.Database.GetSchema(context.Background(), "api.json", 1); err == nil {
+		t.Error("expected no schema to be named after the uploaded file")
+	}
+}
 
-	// Set path variables in the request's context
+func TestUploadRawSchemaHandler(t *testing.T) {
+	apiHandler := newTestAPIHandler()
+
+	upload := func(method string, contentType string, fileContents []byte) *httptest.ResponseRecorder {
+		t.Helper()
+		req, err := http.NewRequest(method, "/schemas/payments/versions", bytes.NewReader(fileContents))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Content-Type", contentType)
+		req = mux.SetURLVars(req, map[string]string{"name": "payments"})
+		rr := httptest.NewRecorder()
+		apiHandler.UploadRawSchemaHandler(rr, req)
+		return rr
+	}
+
+	rr := upload("PUT", "application/json", dummySchema)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("expected status %d but got %d, body '%s'", http.StatusOK, rr.Code, rr.Body.String())
+	}
+	rr = upload("POST", "application/yaml", []byte("openapi: 3.0.1\ninfo:\n  title: payments\n"))
+	if rr.Code != http.StatusOK {
+		t.Fatalf("expected status %d but got %d, body '%s'", http.StatusOK, rr.Code, rr.Body.String())
+	}
+	if !strings.Contains(rr.Body.String(), `"version":2`) {
+		t.Errorf("expected version 2 to be created but got '%s'", rr.Body.String())
+	}
+
+	schema, err := apiHandler.Database.GetSchema(context.Background(), "payments", 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if schema.Format != "yaml" {
+		t.Errorf("expected version 2 to be yaml but got '%s'", schema.Format)
+	}
+
+	// A body that doesn't match its Content-Type is rejected like an invalid file
+	if rr := upload("PUT", "application/json", []byte("openapi: 3.0.1\n")); rr.Code != http.StatusBadRequest {
+		t.Errorf("expected status %d for an invalid body but got %d", http.StatusBadRequest, rr.Code)
+	}
+
+	// Multipart requests to the same route are uploads of the "file" field
+	req := newUploadRequest(t, "api.json", dummySchemaV2)
+	req = mux.SetURLVars(req, map[string]string{"name": "payments"})
+	rr = httptest.NewRecorder()
+	apiHandler.UploadRawSchemaHandler(rr, req)
+	if rr.Code != http.StatusOK || !strings.Contains(rr.Body.String(), `"version":3`) {
+		t.Errorf("expected the multipart upload to create version 3 but got status %d, body '%s'", rr.Code, rr.Body.String())
+	}
+}
+
+func TestUploadSizeLimit(t *testing.T) {
+	apiHandler := newTestAPIHandler()
+	apiHandler.MaxUploadSize = int64(len(dummySchema))
+	apiHandler.MultipartMemory = 16
+
+	// A file of the maximum size is accepted, the multipart form is buffered on disk
+	uploadSchema(t, apiHandler, "dummy.json", dummySchema)
+
+	tooLarge := append([]byte(" "), dummySchemaV2...)
+	rr := httptest.NewRecorder()
+	apiHandler.UploadSchemaHandler(rr, newUploadRequest(t, "dummy.json", tooLarge))
+	if rr.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("expected status %d for a multipart upload but got %d", http.StatusRequestEntityTooLarge, rr.Code)
+	}
+
+	// Multipart requests far above the limit are cut off while they are read
+	rr = httptest.NewRecorder()
+	apiHandler.UploadSchemaHandler(rr, newUploadRequest(t, "dummy.json", bytes.Repeat(tooLarge, 1000)))
+	if rr.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("expected status %d for a large multipart request but got %d", http.StatusRequestEntityTooLarge, rr.Code)
+	}
+
+	for _, contentLength := range []int64{int64(len(tooLarge)), -1} {
+		req, err := http.NewRequest("PUT", "/schemas/dummy.json/versions", bytes.NewReader(tooLarge))
+		if err != nil {
+			t.Fatal(err)
+		}
+		// An unknown length is only checked while the body is read
+		req.ContentLength = contentLength
+		req.Header.Set("Content-Type", "application/json")
+		req = mux.SetURLVars(req, map[string]string{"name": "dummy.json"})
+		rr = httptest.NewRecorder()
+		apiHandler.UploadRawSchemaHandler(rr, req)
+		if rr.Code != http.StatusRequestEntityTooLarge {
+			t.Errorf("expected status %d for a raw upload of length %d but got %d", http.StatusRequestEntityTooLarge, contentLength, rr.Code)
+		}
+	}
+
+	versions, err := apiHandler.Database.GetAllVersionsForSchema(context.Background(), "dummy.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(versions) != 1 {
+		t.Errorf("expected the uploads over the limit not to create versions but got %d versions", len(versions))
+	}
+}
+
+func TestUploadSchemaHandlerInvalidSchema(t *testing.T) {
+	apiHandler := newTestAPIHandler()
+
+	for filename, fileContents := range map[string][]byte{
+		"broken.json": []byte(`{"openapi": `),
+		"broken.yaml": []byte("openapi: [3.0.1"),
+		"notes.txt":   []byte("just some notes"),
+		"empty.json":  []byte(""),
+	} {
+		rr := httptest.NewRecorder()
+		apiHandler.UploadSchemaHandler(rr, newUploadRequest(t, filename, fileContents))
+
+		if rr.Code != http.StatusBadRequest {
+			t.Errorf("%s: expected status %d but got %d", filename, http.StatusBadRequest, rr.Code)
+		}
+	}
+}
+
+func TestUploadSchemaHandlerDetectsFormat(t *testing.T) {
+	apiHandler := newTestAPIHandler()
+
+	// The format comes from the content, whatever the extension of the file
+	for filename, format := range map[string]string{
+		"openapi.yml": "yaml",
+		"openapi":     "yaml",
+		"openapi.txt": "json",
+	} {
+		fileContents := dummySchema
+		if format == "yaml" {
+			fileContents = []byte("openapi: 3.0.1\ninfo:\n  title: " + filename + "\n")
+		}
+		uploadSchema(t, apiHandler, filename, fileContents)
+
+		schema, err := apiHandler.Database.GetSchema(context.Background(), filename, 1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if schema.Format != format {
+			t.Errorf("%s: expected format %s but got '%s'", filename, format, schema.Format)
+		}
+
+		req, err := http.NewRequest("GET", "/getSchemaByVersion/"+filename+"/1", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req = mux.SetURLVars(req, map[string]string{"filename": filename, "version": "1"})
+		rr := httptest.NewRecorder()
+		apiHandler.GetSchemaHandler(rr, req)
+		if rr.Code != http.StatusOK || rr.Body.String() != string(fileContents) {
+			t.Errorf("%s: failed to read the schema back, status %d", filename, rr.Code)
+		}
+		if expected := contentType(format); rr.Header().Get("Content-Type") != expected {
+			t.Errorf("%s: expected content type %s but got %s", filename, expected, rr.Header().Get("Content-Type"))
+		}
+	}
+}
+
+func TestSchemaNameValidation(t *testing.T) {
+	apiHandler := newTestAPIHandler()
+
+	for _, filename := range []string{"..", ".hidden.json", "api spec.json", "con.json", "%2e%2e.json"} {
+		rr := httptest.NewRecorder()
+		apiHandler.UploadSchemaHandler(rr, newUploadRequest(t, filename, dummySchema))
+		if rr.Code != http.StatusBadRequest {
+			t.Errorf("expected status %d for upload of '%s' but got %d", http.StatusBadRequest, filename, rr.Code)
+		}
+		if !strings.Contains(rr.Body.String(), "invalid schema name") {
+			t.Errorf("expected an invalid schema name error for '%s' but got '%s'", filename, rr.Body.String())
+		}
+	}
+
+	for _, filename := range []string{"../../etc/passwd", "..", "dummy.json/..", "a\\..\\b.json"} {
+		req, err := http.NewRequest("GET", "/getSchemaByVersion/x/1", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req = mux.SetURLVars(req, map[string]string{
+			"filename": filename,
+			"version":  "1",
+		})
+		rr := httptest.NewRecorder()
+		apiHandler.GetSchemaHandler(rr, req)
+		if rr.Code != http.StatusBadRequest {
+			t.Errorf("expected status %d for '%s' but got %d", http.StatusBadRequest, filename, rr.Code)
+		}
+	}
+
+	// Names are case-insensitive
+	uploadSchema(t, apiHandler, "Dummy.JSON", dummySchema)
+	req, err := http.NewRequest("GET", "/getAllVersions/DUMMY.json", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req = mux.SetURLVars(req, map[string]string{"filename": "DUMMY.json"})
+	rr := httptest.NewRecorder()
+	apiHandler.GetAllVersionsHandler(rr, req)
+	if !strings.Contains(rr.Body.String(), `"available_versions":[1]`) {
+		t.Errorf("expected version 1 of dummy.json but got '%s'", rr.Body.String())
+	}
+}
+
+func TestGetSchemaHandler(t *testing.T) {
+	apiHandler := newTestAPIHandler()
+	uploadSchema(t, apiHandler, "dummy.json", dummySchema)
+
+	req, err := http.NewRequest("GET", "/getSchemaByVersion/dummy.json/1", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
 	req = mux.SetURLVars(req, map[string]string{
 		"filename": "dummy.json",
+		"version":  "1",
 	})
 
-	// Create a mock HTTP response recorder
 	rr := httptest.NewRecorder()
+	apiHandler.GetSchemaHandler(rr, req)
+
+	if rr.Code != http.StatusOK {
+		t.Errorf("expected status %d but got %d", http.StatusOK, rr.Code)
+	}
+	if !bytes.Equal(rr.Body.Bytes(), dummySchema) {
+		t.Errorf("expected schema '%s' but got '%s'", dummySchema, rr.Body.String())
+	}
+	etag := `"` + service.Checksum(dummySchema) + `"`
+	if rr.Header().Get("ETag") != etag {
+		t.Errorf("expected ETag %s but got %s", etag, rr.Header().Get("ETag"))
+	}
+	if !strings.HasPrefix(rr.Header().Get("Digest"), "sha-256=") {
+		t.Errorf("expected a sha-256 Digest header but got '%s'", rr.Header().Get("Digest"))
+	}
+
+	// A client that already has the version gets no body
+	req.Header.Set("If-None-Match", etag)
+	rr = httptest.NewRecorder()
+	apiHandler.GetSchemaHandler(rr, req)
+
+	if rr.Code != http.StatusNotModified {
+		t.Errorf("expected status %d but got %d", http.StatusNotModified, rr.Code)
+	}
+	req.Header.Del("If-None-Match")
+
+	// Unknown versions are reported as not found
+	req = mux.SetURLVars(req, map[string]string{
+		"filename": "dummy.json",
+		"version":  "2",
+	})
+	rr = httptest.NewRecorder()
+	apiHandler.GetSchemaHandler(rr, req)
+
+	if rr.Code != http.StatusNotFound {
+		t.Errorf("expected status %d but got %d", http.StatusNotFound, rr.Code)
+	}
+}
+
+func TestGetSchemaHandlerGzip(t *testing.T) {
+	compressedStore, err := storage.NewCompressedStore(storage.NewMemoryStore(), storage.CompressionGzip)
+	if err != nil {
+		t.Fatal(err)
+	}
+	apiHandler := NewAPIHandler(compressedStore, db.NewMemoryRepository())
+	uploadSchema(t, apiHandler, "dummy.json", dummySchema)
+
+	req, err := http.NewRequest("GET", "/getSchemaByVersion/dummy.json/1", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req = mux.SetURLVars(req, map[string]string{
+		"filename": "dummy.json",
+		"version":  "1",
+	})
+
+	// Clients accepting gzip get the stored bytes
+	req.Header.Set("Accept-Encoding", "br, gzip;q=0.8")
+	rr := httptest.NewRecorder()
+	apiHandler.GetSchemaHandler(rr, req)
+
+	if rr.Code != http.StatusOK {
+		t.Errorf("expected status %d but got %d", http.StatusOK, rr.Code)
+	}
+	if rr.Header().Get("Content-Encoding") != "gzip" {
+		t.Errorf("expected a gzip response but got Content-Encoding '%s'", rr.Header().Get("Content-Encoding"))
+	}
+	schemaFile, err := storage.Decompress(rr.Body.Bytes(), DefaultMaxUploadSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(schemaFile, dummySchema) {
+		t.Errorf("expected schema '%s' but got '%s'", dummySchema, schemaFile)
+	}
+	gzipETag := rr.Header().Get("ETag")
+	if gzipETag != `"`+service.Checksum(dummySchema)+`-gzip"` {
+		t.Errorf("expected the ETag of the gzip body but got '%s'", gzipETag)
+	}
+
+	// The revalidation of the gzip response varies with the encoding too
+	req.Header.Set("If-None-Match", gzipETag)
+	rr = httptest.NewRecorder()
+	apiHandler.GetSchemaHandler(rr, req)
+
+	if rr.Code != http.StatusNotModified {
+		t.Errorf("expected status %d but got %d", http.StatusNotModified, rr.Code)
+	}
+	if rr.Header().Get("Vary") != "Accept-Encoding" || rr.Header().Get("ETag") != gzipETag {
+		t.Errorf("expected the Vary and ETag headers of the gzip body but got %v", rr.Header())
+	}
+	req.Header.Del("If-None-Match")
 
-	// Initialize the database connection
-	database, err := db.Initialize()
+	// Other clients get the decompressed file
+	req.Header.Set("Accept-Encoding", "gzip;q=0")
+	rr = httptest.NewRecorder()
+	apiHandler.GetSchemaHandler(rr, req)
+
+	if rr.Header().Get("Content-Encoding") != "" {
+		t.Errorf("expected no Content-Encoding but got '%s'", rr.Header().Get("Content-Encoding"))
+	}
+	if rr.Header().Get("ETag") == gzipETag {
+		t.Error("expected the decompressed file to have another ETag than the gzip body")
+	}
+	if !bytes.Equal(rr.Body.Bytes(), dummySchema) {
+		t.Errorf("expected schema '%s' but got '%s'", dummySchema, rr.Body.String())
+	}
+}
+
+func TestGetLatestSchemaHandler(t *testing.T) {
+	apiHandler := newTestAPIHandler()
+	uploadSchema(t, apiHandler, "dummy.json", dummySchema)
+	uploadSchema(t, apiHandler, "dummy.json", dummySchemaV2)
+
+	// Create a mock HTTP request with path variables
+	req, err := http.NewRequest("GET", "/getLatestSchema/dummy.json", nil)
 	if err != nil {
-		fmt.Errorf("Failed to initialize database: %v", err)
+		t.Fatal(err)
 	}
-	defer database.DB.Close()
 
-	fileStore := storage.NewFileStore("test_dummy_directory")
+	// Set path variables in the request's context
+	req = mux.SetURLVars(req, map[string]string{
+		"filename": "dummy.json",
+	})
 
-	apiHandler := NewAPIHandler(fileStore, database)
+	// Create a mock HTTP response recorder
+	rr := httptest.NewRecorder()
 
 	// Call the handler function
 	apiHandler.GetLatestSchemaHandler(rr, req)
@@ -118,9 +600,6 @@ func TestGetLatestSchemaHandler(t *testing.T) {
 		t.Errorf("expected status %d but got %d", http.StatusOK, rr.Code)
 	}
 
-	// Check the response body or other assertions as needed
-	// ...
-
 	// Parse the response JSON
 	var resp map[string]interface{}
 	err = json.Unmarshal(rr.Body.Bytes(), &resp)
@@ -129,8 +608,8 @@ func TestGetLatestSchemaHandler(t *testing.T) {
 	}
 
 	// Verify the expected structure of the response
-	if _, ok := resp["version"]; !ok {
-		t.Error("expected 'version' key in the response")
+	if version, ok := resp["version"]; !ok || version != float64(2) {
+		t.Errorf("expected 'version' 2 in the response but got %v", version)
 	}
 
 	if _, ok := resp["file-dummy.json"]; !ok {
@@ -138,8 +617,12 @@ func TestGetLatestSchemaHandler(t *testing.T) {
 	}
 }
 
-
 func TestGetAllVersionsHandler(t *testing.T) {
+	apiHandler := newTestAPIHandler()
+	uploadSchema(t, apiHandler, "dummy.json", dummySchema)
+	uploadSchema(t, apiHandler, "dummy.json", dummySchemaV2)
+	uploadSchema(t, apiHandler, "other.json", dummySchema)
+
 	// Create a mock HTTP request with path variables
 	req, err := http.NewRequest("GET", "/getAllVersions/dummy.json", nil)
 	if err != nil {
@@ -153,16 +636,6 @@ func TestGetAllVersionsHandler(t *testing.T) {
 	// Create a mock HTTP response recorder
 	rr := httptest.NewRecorder()
 
-	database, err := db.Initialize()
-	if err != nil {
-		fmt.Errorf("Failed to initialize database: %v", err)
-	}
-	defer database.DB.Close()
-	
-	fileStore := storage.NewFileStore("test_dummy_directory")
-
-	apiHandler := NewAPIHandler(fileStore, database)
-
 	// Call the handler function
 	apiHandler.GetAllVersionsHandler(rr, req)
 
@@ -171,25 +644,149 @@ func TestGetAllVersionsHandler(t *testing.T) {
 		t.Errorf("expected status %d but got %d", http.StatusOK, rr.Code)
 	}
 
+	// Check the response body
+	var resp struct {
+		AvailableVersions []int64 `json:"available_versions"`
+		Versions          []struct {
+			Version  int64  `json:"version"`
+			Checksum string `json:"checksum"`
+		} `json:"versions"`
+	}
+	err = json.Unmarshal(rr.Body.Bytes(), &resp)
+	if err != nil {
+		t.Fatalf("failed to unmarshal response JSON: %v", err)
+	}
+	if !reflect.DeepEqual(resp.AvailableVersions, []int64{1, 2}) {
+		t.Errorf("expected available versions [1 2] but got %v", resp.AvailableVersions)
+	}
+	if len(resp.Versions) != 2 || resp.Versions[1].Version != 2 || resp.Versions[1].Checksum != service.Checksum(dummySchemaV2) {
+		t.Errorf("unexpected version details %+v", resp.Versions)
+	}
+}
+
+func TestGetSchemaHandlerCorruptedFile(t *testing.T) {
+	apiHandler := newTestAPIHandler()
+	uploadSchema(t, apiHandler, "dummy.json", dummySchema)
 
-	// Parse the response JSON
-	fmt.Println()
-	fmt.Println("response body", rr.Body.String())
+	// Replace the stored file behind the registry's back
+	ctx := context.Background()
+	if err := apiHandler.Storage.DeleteSchema(ctx, "dummy.json", 1); err != nil {
+		t.Fatal(err)
+	}
+	if err := apiHandler.Storage.SaveSchema(ctx, []byte(`{"openapi": "3.0.1"}`), "dummy.json", "json", 1); err != nil {
+		t.Fatal(err)
+	}
+
+	req, err := http.NewRequest("GET", "/getSchemaByVersion/dummy.json/1", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req = mux.SetURLVars(req, map[string]string{
+		"filename": "dummy.json",
+		"version":  "1",
+	})
 
-	for _, b := range rr.Body.Bytes() {
-		if b < 0 || b > 127 {
-			t.Fatalf("Cannot convert []byte to []int64: byte value out of range")
-			return
+	rr := httptest.NewRecorder()
+	apiHandler.GetSchemaHandler(rr, req)
+
+	if rr.Code != http.StatusInternalServerError {
+		t.Errorf("expected status %d but got %d", http.StatusInternalServerError, rr.Code)
+	}
+	if bytes.Contains(rr.Body.Bytes(), []byte("openapi")) {
+		t.Errorf("expected the corrupted file not to be served but got '%s'", rr.Body.String())
+	}
+}
+
+func TestUploadSchemaHandlerConcurrent(t *testing.T) {
+	apiHandler := NewAPIHandler(storage.NewFileStore(t.TempDir()), db.NewMemoryRepository())
+
+	const uploads = 20
+	versions := make(chan float64, uploads)
+	var wg sync.WaitGroup
+	for i := 0; i < uploads; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+
+			rr := httptest.NewRecorder()
+			apiHandler.UploadSchemaHandler(rr, newUploadRequest(t, "dummy.json", []byte(fmt.Sprintf(`{"upload": %d}`, i))))
+			if rr.Code != http.StatusOK {
+				t.Errorf("expected status %d but got %d: %s", http.StatusOK, rr.Code, rr.Body.String())
+				return
+			}
+
+			var resp map[string]interface{}
+			if err := json.Unmarshal(rr.Body.Bytes(), &resp); err != nil {
+				t.Errorf("failed to unmarshal response JSON: %v", err)
+				return
+			}
+			versions <- resp["version"].(float64)
+		}(i)
+	}
+	wg.Wait()
+	close(versions)
+
+	seen := make(map[float64]bool)
+	for version := range versions {
+		if seen[version] {
+			t.Errorf("version %v was assigned twice", version)
 		}
+		seen[version] = true
+	}
+	if len(seen) != uploads {
+		t.Errorf("expected %d distinct versions but got %d", uploads, len(seen))
 	}
 
-	var versions map[string]interface{}
-	var intf interface{}
-	err = json.Unmarshal(rr.Body.Bytes(), &intf)
+	// Every version must have its own file
+	storedVersions, err := apiHandler.Storage.ListVersions(context.Background(), "dummy.json")
 	if err != nil {
-		t.Fatalf("failed to unmarshal response JSON: %v", err)
+		t.Fatal(err)
+	}
+	if len(storedVersions) != uploads {
+		t.Errorf("expected %d stored versions but got %v", uploads, storedVersions)
 	}
-	versions = intf.(map[string]interface{})
-	fmt.Println("versions", versions)
 }
 
+func TestGetSchemaByDigestHandler(t *testing.T) {
+	yamlSchema := []byte("openapi: 3.0.1\ninfo:\n  title: test\n")
+	for name, apiHandler := range map[string]*APIHandler{
+		"memory": newTestAPIHandler(),
+		"blob":   NewAPIHandler(storage.NewBlobStore(t.TempDir()), db.NewMemoryRepository()),
+	} {
+		uploadSchema(t, apiHandler, "dummy.json", dummySchema)
+		uploadSchema(t, apiHandler, "openapi", yamlSchema)
+
+		// YAML versions are served as YAML
+		digest := service.Checksum(yamlSchema)
+		rr := httptest.NewRecorder()
+		apiHandler.GetSchemaByDigestHandler(rr, mux.SetURLVars(httptest.NewRequest("GET", "/schemas/by-digest/"+digest, nil), map[string]string{"sha256": digest}))
+		if rr.Code != http.StatusOK || rr.Header().Get("Content-Type") != "application/x-yaml" {
+			t.Errorf("%s: expected the YAML schema with a YAML Content-Type but got status %d, '%s'", name, rr.Code, rr.Header().Get("Content-Type"))
+		}
+
+		for digest, expectedStatus := range map[string]int{
+			service.Checksum(dummySchema):   http.StatusOK,
+			service.Checksum(dummySchemaV2): http.StatusNotFound,
+			"not-a-digest":                  http.StatusBadRequest,
+		} {
+			req, err := http.NewRequest("GET", "/schemas/by-digest/"+digest, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			req = mux.SetURLVars(req, map[string]string{"sha256": digest})
+
+			rr := httptest.NewRecorder()
+			apiHandler.GetSchemaByDigestHandler(rr, req)
+
+			if rr.Code != expectedStatus {
+				t.Errorf("%s: expected status %d for digest '%s' but got %d", name, expectedStatus, digest, rr.Code)
+			}
+			if expectedStatus == http.StatusOK && !bytes.Equal(rr.Body.Bytes(), dummySchema) {
+				t.Errorf("%s: expected schema '%s' but got '%s'", name, dummySchema, rr.Body.String())
+			}
+			if expectedStatus == http.StatusOK && rr.Header().Get("Content-Type") != "application/json" {
+				t.Errorf("%s: expected a JSON Content-Type but got '%s'", name, rr.Header().Get("Content-Type"))
+			}
+		}
+	}
+}
@@ -0,0 +1,80 @@
+package controller
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"example.com/levo_app/storage"
+)
+
+// readinessTimeout bounds the checks of the readiness API, an orchestrator probe gives up soon
+const readinessTimeout = 3 * time.Second
+
+// pinger is implemented by the repositories that can check their connection
+type pinger interface {
+	Ping(ctx context.Context) error
+}
+
+// readiness is the response of the readiness API
+type readiness struct {
+	Ready bool `json:"ready"`
+	// Checks has "ok" or the error of every check
+	Checks map[string]string `json:"checks"`
+}
+
+// HealthHandler handles the liveness API, it succeeds as long as the server is able to respond
+func (ah *APIHandler) HealthHandler(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, map[string]string{"status": "ok"})
+}
+
+// ReadyHandler handles the readiness API, it responds with 503 Service Unavailable when the
+// database can't be reached, the storage can't be written to or the server is shutting down
+func (ah *APIHandler) ReadyHandler(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(r.Context(), readinessTimeout)
+	defer cancel()
+
+	resp := readiness{Ready: true, Checks: make(map[string]string)}
+	check := func(name string, err error) {
+		if err != nil {
+			ah.logger(r.Context()).Warn("readiness check failed", "check", name, "error", err)
+			resp.Ready = false
+			resp.Checks[name] = err.Error()
+			return
+		}
+		resp.Checks[name] = "ok"
+	}
+
+	if atomic.LoadInt32(&ah.shuttingDown) != 0 {
+		check("shutdown", errors.New("the server is shutting down"))
+	}
+	if p, ok := ah.Database.(pinger); ok {
+		check("database", p.Ping(ctx))
+	}
+	check("storage", storage.CheckWritable(ctx, ah.Storage))
+	if ah.Uploads != nil {
+		check("uploads", ah.Uploads.CheckWritable(ctx))
+	}
+
+	respBytes, err := json.Marshal(resp)
+	if err != nil {
+		http.Error(w, "failed to marshal response to JSON", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	if !resp.Ready {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	w.Write(respBytes)
+}
+
+// StartShutdown makes the readiness API fail, so that no new requests are routed to the server
+// while the requests in flight are drained
+func (ah *APIHandler) StartShutdown() {
+	atomic.StoreInt32(&ah.shuttingDown, 1)
+}
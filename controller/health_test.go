@@ -0,0 +1,66 @@
+package controller
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"example.com/levo_app/db"
+	"example.com/levo_app/storage"
+)
+
+// unreachableRepository is a repository whose database can't be reached
+type unreachableRepository struct {
+	*db.MemoryRepository
+}
+
+func (unreachableRepository) Ping(ctx context.Context) error {
+	return errors.New("connection refused")
+}
+
+// ready calls the readiness API and returns its status and body
+func ready(apiHandler *APIHandler) (int, string) {
+	rr := httptest.NewRecorder()
+	apiHandler.ReadyHandler(rr, httptest.NewRequest("GET", "/readyz", nil))
+	return rr.Code, rr.Body.String()
+}
+
+func TestHealthHandler(t *testing.T) {
+	rr := httptest.NewRecorder()
+	newTestAPIHandler().HealthHandler(rr, httptest.NewRequest("GET", "/healthz", nil))
+	if rr.Code != http.StatusOK {
+		t.Errorf("expected status %d but got %d", http.StatusOK, rr.Code)
+	}
+}
+
+func TestReadyHandler(t *testing.T) {
+	apiHandler := NewAPIHandler(storage.NewFileStore(filepath.Join(t.TempDir(), "schemas")), db.NewMemoryRepository())
+	if code, body := ready(apiHandler); code != http.StatusOK {
+		t.Errorf("expected status %d but got %d, body '%s'", http.StatusOK, code, body)
+	}
+
+	apiHandler.StartShutdown()
+	if code, body := ready(apiHandler); code != http.StatusServiceUnavailable || !strings.Contains(body, "shutting down") {
+		t.Errorf("expected status %d while shutting down but got %d, body '%s'", http.StatusServiceUnavailable, code, body)
+	}
+
+	apiHandler = NewAPIHandler(storage.NewMemoryStore(), unreachableRepository{db.NewMemoryRepository()})
+	if code, body := ready(apiHandler); code != http.StatusServiceUnavailable || !strings.Contains(body, `"database":"connection refused"`) {
+		t.Errorf("expected status %d with an unreachable database but got %d, body '%s'", http.StatusServiceUnavailable, code, body)
+	}
+
+	// A storage directory under a file can't be created
+	file := filepath.Join(t.TempDir(), "file")
+	if err := ioutil.WriteFile(file, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	apiHandler = NewAPIHandler(storage.NewFileStore(filepath.Join(file, "schemas")), db.NewMemoryRepository())
+	if code, body := ready(apiHandler); code != http.StatusServiceUnavailable || !strings.Contains(body, `"storage":`) || strings.Contains(body, `"storage":"ok"`) {
+		t.Errorf("expected status %d with a read-only storage but got %d, body '%s'", http.StatusServiceUnavailable, code, body)
+	}
+}
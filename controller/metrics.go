@@ -0,0 +1,105 @@
+package controller
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+
+	"example.com/levo_app/metrics"
+	"example.com/levo_app/service"
+)
+
+// Metrics are the metrics of the API handlers. The methods of a nil *Metrics do nothing.
+type Metrics struct {
+	// Registry keeps the metrics of the handlers and the other metrics of the server, it is served on /metrics
+	Registry *metrics.Registry
+
+	requests           *metrics.Counter
+	requestDuration    *metrics.Histogram
+	uploadSize         *metrics.Histogram
+	validationFailures *metrics.Counter
+	storageErrors      *metrics.Counter
+}
+
+// NewMetrics registers the metrics of the API handlers in the registry
+func NewMetrics(registry *metrics.Registry) *Metrics {
+	return &Metrics{
+		Registry: registry,
+		requests: registry.NewCounter("levo_http_requests_total",
+			"Requests handled, by route, method and status code.", "route", "method", "code"),
+		requestDuration: registry.NewHistogram("levo_http_request_duration_seconds",
+			"Time taken to handle the requests, by route and method.", metrics.LatencyBuckets, "route", "method"),
+		uploadSize: registry.NewHistogram("levo_upload_size_bytes",
+			"Size of the uploaded schema files.", metrics.SizeBuckets),
+		validationFailures: registry.NewCounter("levo_schema_validation_failures_total",
+			"Uploaded schema files rejected as invalid, by reason.", "reason"),
+		storageErrors: registry.NewCounter("levo_storage_errors_total",
+			"Failed reads and writes of the schema storage, by operation.", "operation"),
+	}
+}
+
+// MetricsHandler serves the metrics in the Prometheus text format
+func (ah *APIHandler) MetricsHandler(w http.ResponseWriter, r *http.Request) {
+	if ah.Metrics == nil {
+		http.Error(w, "metrics are not enabled", http.StatusNotImplemented)
+		return
+	}
+
+	ah.Metrics.Registry.ServeHTTP(w, r)
+}
+
+// observeRequest records a handled request, route is the path template of its route
+func (m *Metrics) observeRequest(route string, method string, status int, duration time.Duration) {
+	if m == nil {
+		return
+	}
+
+	m.requests.Inc(route, method, strconv.Itoa(status))
+	m.requestDuration.Observe(duration.Seconds(), route, method)
+}
+
+// observeUpload records the size of an uploaded schema file
+func (m *Metrics) observeUpload(size int) {
+	if m == nil {
+		return
+	}
+
+	m.uploadSize.Observe(float64(size))
+}
+
+// validationFailed records a schema file rejected by the validation
+func (m *Metrics) validationFailed(err error) {
+	if m == nil {
+		return
+	}
+
+	m.validationFailures.Inc(validationReason(err))
+}
+
+// storageFailed records a failed operation of the schema storage, "read", "write" or "delete".
+// Requests cancelled by the client are not failures of the storage.
+func (m *Metrics) storageFailed(operation string, err error) {
+	if m == nil || errors.Is(err, context.Canceled) {
+		return
+	}
+
+	m.storageErrors.Inc(operation)
+}
+
+// validationReason returns the reason label of a validation error
+func validationReason(err error) string {
+	switch {
+	case errors.Is(err, service.ErrEmptySchema):
+		return "empty"
+	case errors.Is(err, service.ErrInvalidJSON):
+		return "invalid_json"
+	case errors.Is(err, service.ErrInvalidYAML):
+		return "invalid_yaml"
+	case errors.Is(err, service.ErrNotADocument):
+		return "not_a_document"
+	default:
+		return "other"
+	}
+}
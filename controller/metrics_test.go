@@ -0,0 +1,73 @@
+package controller
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"example.com/levo_app/metrics"
+
+	"github.com/gorilla/mux"
+)
+
+func TestMetrics(t *testing.T) {
+	apiHandler := newTestAPIHandler()
+	apiHandler.Metrics = NewMetrics(metrics.NewRegistry())
+	m := apiHandler.Metrics
+
+	uploadSchema(t, apiHandler, "dummy.json", dummySchema)
+	for filename, content := range map[string]string{
+		"empty.json":  "",
+		"broken.json": `{"openapi": `,
+		"broken.yaml": "openapi: [3.0.1",
+		"notes.txt":   "just some notes",
+	} {
+		rr := httptest.NewRecorder()
+		apiHandler.UploadSchemaHandler(rr, newUploadRequest(t, filename, []byte(content)))
+		if rr.Code != http.StatusBadRequest {
+			t.Errorf("%s: expected status %d but got %d", filename, http.StatusBadRequest, rr.Code)
+		}
+	}
+
+	if count := m.uploadSize.Count(); count != 5 {
+		t.Errorf("expected 5 upload sizes but got %d", count)
+	}
+	for _, reason := range []string{"empty", "invalid_json", "invalid_yaml", "not_a_document"} {
+		if value := m.validationFailures.Value(reason); value != 1 {
+			t.Errorf("expected 1 validation failure '%s' but got %v", reason, value)
+		}
+	}
+
+	// A corrupted file is a failed read of the storage
+	ctx := context.Background()
+	if err := apiHandler.Storage.DeleteSchema(ctx, "dummy.json", 1); err != nil {
+		t.Fatal(err)
+	}
+	if err := apiHandler.Storage.SaveSchema(ctx, []byte(`{"openapi": "3.0.1"}`), "dummy.json", "json", 1); err != nil {
+		t.Fatal(err)
+	}
+	req := mux.SetURLVars(httptest.NewRequest("GET", "/getSchemaByVersion/dummy.json/1", nil), map[string]string{
+		"filename": "dummy.json",
+		"version":  "1",
+	})
+	apiHandler.GetSchemaHandler(httptest.NewRecorder(), req)
+	if value := m.storageErrors.Value("read"); value != 1 {
+		t.Errorf("expected 1 storage read error but got %v", value)
+	}
+
+	rr := httptest.NewRecorder()
+	apiHandler.MetricsHandler(rr, httptest.NewRequest("GET", "/metrics", nil))
+	if !strings.Contains(rr.Body.String(), `levo_storage_errors_total{operation="read"} 1`) {
+		t.Errorf("expected the storage errors in the metrics but got\n%s", rr.Body.String())
+	}
+}
+
+func TestMetricsHandlerDisabled(t *testing.T) {
+	rr := httptest.NewRecorder()
+	newTestAPIHandler().MetricsHandler(rr, httptest.NewRequest("GET", "/metrics", nil))
+	if rr.Code != http.StatusNotImplemented {
+		t.Errorf("expected status %d without metrics but got %d", http.StatusNotImplemented, rr.Code)
+	}
+}
@@ -0,0 +1,94 @@
+package controller
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"net/http"
+	"strconv"
+	"time"
+
+	"example.com/levo_app/logging"
+
+	"github.com/gorilla/mux"
+)
+
+// RequestIDHeader is the header carrying the ID of a request, it is read from the request if the
+// client sets it and always written to the response
+const RequestIDHeader = "X-Request-ID"
+
+// maxRequestIDLength is the maximum length of a request ID accepted from a client
+const maxRequestIDLength = 128
+
+// statusRecorder records the status code written by a handler
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+// WriteHeader records the status code and writes it
+func (sr *statusRecorder) WriteHeader(status int) {
+	sr.status = status
+	sr.ResponseWriter.WriteHeader(status)
+}
+
+// Unwrap returns the wrapped ResponseWriter, http.MaxBytesReader needs it to close the connection
+func (sr *statusRecorder) Unwrap() http.ResponseWriter {
+	return sr.ResponseWriter
+}
+
+// RequestMiddleware tags the request with an ID, taken from the X-Request-ID header or generated,
+// returns it in the response and logs and measures the request once it is handled. The handlers
+// get a logger adding the ID to their lines with ah.logger.
+func (ah *APIHandler) RequestMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+
+		id := r.Header.Get(RequestIDHeader)
+		if !validRequestID(id) {
+			id = newRequestID()
+		}
+		w.Header().Set(RequestIDHeader, id)
+
+		logger := ah.Logger.With("request_id", id)
+		recorder := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(recorder, r.WithContext(logging.NewContext(r.Context(), logger)))
+
+		duration := time.Since(start)
+		logger.Info("request", "method", r.Method, "path", r.URL.Path, "status", recorder.status, "duration", duration)
+		ah.Metrics.observeRequest(routeTemplate(r), r.Method, recorder.status, duration)
+	})
+}
+
+// routeTemplate returns the path template of the route of the request, such as "/uploads/{id}", so
+// that the requests of a route share their metrics whatever the names and versions in their path
+func routeTemplate(r *http.Request) string {
+	if route := mux.CurrentRoute(r); route != nil {
+		if template, err := route.GetPathTemplate(); err == nil {
+			return template
+		}
+	}
+	return "unmatched"
+}
+
+// validRequestID reports whether a request ID sent by a client can be used, it must be short and
+// printable so that it can't forge log lines
+func validRequestID(id string) bool {
+	if id == "" || len(id) > maxRequestIDLength {
+		return false
+	}
+	for i := 0; i < len(id); i++ {
+		if id[i] < 0x21 || id[i] > 0x7e {
+			return false
+		}
+	}
+	return true
+}
+
+// newRequestID generates a random request ID
+func newRequestID() string {
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return strconv.FormatInt(time.Now().UnixNano(), 16)
+	}
+	return hex.EncodeToString(id)
+}
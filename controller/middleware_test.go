@@ -0,0 +1,94 @@
+package controller
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"example.com/levo_app/logging"
+
+	"github.com/gorilla/mux"
+)
+
+func TestRequestMiddleware(t *testing.T) {
+	var logs bytes.Buffer
+	logger, err := logging.New(&logs, logging.LevelDebug, logging.FormatText)
+	if err != nil {
+		t.Fatal(err)
+	}
+	apiHandler := newTestAPIHandler()
+	apiHandler.Logger = logger
+
+	handler := apiHandler.RequestMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		apiHandler.logger(r.Context()).Warn("handled")
+		w.WriteHeader(http.StatusTeapot)
+	}))
+
+	// The ID of the client is kept
+	req := httptest.NewRequest("GET", "/getLatestSchema/petstore", nil)
+	req.Header.Set(RequestIDHeader, "client-id-1")
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+	if id := rr.Header().Get(RequestIDHeader); id != "client-id-1" {
+		t.Errorf("expected the request ID 'client-id-1' but got '%s'", id)
+	}
+	lines := strings.Split(strings.TrimSpace(logs.String()), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("expected 2 log lines but got %q", lines)
+	}
+	for _, line := range lines {
+		if !strings.Contains(line, "request_id=client-id-1") {
+			t.Errorf("expected the request ID in the log line '%s'", line)
+		}
+	}
+	if !strings.Contains(lines[1], "method=GET path=/getLatestSchema/petstore status=418") {
+		t.Errorf("expected the request to be logged but got '%s'", lines[1])
+	}
+
+	// An ID is generated when the client doesn't send a usable one
+	for _, clientID := range []string{"", "two words", strings.Repeat("x", maxRequestIDLength+1)} {
+		logs.Reset()
+		req := httptest.NewRequest("GET", "/healthz", nil)
+		req.Header.Set(RequestIDHeader, clientID)
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+
+		id := rr.Header().Get(RequestIDHeader)
+		if len(id) != 32 {
+			t.Errorf("expected a generated request ID for '%s' but got '%s'", clientID, id)
+		}
+		if !strings.Contains(logs.String(), "request_id="+id) {
+			t.Errorf("expected the generated request ID in the log lines '%s'", logs.String())
+		}
+	}
+}
+
+func TestRequestMiddlewareBodyLimit(t *testing.T) {
+	apiHandler := newTestAPIHandler()
+	apiHandler.MaxUploadSize = 16
+	router := mux.NewRouter()
+	router.HandleFunc("/schemas/{name}/versions", apiHandler.UploadRawSchemaHandler)
+	server := httptest.NewServer(apiHandler.RequestMiddleware(router))
+	defer server.Close()
+
+	// The server closes the connection of a body cut off by the limit, behind the status recorder too
+	req, err := http.NewRequest("PUT", server.URL+"/schemas/dummy/versions", strings.NewReader(strings.Repeat(" ", 64)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.ContentLength = -1
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusRequestEntityTooLarge {
+		t.Errorf("expected status %d but got %d", http.StatusRequestEntityTooLarge, resp.StatusCode)
+	}
+	if !resp.Close {
+		t.Error("expected the server to close the connection after the body over the limit")
+	}
+}
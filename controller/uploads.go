@@ -0,0 +1,193 @@
+package controller
+
+import (
+	"encoding/json"
+	"errors"
+	"mime"
+	"net/http"
+	"strconv"
+
+	"example.com/levo_app/storage"
+	"github.com/gorilla/mux"
+)
+
+// Headers of the resumable upload protocol
+const (
+	// uploadLengthHeader declares the size of the complete file when a session is created
+	uploadLengthHeader = "Upload-Length"
+	// uploadContentTypeHeader declares the media type of the complete file when a session is created
+	uploadContentTypeHeader = "Upload-Content-Type"
+	// uploadOffsetHeader is the offset a chunk starts at, and the size uploaded so far in the responses
+	uploadOffsetHeader = "Upload-Offset"
+)
+
+// CreateUploadHandler handles the API starting a resumable upload of a new version of the schema
+// named in the path. The size of the file can be declared with "Upload-Length", its format with
+// "Upload-Content-Type" and its original name with "Content-Disposition".
+func (ah *APIHandler) CreateUploadHandler(w http.ResponseWriter, r *http.Request) {
+	if !ah.uploadsEnabled(w) {
+		return
+	}
+
+	filename, ok := normalizeSchemaName(w, mux.Vars(r)["name"])
+	if !ok {
+		return
+	}
+
+	length := int64(-1)
+	if value := r.Header.Get(uploadLengthHeader); value != "" {
+		var err error
+		length, err = strconv.ParseInt(value, 10, 64)
+		if err != nil || length < 0 {
+			http.Error(w, "invalid "+uploadLengthHeader+" header", http.StatusBadRequest)
+			return
+		}
+		if length > ah.maxUploadSize() {
+			uploadTooLarge(w, ah.maxUploadSize())
+			return
+		}
+	}
+
+	originalFilename := ""
+	if _, params, err := mime.ParseMediaType(r.Header.Get("Content-Disposition")); err == nil {
+		originalFilename = params["filename"]
+	}
+
+	upload, err := ah.Uploads.Create(filename, originalFilename, r.Header.Get(uploadContentTypeHeader), length)
+	if errors.Is(err, storage.ErrUploadLimit) {
+		ah.uploadError(w, r, err)
+		return
+	}
+	if err != nil {
+		ah.logger(r.Context()).Error("failed to create upload", "name", filename, "error", err)
+		http.Error(w, "failed to create upload", http.StatusInternalServerError)
+		return
+	}
+
+	respBytes, err := json.Marshal(upload)
+	if err != nil {
+		http.Error(w, "failed to marshal response to JSON", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Location", "/uploads/"+upload.ID)
+	w.Header().Set(uploadOffsetHeader, "0")
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	w.Write(respBytes)
+}
+
+// GetUploadHandler handles the API returning the state of an upload session, a client resuming an
+// interrupted upload sends the next chunk at the returned offset
+func (ah *APIHandler) GetUploadHandler(w http.ResponseWriter, r *http.Request) {
+	if !ah.uploadsEnabled(w) {
+		return
+	}
+
+	upload, err := ah.Uploads.Get(mux.Vars(r)["id"])
+	if err != nil {
+		ah.uploadError(w, r, err)
+		return
+	}
+
+	w.Header().Set(uploadOffsetHeader, strconv.FormatInt(upload.Offset, 10))
+	w.Header().Set("Cache-Control", "no-store")
+	writeJSON(w, upload)
+}
+
+// AppendUploadHandler handles the API adding the request body to an upload session, at the offset
+// given by the "Upload-Offset" header which must be the size uploaded so far
+func (ah *APIHandler) AppendUploadHandler(w http.ResponseWriter, r *http.Request) {
+	if !ah.uploadsEnabled(w) {
+		return
+	}
+
+	offset, err := strconv.ParseInt(r.Header.Get(uploadOffsetHeader), 10, 64)
+	if err != nil || offset < 0 {
+		http.Error(w, "missing or invalid "+uploadOffsetHeader+" header", http.StatusBadRequest)
+		return
+	}
+
+	upload, err := ah.Uploads.Append(mux.Vars(r)["id"], offset, r.Body, ah.maxUploadSize())
+	if err != nil {
+		if errors.Is(err, storage.ErrUploadOffsetMismatch) {
+			w.Header().Set(uploadOffsetHeader, strconv.FormatInt(upload.Offset, 10))
+		}
+		ah.uploadError(w, r, err)
+		return
+	}
+
+	w.Header().Set(uploadOffsetHeader, strconv.FormatInt(upload.Offset, 10))
+	writeJSON(w, upload)
+}
+
+// FinalizeUploadHandler handles the API saving a complete upload as the next version of its schema.
+// The file is only validated and given a version now, the response is the one of an upload. The
+// session is removed unless saving failed on the server side, in which case finalizing can be retried.
+func (ah *APIHandler) FinalizeUploadHandler(w http.ResponseWriter, r *http.Request) {
+	if !ah.uploadsEnabled(w) {
+		return
+	}
+
+	id := mux.Vars(r)["id"]
+	upload, schemaFile, err := ah.Uploads.Read(id)
+	if err != nil {
+		ah.uploadError(w, r, err)
+		return
+	}
+
+	recorder := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+	ah.saveSchemaVersion(recorder, r, schemaFile, upload.Name, upload.OriginalFilename, upload.ContentType)
+	if recorder.status >= http.StatusInternalServerError {
+		return
+	}
+
+	err = ah.Uploads.Delete(id)
+	if err != nil && !errors.Is(err, storage.ErrUploadNotFound) {
+		ah.logger(r.Context()).Warn("failed to remove finalized upload", "upload_id", id, "error", err)
+	}
+}
+
+// DeleteUploadHandler handles the API abandoning an upload session
+func (ah *APIHandler) DeleteUploadHandler(w http.ResponseWriter, r *http.Request) {
+	if !ah.uploadsEnabled(w) {
+		return
+	}
+
+	err := ah.Uploads.Delete(mux.Vars(r)["id"])
+	if err != nil {
+		ah.uploadError(w, r, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// uploadsEnabled responds with 501 Not Implemented if the handler has no upload sessions
+func (ah *APIHandler) uploadsEnabled(w http.ResponseWriter) bool {
+	if ah.Uploads == nil {
+		http.Error(w, "resumable uploads are not enabled", http.StatusNotImplemented)
+		return false
+	}
+	return true
+}
+
+// uploadError responds with the status matching an error of the upload sessions
+func (ah *APIHandler) uploadError(w http.ResponseWriter, r *http.Request, err error) {
+	switch {
+	case errors.Is(err, storage.ErrUploadNotFound):
+		http.Error(w, err.Error(), http.StatusNotFound)
+	case errors.Is(err, storage.ErrUploadOffsetMismatch), errors.Is(err, storage.ErrUploadIncomplete):
+		http.Error(w, err.Error(), http.StatusConflict)
+	case errors.Is(err, storage.ErrUploadTooLarge):
+		http.Error(w, err.Error(), http.StatusRequestEntityTooLarge)
+	case errors.Is(err, storage.ErrUploadLimit):
+		// The server is out of room for uploads until some are finished or expire
+		ah.logger(r.Context()).Warn("upload refused", "error", err)
+		w.Header().Set("Retry-After", "60")
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+	default:
+		ah.logger(r.Context()).Error("upload failed", "error", err)
+		http.Error(w, "upload failed", http.StatusInternalServerError)
+	}
+}
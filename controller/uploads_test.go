@@ -0,0 +1,181 @@
+package controller
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"example.com/levo_app/storage"
+	"github.com/gorilla/mux"
+)
+
+// newTestUploadHandler creates an API handler with resumable uploads in a temp directory
+func newTestUploadHandler(t *testing.T) *APIHandler {
+	t.Helper()
+
+	uploads, err := storage.NewUploadSessions(t.TempDir(), time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	apiHandler := newTestAPIHandler()
+	apiHandler.Uploads = uploads
+	return apiHandler
+}
+
+// serveUpload calls an upload handler with the given path variables and headers
+func serveUpload(handler http.HandlerFunc, method string, vars map[string]string, headers map[string]string, body []byte) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, "/uploads", bytes.NewReader(body))
+	for key, value := range headers {
+		req.Header.Set(key, value)
+	}
+	req = mux.SetURLVars(req, vars)
+
+	rr := httptest.NewRecorder()
+	handler(rr, req)
+	return rr
+}
+
+func TestResumableUpload(t *testing.T) {
+	apiHandler := newTestUploadHandler(t)
+
+	rr := serveUpload(apiHandler.CreateUploadHandler, "POST", map[string]string{"name": "payments"}, map[string]string{
+		"Upload-Length":       strconv.Itoa(len(dummySchema)),
+		"Upload-Content-Type": "application/json",
+		"Content-Disposition": `attachment; filename="payments.json"`,
+	}, nil)
+	if rr.Code != http.StatusCreated {
+		t.Fatalf("expected status %d but got %d, body '%s'", http.StatusCreated, rr.Code, rr.Body.String())
+	}
+	var upload storage.Upload
+	if err := json.Unmarshal(rr.Body.Bytes(), &upload); err != nil {
+		t.Fatal(err)
+	}
+	if rr.Header().Get("Location") != "/uploads/"+upload.ID {
+		t.Errorf("unexpected location '%s'", rr.Header().Get("Location"))
+	}
+	id := map[string]string{"id": upload.ID}
+
+	half := len(dummySchema) / 2
+	rr = serveUpload(apiHandler.AppendUploadHandler, "PATCH", id, map[string]string{"Upload-Offset": "0"}, dummySchema[:half])
+	if rr.Code != http.StatusOK || rr.Header().Get("Upload-Offset") != strconv.Itoa(half) {
+		t.Fatalf("expected the first chunk to be appended but got status %d, offset '%s'", rr.Code, rr.Header().Get("Upload-Offset"))
+	}
+
+	// Finalizing an incomplete upload fails and keeps the session
+	rr = serveUpload(apiHandler.FinalizeUploadHandler, "POST", id, nil, nil)
+	if rr.Code != http.StatusConflict {
+		t.Errorf("expected status %d for an incomplete upload but got %d", http.StatusConflict, rr.Code)
+	}
+
+	// A client that lost the response of the first chunk asks for the offset to resume from
+	rr = serveUpload(apiHandler.AppendUploadHandler, "PATCH", id, map[string]string{"Upload-Offset": "0"}, dummySchema[:half])
+	if rr.Code != http.StatusConflict || rr.Header().Get("Upload-Offset") != strconv.Itoa(half) {
+		t.Errorf("expected status %d with the current offset but got %d, offset '%s'", http.StatusConflict, rr.Code, rr.Header().Get("Upload-Offset"))
+	}
+	rr = serveUpload(apiHandler.GetUploadHandler, "HEAD", id, nil, nil)
+	if rr.Code != http.StatusOK || rr.Header().Get("Upload-Offset") != strconv.Itoa(half) {
+		t.Errorf("expected the current offset but got status %d, offset '%s'", rr.Code, rr.Header().Get("Upload-Offset"))
+	}
+
+	rr = serveUpload(apiHandler.AppendUploadHandler, "PATCH", id, map[string]string{"Upload-Offset": strconv.Itoa(half)}, dummySchema[half:])
+	if rr.Code != http.StatusOK {
+		t.Fatalf("expected the last chunk to be appended but got status %d, body '%s'", rr.Code, rr.Body.String())
+	}
+
+	rr = serveUpload(apiHandler.FinalizeUploadHandler, "POST", id, nil, nil)
+	if rr.Code != http.StatusOK || !strings.Contains(rr.Body.String(), `"version":1`) {
+		t.Fatalf("expected version 1 to be created but got status %d, body '%s'", rr.Code, rr.Body.String())
+	}
+	schema, err := apiHandler.Database.GetSchema(context.Background(), "payments", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if schema.OriginalFilename != "payments.json" || schema.Format != "json" {
+		t.Errorf("unexpected schema %+v", schema)
+	}
+	schemaFile, err := apiHandler.Storage.GetSchema(context.Background(), "payments", 1)
+	if err != nil || !bytes.Equal(schemaFile, dummySchema) {
+		t.Errorf("expected the assembled file to be stored but got '%s' (%v)", schemaFile, err)
+	}
+
+	// The finished session is removed
+	rr = serveUpload(apiHandler.GetUploadHandler, "GET", id, nil, nil)
+	if rr.Code != http.StatusNotFound {
+		t.Errorf("expected status %d after finalizing but got %d", http.StatusNotFound, rr.Code)
+	}
+}
+
+func TestResumableUploadInvalidSchema(t *testing.T) {
+	apiHandler := newTestUploadHandler(t)
+
+	upload, err := apiHandler.Uploads.Create("payments", "", "", -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	id := map[string]string{"id": upload.ID}
+	rr := serveUpload(apiHandler.AppendUploadHandler, "PATCH", id, map[string]string{"Upload-Offset": "0"}, []byte(`{"openapi": `))
+	if rr.Code != http.StatusOK {
+		t.Fatalf("expected the chunk to be appended but got status %d", rr.Code)
+	}
+
+	// The file is only validated once it is complete
+	rr = serveUpload(apiHandler.FinalizeUploadHandler, "POST", id, nil, nil)
+	if rr.Code != http.StatusBadRequest {
+		t.Errorf("expected status %d but got %d", http.StatusBadRequest, rr.Code)
+	}
+	if versions, _ := apiHandler.Database.GetAllVersionsForSchema(context.Background(), "payments"); len(versions) != 0 {
+		t.Errorf("expected no version to be created but got %v", versions)
+	}
+}
+
+func TestResumableUploadLimits(t *testing.T) {
+	apiHandler := newTestUploadHandler(t)
+	apiHandler.MaxUploadSize = 8
+
+	rr := serveUpload(apiHandler.CreateUploadHandler, "POST", map[string]string{"name": "payments"}, map[string]string{"Upload-Length": "9"}, nil)
+	if rr.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("expected status %d for a declared length over the limit but got %d", http.StatusRequestEntityTooLarge, rr.Code)
+	}
+
+	upload, err := apiHandler.Uploads.Create("payments", "", "", -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rr = serveUpload(apiHandler.AppendUploadHandler, "PATCH", map[string]string{"id": upload.ID}, map[string]string{"Upload-Offset": "0"}, []byte("openapi: 3"))
+	if rr.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("expected status %d for a chunk over the limit but got %d", http.StatusRequestEntityTooLarge, rr.Code)
+	}
+
+	rr = serveUpload(apiHandler.DeleteUploadHandler, "DELETE", map[string]string{"id": upload.ID}, nil, nil)
+	if rr.Code != http.StatusNoContent {
+		t.Errorf("expected status %d for an abandoned upload but got %d", http.StatusNoContent, rr.Code)
+	}
+
+	rr = serveUpload(newTestAPIHandler().CreateUploadHandler, "POST", map[string]string{"name": "payments"}, nil, nil)
+	if rr.Code != http.StatusNotImplemented {
+		t.Errorf("expected status %d without upload sessions but got %d", http.StatusNotImplemented, rr.Code)
+	}
+}
+
+func TestResumableUploadSessionLimit(t *testing.T) {
+	apiHandler := newTestUploadHandler(t)
+	apiHandler.Uploads.MaxSessions = 1
+
+	rr := serveUpload(apiHandler.CreateUploadHandler, "POST", map[string]string{"name": "payments"}, nil, nil)
+	if rr.Code != http.StatusCreated {
+		t.Fatalf("expected status %d but got %d", http.StatusCreated, rr.Code)
+	}
+	rr = serveUpload(apiHandler.CreateUploadHandler, "POST", map[string]string{"name": "payments"}, nil, nil)
+	if rr.Code != http.StatusServiceUnavailable {
+		t.Errorf("expected status %d past the maximum number of uploads but got %d", http.StatusServiceUnavailable, rr.Code)
+	}
+	if rr.Header().Get("Retry-After") == "" {
+		t.Error("expected a Retry-After header")
+	}
+}
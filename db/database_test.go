@@ -0,0 +1,366 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"example.com/levo_app/metrics"
+	"example.com/levo_app/schemaname"
+)
+
+// testRepository runs the behaviour every Repository implementation must share
+func testRepository(t *testing.T, repo Repository) {
+	ctx := context.Background()
+
+	latestVersion, err := repo.GetLatestSchemaVersion(ctx, "dummy.json")
+	if err != nil {
+		t.Fatalf("failed to get latest version of an unknown schema: %v", err)
+	}
+	if latestVersion != 0 {
+		t.Errorf("expected latest version 0 but got %d", latestVersion)
+	}
+
+	timestamp := time.Date(2023, 7, 1, 12, 0, 0, 0, time.UTC)
+	for _, schema := range []Schema{
+		{Version: 2, Filename: "dummy.json", Timestamp: timestamp, Checksum: "abc123", OriginalFilename: "api.json", Format: "json"},
+		{Version: 1, Filename: "dummy.json", Timestamp: timestamp},
+		{Version: 1, Filename: "other.yaml", Timestamp: timestamp},
+	} {
+		if err := repo.SaveSchema(ctx, schema); err != nil {
+			t.Fatalf("failed to save schema: %v", err)
+		}
+	}
+
+	err = repo.SaveSchema(ctx, Schema{Version: 1, Filename: "../dummy.json", Timestamp: timestamp})
+	if !errors.Is(err, schemaname.ErrInvalidName) {
+		t.Errorf("expected an invalid name to be rejected with ErrInvalidName but got %v", err)
+	}
+	_, err = repo.SaveNextSchemaVersion(ctx, Schema{Filename: "Dummy.json", Timestamp: timestamp}, func(int64) error { return nil })
+	if !errors.Is(err, schemaname.ErrInvalidName) {
+		t.Errorf("expected a name that is not normalized to be rejected with ErrInvalidName but got %v", err)
+	}
+
+	schema, err := repo.GetSchema(ctx, "dummy.json", 2)
+	if err != nil {
+		t.Fatalf("failed to get schema: %v", err)
+	}
+	if schema.Filename != "dummy.json" || schema.Version != 2 || !schema.Timestamp.Equal(timestamp) || schema.Checksum != "abc123" ||
+		schema.OriginalFilename != "api.json" || schema.Format != "json" {
+		t.Errorf("unexpected schema record %+v", schema)
+	}
+
+	_, err = repo.GetSchema(ctx, "dummy.json", 3)
+	if !errors.Is(err, ErrSchemaNotFound) {
+		t.Errorf("expected ErrSchemaNotFound but got %v", err)
+	}
+
+	schema, err = repo.GetSchemaByChecksum(ctx, "abc123")
+	if err != nil {
+		t.Fatalf("failed to get schema by checksum: %v", err)
+	}
+	if schema.Filename != "dummy.json" || schema.Version != 2 {
+		t.Errorf("unexpected schema record %+v", schema)
+	}
+	_, err = repo.GetSchemaByChecksum(ctx, "def456")
+	if !errors.Is(err, ErrSchemaNotFound) {
+		t.Errorf("expected ErrSchemaNotFound but got %v", err)
+	}
+
+	latestVersion, err = repo.GetLatestSchemaVersion(ctx, "dummy.json")
+	if err != nil {
+		t.Fatalf("failed to get latest version: %v", err)
+	}
+	if latestVersion != 2 {
+		t.Errorf("expected latest version 2 but got %d", latestVersion)
+	}
+
+	versions, err := repo.GetAllVersionsForSchema(ctx, "dummy.json")
+	if err != nil {
+		t.Fatalf("failed to get versions: %v", err)
+	}
+	if !reflect.DeepEqual(versions, []int64{1, 2}) {
+		t.Errorf("expected versions [1 2] but got %v", versions)
+	}
+
+	schemas, err := repo.ListSchemaVersions(ctx, "dummy.json")
+	if err != nil {
+		t.Fatalf("failed to list versions: %v", err)
+	}
+	if len(schemas) != 2 || schemas[0].Version != 1 || schemas[0].Checksum != "" || schemas[1].Checksum != "abc123" {
+		t.Errorf("unexpected version records %+v", schemas)
+	}
+
+	// Renaming moves every version, but never onto the versions of another schema
+	if err := repo.SaveSchema(ctx, Schema{Version: 1, Filename: "other.json", Timestamp: timestamp}); err != nil {
+		t.Fatal(err)
+	}
+	if err := repo.RenameSchema(ctx, "dummy.json", "other.json"); !errors.Is(err, ErrSchemaExists) {
+		t.Errorf("expected ErrSchemaExists but got %v", err)
+	}
+	if err := repo.RenameSchema(ctx, "dummy.json", "Renamed.json"); !errors.Is(err, schemaname.ErrInvalidName) {
+		t.Errorf("expected a new name that is not normalized to be rejected with ErrInvalidName but got %v", err)
+	}
+	if err := repo.RenameSchema(ctx, "dummy.json", "renamed.json"); err != nil {
+		t.Fatalf("failed to rename schema: %v", err)
+	}
+	versions, err = repo.GetAllVersionsForSchema(ctx, "renamed.json")
+	if err != nil {
+		t.Fatalf("failed to get versions: %v", err)
+	}
+	if !reflect.DeepEqual(versions, []int64{1, 2}) {
+		t.Errorf("expected versions [1 2] under the new name but got %v", versions)
+	}
+	if latestVersion, err = repo.GetLatestSchemaVersion(ctx, "dummy.json"); err != nil || latestVersion != 0 {
+		t.Errorf("expected no version left under the old name but got %d, %v", latestVersion, err)
+	}
+}
+
+func TestMemoryRepository(t *testing.T) {
+	testRepository(t, NewMemoryRepository())
+}
+
+// newTestSQLiteDatabase creates a migrated in-memory sqlite database
+func newTestSQLiteDatabase(t *testing.T) *Database {
+	t.Helper()
+
+	database, err := InitializeSQLite(":memory:")
+	if err != nil {
+		t.Fatalf("failed to initialize sqlite: %v", err)
+	}
+	t.Cleanup(func() { database.DB.Close() })
+
+	if err := database.Migrate(context.Background()); err != nil {
+		t.Fatalf("failed to migrate sqlite: %v", err)
+	}
+
+	return database
+}
+
+func TestSQLiteDatabase(t *testing.T) {
+	testRepository(t, newTestSQLiteDatabase(t))
+}
+
+func TestMigrate(t *testing.T) {
+	ctx := context.Background()
+	database := newTestSQLiteDatabase(t)
+
+	version, err := database.MigrationVersion(ctx)
+	if err != nil {
+		t.Fatalf("failed to get migration version: %v", err)
+	}
+	if version != LatestMigrationVersion() {
+		t.Errorf("expected migration version %d but got %d", LatestMigrationVersion(), version)
+	}
+
+	// Migrating an up-to-date database must be a no-op
+	if err := database.Migrate(ctx); err != nil {
+		t.Fatalf("failed to migrate twice: %v", err)
+	}
+
+	var applied int
+	err = database.DB.QueryRow("SELECT COUNT(*) FROM schema_migrations").Scan(&applied)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if applied != len(migrations) {
+		t.Errorf("expected %d applied migrations but got %d", len(migrations), applied)
+	}
+}
+
+func TestMigrateDuplicateVersions(t *testing.T) {
+	ctx := context.Background()
+
+	database, err := InitializeSQLite(":memory:")
+	if err != nil {
+		t.Fatalf("failed to initialize sqlite: %v", err)
+	}
+	t.Cleanup(func() { database.DB.Close() })
+
+	// A table created before the unique index, with a version recorded twice
+	for _, statement := range migrations[0].sqlite {
+		if _, err := database.DB.Exec(statement); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, row := range []struct {
+		filename string
+		version  int64
+	}{{"dummy.json", 1}, {"dummy.json", 2}, {"dummy.json", 2}, {"other.yaml", 1}} {
+		_, err := database.DB.Exec("INSERT INTO schemas (filename, version, created_on) VALUES ($1, $2, $3)", row.filename, row.version, time.Now())
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	err = database.Migrate(ctx)
+	if err == nil {
+		t.Fatal("expected the migration to fail on duplicate versions")
+	}
+	if !strings.Contains(err.Error(), "dummy.json version 2 (2 rows)") {
+		t.Errorf("expected the duplicate to be listed but got: %v", err)
+	}
+	if strings.Contains(err.Error(), "other.yaml") {
+		t.Errorf("expected only the duplicates to be listed but got: %v", err)
+	}
+
+	version, err := database.MigrationVersion(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if version != 1 {
+		t.Errorf("expected the migration to stop at version 1 but got %d", version)
+	}
+
+	// Once resolved by hand the migration goes through
+	_, err = database.DB.Exec("DELETE FROM schemas WHERE id = (SELECT MAX(id) FROM schemas WHERE filename = 'dummy.json' AND version = 2)")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := database.Migrate(ctx); err != nil {
+		t.Fatalf("failed to migrate after removing the duplicate: %v", err)
+	}
+}
+
+// testSaveNextSchemaVersionConcurrent checks that parallel uploads of a schema get distinct versions
+func testSaveNextSchemaVersionConcurrent(t *testing.T, repo Repository) {
+	ctx := context.Background()
+
+	const uploads = 20
+	versions := make(chan int64, uploads)
+	var wg sync.WaitGroup
+	for i := 0; i < uploads; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			schema, err := repo.SaveNextSchemaVersion(ctx, Schema{Filename: "dummy.json", Timestamp: time.Now()}, func(version int64) error {
+				return nil
+			})
+			if err != nil {
+				t.Errorf("failed to save next version: %v", err)
+				return
+			}
+			versions <- schema.Version
+		}()
+	}
+	wg.Wait()
+	close(versions)
+
+	seen := make(map[int64]bool)
+	for version := range versions {
+		if seen[version] {
+			t.Errorf("version %d was allocated twice", version)
+		}
+		seen[version] = true
+	}
+	for version := int64(1); version <= uploads; version++ {
+		if !seen[version] {
+			t.Errorf("version %d was not allocated", version)
+		}
+	}
+
+	// A failing persist must not record nor consume the version
+	_, err := repo.SaveNextSchemaVersion(ctx, Schema{Filename: "dummy.json", Timestamp: time.Now()}, func(version int64) error {
+		return errors.New("disk full")
+	})
+	if err == nil {
+		t.Error("expected the persist error to be returned")
+	}
+	latestVersion, err := repo.GetLatestSchemaVersion(ctx, "dummy.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if latestVersion != uploads {
+		t.Errorf("expected latest version %d but got %d", uploads, latestVersion)
+	}
+}
+
+func TestMemoryRepositoryConcurrentVersions(t *testing.T) {
+	testSaveNextSchemaVersionConcurrent(t, NewMemoryRepository())
+}
+
+func TestSQLiteDatabaseConcurrentVersions(t *testing.T) {
+	testSaveNextSchemaVersionConcurrent(t, newTestSQLiteDatabase(t))
+}
+
+func TestSQLiteDatabaseUniqueVersions(t *testing.T) {
+	database := newTestSQLiteDatabase(t)
+	ctx := context.Background()
+
+	schema := Schema{Version: 1, Filename: "dummy.json", Timestamp: time.Now()}
+	if err := database.SaveSchema(ctx, schema); err != nil {
+		t.Fatal(err)
+	}
+	if err := database.SaveSchema(ctx, schema); err == nil {
+		t.Error("expected a duplicate version to be rejected")
+	}
+}
+
+// testSaveNextSchemaVersionUnchanged checks that an upload with the latest content digest is not saved
+func testSaveNextSchemaVersionUnchanged(t *testing.T, repo Repository) {
+	ctx := context.Background()
+	persist := func(version int64) error { return nil }
+
+	for _, digest := range []string{"aaa", "bbb"} {
+		_, err := repo.SaveNextSchemaVersion(ctx, Schema{Filename: "dummy.json", Timestamp: time.Now(), ContentDigest: digest}, persist)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	schema, err := repo.SaveNextSchemaVersion(ctx, Schema{Filename: "dummy.json", Timestamp: time.Now(), ContentDigest: "bbb"}, func(version int64) error {
+		t.Error("expected persist not to be called for unchanged content")
+		return nil
+	})
+	if !errors.Is(err, ErrSchemaUnchanged) {
+		t.Errorf("expected ErrSchemaUnchanged but got %v", err)
+	}
+	if schema.Version != 2 {
+		t.Errorf("expected the latest version 2 to be returned but got %d", schema.Version)
+	}
+
+	// Only the latest version counts, going back to older content is a new version
+	schema, err = repo.SaveNextSchemaVersion(ctx, Schema{Filename: "dummy.json", Timestamp: time.Now(), ContentDigest: "aaa"}, persist)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if schema.Version != 3 {
+		t.Errorf("expected version 3 but got %d", schema.Version)
+	}
+}
+
+func TestMemoryRepositoryUnchanged(t *testing.T) {
+	testSaveNextSchemaVersionUnchanged(t, NewMemoryRepository())
+}
+
+func TestSQLiteDatabaseUnchanged(t *testing.T) {
+	testSaveNextSchemaVersionUnchanged(t, newTestSQLiteDatabase(t))
+}
+
+func TestSQLiteDatabaseQueryDuration(t *testing.T) {
+	ctx := context.Background()
+	database := newTestSQLiteDatabase(t)
+	database.QueryDuration = NewQueryDurationHistogram(metrics.NewRegistry())
+
+	_, err := database.SaveNextSchemaVersion(ctx, Schema{Filename: "dummy.json", Timestamp: time.Now()}, func(version int64) error { return nil })
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		if _, err := database.GetSchema(ctx, "dummy.json", 1); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if count := database.QueryDuration.Count("save_next_schema_version"); count != 1 {
+		t.Errorf("expected 1 save_next_schema_version query but got %d", count)
+	}
+	if count := database.QueryDuration.Count("get_schema"); count != 2 {
+		t.Errorf("expected 2 get_schema queries but got %d", count)
+	}
+}
@@ -0,0 +1,248 @@
+package db
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+
+	"example.com/levo_app/schemaname"
+)
+
+// MemoryRepository is a thread-safe in-memory metadata repository, useful for tests and embedding
+type MemoryRepository struct {
+	mu      sync.RWMutex
+	nextID  int
+	schemas map[string]map[int64]Schema
+
+	// allocMu serializes version allocation without blocking readers while persisting
+	allocMu sync.Mutex
+}
+
+var _ Repository = (*MemoryRepository)(nil)
+
+// NewMemoryRepository creates a new empty in-memory repository
+func NewMemoryRepository() *MemoryRepository {
+	return &MemoryRepository{nextID: 1, schemas: make(map[string]map[int64]Schema)}
+}
+
+// SaveSchema saves the schema record in memory, assigning it the next ID
+func (mr *MemoryRepository) SaveSchema(ctx context.Context, schema Schema) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if err := schemaname.Validate(schema.Filename); err != nil {
+		return fmt.Errorf("failed to save schema: %w", err)
+	}
+
+	mr.mu.Lock()
+	defer mr.mu.Unlock()
+
+	_, err := mr.insert(schema)
+	return err
+}
+
+// SaveNextSchemaVersion allocates the next version of the schema, calls persist with it and saves the record.
+// An upload with the same ContentDigest as the latest version returns the latest record with ErrSchemaUnchanged.
+func (mr *MemoryRepository) SaveNextSchemaVersion(ctx context.Context, schema Schema, persist func(version int64) error) (Schema, error) {
+	if err := schemaname.Validate(schema.Filename); err != nil {
+		return Schema{}, fmt.Errorf("failed to save schema: %w", err)
+	}
+
+	mr.allocMu.Lock()
+	defer mr.allocMu.Unlock()
+
+	latestVersion, err := mr.GetLatestSchemaVersion(ctx, schema.Filename)
+	if err != nil {
+		return Schema{}, err
+	}
+	if schema.ContentDigest != "" && latestVersion > 0 {
+		latest, err := mr.GetSchema(ctx, schema.Filename, latestVersion)
+		if err != nil {
+			return Schema{}, err
+		}
+		if latest.ContentDigest == schema.ContentDigest {
+			return latest, ErrSchemaUnchanged
+		}
+	}
+	schema.Version = latestVersion + 1
+
+	err = persist(schema.Version)
+	if err != nil {
+		return Schema{}, err
+	}
+
+	mr.mu.Lock()
+	defer mr.mu.Unlock()
+
+	return mr.insert(schema)
+}
+
+// insert adds the record with the next ID, like the unique index of the database it refuses
+// duplicate versions. The caller must hold mu.
+func (mr *MemoryRepository) insert(schema Schema) (Schema, error) {
+	versions, ok := mr.schemas[schema.Filename]
+	if !ok {
+		versions = make(map[int64]Schema)
+		mr.schemas[schema.Filename] = versions
+	}
+	if _, ok := versions[schema.Version]; ok {
+		return Schema{}, fmt.Errorf("failed to save schema: version '%d' of '%s' already exists", schema.Version, schema.Filename)
+	}
+
+	schema.ID = mr.nextID
+	mr.nextID++
+	versions[schema.Version] = schema
+
+	return schema, nil
+}
+
+// GetSchema retrieves a specific version of a schema record
+func (mr *MemoryRepository) GetSchema(ctx context.Context, filename string, version int64) (Schema, error) {
+	if err := ctx.Err(); err != nil {
+		return Schema{}, err
+	}
+
+	mr.mu.RLock()
+	defer mr.mu.RUnlock()
+
+	schema, ok := mr.schemas[filename][version]
+	if !ok {
+		return Schema{}, fmt.Errorf("failed to get schema '%s' version '%d': %w", filename, version, ErrSchemaNotFound)
+	}
+
+	return schema, nil
+}
+
+// GetLatestSchemaVersion returns the highest version recorded for the schema, or 0 if there is none
+func (mr *MemoryRepository) GetLatestSchemaVersion(ctx context.Context, filename string) (int64, error) {
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+
+	mr.mu.RLock()
+	defer mr.mu.RUnlock()
+
+	var latestVersion int64
+	for version := range mr.schemas[filename] {
+		if version > latestVersion {
+			latestVersion = version
+		}
+	}
+
+	return latestVersion, nil
+}
+
+// GetAllVersionsForSchema returns all the versions recorded for the schema in ascending order
+func (mr *MemoryRepository) GetAllVersionsForSchema(ctx context.Context, filename string) ([]int64, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	mr.mu.RLock()
+	defer mr.mu.RUnlock()
+
+	var versions []int64
+	for version := range mr.schemas[filename] {
+		versions = append(versions, version)
+	}
+	sort.Slice(versions, func(i, j int) bool { return versions[i] < versions[j] })
+
+	return versions, nil
+}
+
+// GetSchemaByChecksum returns the oldest schema version record with the given checksum
+func (mr *MemoryRepository) GetSchemaByChecksum(ctx context.Context, checksum string) (Schema, error) {
+	if err := ctx.Err(); err != nil {
+		return Schema{}, err
+	}
+
+	mr.mu.RLock()
+	defer mr.mu.RUnlock()
+
+	var found Schema
+	for _, versions := range mr.schemas {
+		for _, schema := range versions {
+			if schema.Checksum == checksum && (found.ID == 0 || schema.ID < found.ID) {
+				found = schema
+			}
+		}
+	}
+	if found.ID == 0 {
+		return Schema{}, fmt.Errorf("failed to get schema with checksum '%s': %w", checksum, ErrSchemaNotFound)
+	}
+
+	return found, nil
+}
+
+// ListSchemaVersions returns the records of all the versions of the schema in ascending version order
+func (mr *MemoryRepository) ListSchemaVersions(ctx context.Context, filename string) ([]Schema, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	mr.mu.RLock()
+	defer mr.mu.RUnlock()
+
+	schemas := []Schema{}
+	for _, schema := range mr.schemas[filename] {
+		schemas = append(schemas, schema)
+	}
+	sort.Slice(schemas, func(i, j int) bool { return schemas[i].Version < schemas[j].Version })
+
+	return schemas, nil
+}
+
+// ListSchemas returns the records of all the schema versions ordered by filename and version
+func (mr *MemoryRepository) ListSchemas(ctx context.Context) ([]Schema, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	mr.mu.RLock()
+	defer mr.mu.RUnlock()
+
+	schemas := []Schema{}
+	for _, versions := range mr.schemas {
+		for _, schema := range versions {
+			schemas = append(schemas, schema)
+		}
+	}
+	sort.Slice(schemas, func(i, j int) bool {
+		if schemas[i].Filename != schemas[j].Filename {
+			return schemas[i].Filename < schemas[j].Filename
+		}
+		return schemas[i].Version < schemas[j].Version
+	})
+
+	return schemas, nil
+}
+
+// RenameSchema moves the records of the schema to a new name
+func (mr *MemoryRepository) RenameSchema(ctx context.Context, filename string, newFilename string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if err := schemaname.Validate(newFilename); err != nil {
+		return fmt.Errorf("failed to rename schema: %w", err)
+	}
+
+	mr.mu.Lock()
+	defer mr.mu.Unlock()
+
+	if len(mr.schemas[newFilename]) > 0 {
+		return fmt.Errorf("failed to rename schema '%s' to '%s': %w", filename, newFilename, ErrSchemaExists)
+	}
+	versions, ok := mr.schemas[filename]
+	if !ok {
+		return nil
+	}
+	for version, schema := range versions {
+		schema.Filename = newFilename
+		versions[version] = schema
+	}
+	delete(mr.schemas, filename)
+	mr.schemas[newFilename] = versions
+
+	return nil
+}
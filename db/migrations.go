@@ -0,0 +1,267 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"strings"
+	"time"
+
+	"example.com/levo_app/logging"
+)
+
+// migration is a versioned change of the database structure. Migrations are applied in order
+// and never edited once released, new columns or indexes get a new migration appended to the list.
+type migration struct {
+	version  int
+	name     string
+	postgres []string
+	sqlite   []string
+	// check, when set, runs in the migration transaction before the statements and aborts the
+	// migration when the existing rows can't be migrated
+	check func(ctx context.Context, tx *sql.Tx) error
+}
+
+// migrations lists every migration of the metadata database, in ascending version order
+var migrations = []migration{
+	{
+		version: 1,
+		name:    "create schemas table",
+		// IF NOT EXISTS keeps this idempotent for databases that were set up by hand from the README
+		postgres: []string{
+			`CREATE SEQUENCE IF NOT EXISTS levo_sequence START WITH 1 INCREMENT BY 1 NO MINVALUE NO MAXVALUE CACHE 1`,
+			`CREATE TABLE IF NOT EXISTS schemas(
+				id BIGINT PRIMARY KEY DEFAULT nextval('levo_sequence'),
+				filename TEXT,
+				version BIGINT,
+				created_on TIMESTAMPTZ
+			)`,
+		},
+		sqlite: []string{
+			`CREATE TABLE IF NOT EXISTS schemas(
+				id INTEGER PRIMARY KEY AUTOINCREMENT,
+				filename TEXT,
+				version BIGINT,
+				created_on TIMESTAMP
+			)`,
+		},
+	},
+	{
+		version: 2,
+		name:    "unique schema versions",
+		// Duplicates can't be renumbered, the stored files are keyed by version and only one of
+		// the rows matches the content, so they have to be resolved by hand before migrating
+		check: checkDuplicateVersions,
+		postgres: []string{
+			`CREATE UNIQUE INDEX IF NOT EXISTS schemas_filename_version_key ON schemas (filename, version)`,
+		},
+		sqlite: []string{
+			`CREATE UNIQUE INDEX IF NOT EXISTS schemas_filename_version_key ON schemas (filename, version)`,
+		},
+	},
+	{
+		version: 3,
+		name:    "schema checksums",
+		postgres: []string{
+			`ALTER TABLE schemas ADD COLUMN IF NOT EXISTS checksum TEXT`,
+		},
+		sqlite: []string{
+			`ALTER TABLE schemas ADD COLUMN checksum TEXT`,
+		},
+	},
+	{
+		version: 4,
+		name:    "schema content digests",
+		postgres: []string{
+			`ALTER TABLE schemas ADD COLUMN IF NOT EXISTS content_digest TEXT`,
+		},
+		sqlite: []string{
+			`ALTER TABLE schemas ADD COLUMN content_digest TEXT`,
+		},
+	},
+	{
+		version: 5,
+		name:    "schema checksum index",
+		postgres: []string{
+			`CREATE INDEX IF NOT EXISTS schemas_checksum_idx ON schemas (checksum)`,
+		},
+		sqlite: []string{
+			`CREATE INDEX IF NOT EXISTS schemas_checksum_idx ON schemas (checksum)`,
+		},
+	},
+	{
+		version: 6,
+		name:    "schema original filenames and formats",
+		// Until now the schema name was the uploaded file name and the format its extension
+		postgres: []string{
+			`ALTER TABLE schemas ADD COLUMN IF NOT EXISTS original_filename TEXT`,
+			`ALTER TABLE schemas ADD COLUMN IF NOT EXISTS format TEXT`,
+			`UPDATE schemas SET original_filename = filename WHERE original_filename IS NULL`,
+			`UPDATE schemas SET format = 'json' WHERE format IS NULL AND LOWER(filename) LIKE '%.json'`,
+			`UPDATE schemas SET format = 'yaml' WHERE format IS NULL AND LOWER(filename) LIKE '%.yaml'`,
+		},
+		sqlite: []string{
+			`ALTER TABLE schemas ADD COLUMN original_filename TEXT`,
+			`ALTER TABLE schemas ADD COLUMN format TEXT`,
+			`UPDATE schemas SET original_filename = filename WHERE original_filename IS NULL`,
+			`UPDATE schemas SET format = 'json' WHERE format IS NULL AND LOWER(filename) LIKE '%.json'`,
+			`UPDATE schemas SET format = 'yaml' WHERE format IS NULL AND LOWER(filename) LIKE '%.yaml'`,
+		},
+	},
+}
+
+// migrationLockID is the postgres advisory lock key held while migrating, so that replicas
+// starting at the same time don't apply the same migration twice
+const migrationLockID = 7_482_001
+
+// statements returns the SQL of the migration for the given driver
+func (m migration) statements(driver string) ([]string, error) {
+	switch driver {
+	case DriverPostgres:
+		return m.postgres, nil
+	case DriverSQLite:
+		return m.sqlite, nil
+	default:
+		return nil, fmt.Errorf("unsupported database driver: %s", driver)
+	}
+}
+
+// Migrate applies all the migrations that have not been applied yet. The applied level is
+// tracked in the schema_migrations table, so calling it on an up-to-date database is a no-op.
+func (db *Database) Migrate(ctx context.Context) error {
+	// Pin a single connection, the postgres advisory lock is held per session
+	conn, err := db.DB.Conn(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to get a database connection: %v", err)
+	}
+	defer conn.Close()
+
+	if db.Driver == DriverPostgres {
+		_, err = conn.ExecContext(ctx, "SELECT pg_advisory_lock($1)", migrationLockID)
+		if err != nil {
+			return fmt.Errorf("failed to acquire the migration lock: %v", err)
+		}
+		defer conn.ExecContext(context.Background(), "SELECT pg_advisory_unlock($1)", migrationLockID)
+	}
+
+	_, err = conn.ExecContext(ctx, `CREATE TABLE IF NOT EXISTS schema_migrations(
+		version INTEGER PRIMARY KEY,
+		name TEXT,
+		applied_on TIMESTAMP
+	)`)
+	if err != nil {
+		return fmt.Errorf("failed to create the schema_migrations table: %v", err)
+	}
+
+	current, err := migrationVersion(ctx, conn)
+	if err != nil {
+		return err
+	}
+
+	for _, m := range migrations {
+		if m.version <= current {
+			continue
+		}
+
+		statements, err := m.statements(db.Driver)
+		if err != nil {
+			return err
+		}
+
+		err = applyMigration(ctx, conn, m, statements)
+		if err != nil {
+			return fmt.Errorf("failed to apply migration %d (%s): %v", m.version, m.name, err)
+		}
+
+		logging.FromContext(ctx, db.Logger).Info("applied database migration", "version", m.version, "name", m.name)
+	}
+
+	return nil
+}
+
+// MigrationVersion returns the version of the last applied migration, or 0 for a fresh database
+func (db *Database) MigrationVersion(ctx context.Context) (int, error) {
+	conn, err := db.DB.Conn(ctx)
+	if err != nil {
+		return 0, fmt.Errorf("failed to get a database connection: %v", err)
+	}
+	defer conn.Close()
+
+	return migrationVersion(ctx, conn)
+}
+
+// LatestMigrationVersion returns the version the database is at once every migration is applied
+func LatestMigrationVersion() int {
+	return migrations[len(migrations)-1].version
+}
+
+func migrationVersion(ctx context.Context, conn *sql.Conn) (int, error) {
+	var version sql.NullInt64
+	err := conn.QueryRowContext(ctx, "SELECT MAX(version) FROM schema_migrations").Scan(&version)
+	if err != nil {
+		return 0, fmt.Errorf("failed to get the migration version: %v", err)
+	}
+
+	return int(version.Int64), nil
+}
+
+// applyMigration checks and runs the statements of a migration and records it in a single transaction
+func applyMigration(ctx context.Context, conn *sql.Conn, m migration, statements []string) error {
+	tx, err := conn.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if m.check != nil {
+		err = m.check(ctx, tx)
+		if err != nil {
+			return err
+		}
+	}
+
+	for _, statement := range statements {
+		_, err = tx.ExecContext(ctx, statement)
+		if err != nil {
+			return err
+		}
+	}
+
+	_, err = tx.ExecContext(ctx, "INSERT INTO schema_migrations (version, name, applied_on) VALUES ($1, $2, $3)", m.version, m.name, time.Now())
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// checkDuplicateVersions fails with the list of the schema versions recorded more than once
+func checkDuplicateVersions(ctx context.Context, tx *sql.Tx) error {
+	rows, err := tx.QueryContext(ctx, `SELECT filename, version, COUNT(*) FROM schemas
+		GROUP BY filename, version HAVING COUNT(*) > 1 ORDER BY filename, version`)
+	if err != nil {
+		return fmt.Errorf("failed to look for duplicate schema versions: %v", err)
+	}
+	defer rows.Close()
+
+	var duplicates []string
+	for rows.Next() {
+		var filename string
+		var version, count int64
+		err = rows.Scan(&filename, &version, &count)
+		if err != nil {
+			return fmt.Errorf("failed to look for duplicate schema versions: %v", err)
+		}
+		duplicates = append(duplicates, fmt.Sprintf("%s version %d (%d rows)", filename, version, count))
+	}
+	err = rows.Err()
+	if err != nil {
+		return fmt.Errorf("failed to look for duplicate schema versions: %v", err)
+	}
+
+	if len(duplicates) > 0 {
+		return fmt.Errorf("schema versions are recorded more than once, delete the extra rows of the schemas table and migrate again: %s", strings.Join(duplicates, ", "))
+	}
+
+	return nil
+}
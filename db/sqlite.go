@@ -0,0 +1,29 @@
+package db
+
+import (
+	"database/sql"
+	"fmt"
+
+	_ "modernc.org/sqlite" // pure Go SQLite driver
+)
+
+// InitializeSQLite opens (or creates) an embedded SQLite database at the given path.
+// Use ":memory:" for a throwaway database. Tables are created by Migrate.
+func InitializeSQLite(path string) (*Database, error) {
+	db, err := sql.Open(DriverSQLite, path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open the sqlite database: %v", err)
+	}
+
+	// SQLite allows a single writer at a time, and every connection to ":memory:" is a
+	// separate database, so all queries go through one connection
+	db.SetMaxOpenConns(1)
+
+	_, err = db.Exec("PRAGMA busy_timeout = 5000")
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("failed to configure the sqlite database: %v", err)
+	}
+
+	return &Database{DB: db, Driver: DriverSQLite}, nil
+}
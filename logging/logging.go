@@ -0,0 +1,266 @@
+// Package logging is a small structured, leveled logger. A log line is a message with key-value
+// attributes, written as "key=value" text or as a JSON object:
+//
+//	time=2026-10-17T09:30:00.000Z level=INFO msg="schema uploaded" request_id=3f2a... name=payments version=4
+//
+// Loggers derived with With share the output of their parent and add attributes to every line, the
+// HTTP middleware uses it to tag the lines of a request with its ID. A nil *Logger discards everything.
+package logging
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+)
+
+// Level is the severity of a log line
+type Level int
+
+// Levels of the log lines, a logger writes the lines at or above its level
+const (
+	LevelDebug Level = iota - 1
+	LevelInfo
+	LevelWarn
+	LevelError
+)
+
+// Formats of the log lines
+const (
+	FormatText = "text"
+	FormatJSON = "json"
+)
+
+// String returns the name of the level as it is written in the log lines
+func (l Level) String() string {
+	switch l {
+	case LevelDebug:
+		return "DEBUG"
+	case LevelInfo:
+		return "INFO"
+	case LevelWarn:
+		return "WARN"
+	case LevelError:
+		return "ERROR"
+	default:
+		return "LEVEL(" + strconv.Itoa(int(l)) + ")"
+	}
+}
+
+// ParseLevel parses a level name, "debug", "info", "warn" or "error"
+func ParseLevel(name string) (Level, error) {
+	switch strings.ToLower(name) {
+	case "debug":
+		return LevelDebug, nil
+	case "info":
+		return LevelInfo, nil
+	case "warn", "warning":
+		return LevelWarn, nil
+	case "error":
+		return LevelError, nil
+	default:
+		return LevelInfo, fmt.Errorf("unknown log level '%s', expected debug, info, warn or error", name)
+	}
+}
+
+// output is the destination shared by a logger and the loggers derived from it
+type output struct {
+	mu     sync.Mutex
+	w      io.Writer
+	level  Level
+	format string
+	// now returns the time of the log lines, it is replaced in tests
+	now func() time.Time
+}
+
+// Logger writes structured log lines
+type Logger struct {
+	out   *output
+	attrs []interface{}
+}
+
+// New creates a logger writing the lines at or above level to w in the given format, FormatText or FormatJSON
+func New(w io.Writer, level Level, format string) (*Logger, error) {
+	if format != FormatText && format != FormatJSON {
+		return nil, fmt.Errorf("unknown log format '%s', expected %s or %s", format, FormatText, FormatJSON)
+	}
+
+	return &Logger{out: &output{w: w, level: level, format: format, now: time.Now}}, nil
+}
+
+// With returns a logger adding the given key-value pairs to every line
+func (l *Logger) With(keyvals ...interface{}) *Logger {
+	if l == nil {
+		return nil
+	}
+
+	attrs := make([]interface{}, 0, len(l.attrs)+len(keyvals))
+	attrs = append(attrs, l.attrs...)
+	attrs = append(attrs, keyvals...)
+	return &Logger{out: l.out, attrs: attrs}
+}
+
+// Enabled reports whether lines of the given level are written
+func (l *Logger) Enabled(level Level) bool {
+	return l != nil && level >= l.out.level
+}
+
+// Debug writes a line for troubleshooting, such as the steps of a request
+func (l *Logger) Debug(msg string, keyvals ...interface{}) {
+	l.log(LevelDebug, msg, keyvals)
+}
+
+// Info writes a line about normal operation
+func (l *Logger) Info(msg string, keyvals ...interface{}) {
+	l.log(LevelInfo, msg, keyvals)
+}
+
+// Warn writes a line about an unexpected situation the server recovered from
+func (l *Logger) Warn(msg string, keyvals ...interface{}) {
+	l.log(LevelWarn, msg, keyvals)
+}
+
+// Error writes a line about a failure
+func (l *Logger) Error(msg string, keyvals ...interface{}) {
+	l.log(LevelError, msg, keyvals)
+}
+
+// log formats and writes a line, the key-value pairs of the line follow the ones of the logger
+func (l *Logger) log(level Level, msg string, keyvals []interface{}) {
+	if !l.Enabled(level) {
+		return
+	}
+
+	out := l.out
+	fields := make([]interface{}, 0, 6+len(l.attrs)+len(keyvals))
+	fields = append(fields, "time", out.now().UTC().Format("2006-01-02T15:04:05.000Z07:00"), "level", level.String(), "msg", msg)
+	fields = append(fields, l.attrs...)
+	fields = append(fields, keyvals...)
+
+	var line []byte
+	if out.format == FormatJSON {
+		line = formatJSON(fields)
+	} else {
+		line = formatText(fields)
+	}
+
+	out.mu.Lock()
+	defer out.mu.Unlock()
+	out.w.Write(line)
+}
+
+// formatText writes the key-value pairs as "key=value", quoting the values that contain spaces or quotes
+func formatText(fields []interface{}) []byte {
+	var buf bytes.Buffer
+	for i := 0; i < len(fields); i += 2 {
+		if i > 0 {
+			buf.WriteByte(' ')
+		}
+		key, value := pair(fields, i)
+		buf.WriteString(key)
+		buf.WriteByte('=')
+
+		text := valueString(value)
+		if needsQuoting(text) {
+			buf.WriteString(strconv.Quote(text))
+		} else {
+			buf.WriteString(text)
+		}
+	}
+	buf.WriteByte('\n')
+	return buf.Bytes()
+}
+
+// formatJSON writes the key-value pairs as a JSON object, keeping their order
+func formatJSON(fields []interface{}) []byte {
+	var buf bytes.Buffer
+	buf.WriteByte('{')
+	for i := 0; i < len(fields); i += 2 {
+		if i > 0 {
+			buf.WriteByte(',')
+		}
+		key, value := pair(fields, i)
+		keyBytes, _ := json.Marshal(key)
+		buf.Write(keyBytes)
+		buf.WriteByte(':')
+
+		switch v := value.(type) {
+		case error:
+			value = v.Error()
+		case json.Marshaler:
+		case fmt.Stringer:
+			// Durations and signals are written as in the text format rather than as numbers
+			value = v.String()
+		}
+		valueBytes, err := json.Marshal(value)
+		if err != nil {
+			valueBytes, _ = json.Marshal(fmt.Sprint(value))
+		}
+		buf.Write(valueBytes)
+	}
+	buf.WriteString("}\n")
+	return buf.Bytes()
+}
+
+// pair returns the key and the value at index i of the fields, a key without a value is logged as such
+func pair(fields []interface{}, i int) (string, interface{}) {
+	if i+1 >= len(fields) {
+		return "!BADKEY", fields[i]
+	}
+	key, ok := fields[i].(string)
+	if !ok {
+		key = fmt.Sprint(fields[i])
+	}
+	return key, fields[i+1]
+}
+
+// valueString formats a value of the text format
+func valueString(value interface{}) string {
+	switch v := value.(type) {
+	case string:
+		return v
+	case error:
+		return v.Error()
+	case time.Duration:
+		return v.String()
+	case time.Time:
+		return v.UTC().Format(time.RFC3339Nano)
+	default:
+		return fmt.Sprint(v)
+	}
+}
+
+// needsQuoting reports whether a text value must be quoted to be parsed back
+func needsQuoting(text string) bool {
+	if text == "" {
+		return true
+	}
+	for _, r := range text {
+		if unicode.IsSpace(r) || r == '"' || r == '=' || !unicode.IsPrint(r) {
+			return true
+		}
+	}
+	return false
+}
+
+// contextKey is the key of the logger in a context
+type contextKey struct{}
+
+// NewContext returns a context carrying the logger, typically tagged with the ID of a request
+func NewContext(ctx context.Context, logger *Logger) context.Context {
+	return context.WithValue(ctx, contextKey{}, logger)
+}
+
+// FromContext returns the logger of the context, or fallback if the context has none
+func FromContext(ctx context.Context, fallback *Logger) *Logger {
+	if logger, ok := ctx.Value(contextKey{}).(*Logger); ok && logger != nil {
+		return logger
+	}
+	return fallback
+}
@@ -0,0 +1,85 @@
+package logging
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+// newTestLogger creates a logger writing to buf at a fixed time
+func newTestLogger(t *testing.T, buf *bytes.Buffer, level Level, format string) *Logger {
+	t.Helper()
+
+	logger, err := New(buf, level, format)
+	if err != nil {
+		t.Fatal(err)
+	}
+	logger.out.now = func() time.Time { return time.Date(2026, 10, 17, 9, 30, 0, 0, time.UTC) }
+	return logger
+}
+
+func TestLoggerText(t *testing.T) {
+	var buf bytes.Buffer
+	logger := newTestLogger(t, &buf, LevelInfo, FormatText).With("request_id", "abc")
+
+	logger.Debug("not written")
+	logger.Info("schema uploaded", "name", "payments", "version", 4, "took", 1500*time.Millisecond)
+	logger.Error("upload failed", "error", errors.New("disk full"), "name", "")
+
+	expected := `time=2026-10-17T09:30:00.000Z level=INFO msg="schema uploaded" request_id=abc name=payments version=4 took=1.5s
+time=2026-10-17T09:30:00.000Z level=ERROR msg="upload failed" request_id=abc error="disk full" name=""
+`
+	if buf.String() != expected {
+		t.Errorf("expected\n%s\nbut got\n%s", expected, buf.String())
+	}
+}
+
+func TestLoggerJSON(t *testing.T) {
+	var buf bytes.Buffer
+	logger := newTestLogger(t, &buf, LevelDebug, FormatJSON)
+
+	logger.Debug("saving schema", "name", "payments", "version", int64(2), "error", errors.New("oops"), "took", 1500*time.Millisecond, "dangling")
+
+	expected := `{"time":"2026-10-17T09:30:00.000Z","level":"DEBUG","msg":"saving schema","name":"payments","version":2,"error":"oops","took":"1.5s","!BADKEY":"dangling"}
+`
+	if buf.String() != expected {
+		t.Errorf("expected\n%s\nbut got\n%s", expected, buf.String())
+	}
+}
+
+func TestLoggerContext(t *testing.T) {
+	var buf bytes.Buffer
+	logger := newTestLogger(t, &buf, LevelInfo, FormatText)
+
+	ctx := NewContext(context.Background(), logger.With("request_id", "abc"))
+	FromContext(ctx, logger).Info("tagged")
+	FromContext(context.Background(), logger).Info("untagged")
+
+	expected := `time=2026-10-17T09:30:00.000Z level=INFO msg=tagged request_id=abc
+time=2026-10-17T09:30:00.000Z level=INFO msg=untagged
+`
+	if buf.String() != expected {
+		t.Errorf("expected\n%s\nbut got\n%s", expected, buf.String())
+	}
+
+	// A nil logger discards everything
+	var discard *Logger
+	discard.With("request_id", "abc").Error("dropped")
+}
+
+func TestParseLevel(t *testing.T) {
+	for name, expected := range map[string]Level{"debug": LevelDebug, "INFO": LevelInfo, "warn": LevelWarn, "error": LevelError} {
+		level, err := ParseLevel(name)
+		if err != nil || level != expected {
+			t.Errorf("expected '%s' to be %v but got %v (%v)", name, expected, level, err)
+		}
+	}
+	if _, err := ParseLevel("verbose"); err == nil {
+		t.Error("expected an unknown level to be rejected")
+	}
+	if _, err := New(&bytes.Buffer{}, LevelInfo, "xml"); err == nil {
+		t.Error("expected an unknown format to be rejected")
+	}
+}
@@ -1,33 +1,272 @@
 package main
 
 import (
-	"log"
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
 	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
 
 	"example.com/levo_app/api"
-	"example.com/levo_app/db"
+	"example.com/levo_app/config"
 	"example.com/levo_app/controller"
+	"example.com/levo_app/db"
+	"example.com/levo_app/logging"
+	"example.com/levo_app/metrics"
+	"example.com/levo_app/service"
 	"example.com/levo_app/storage"
-	
 )
 
 func main() {
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "Usage: %s [flags] [migrate | fsck [-normalize-names] [-rebuild]]\n\n", os.Args[0])
+		fmt.Fprintln(flag.CommandLine.Output(), "Without a command the server is started, \"migrate\" only applies the database migrations")
+		fmt.Fprintln(flag.CommandLine.Output(), "and \"fsck\" checks that the database and the file storage agree.")
+		fmt.Fprintln(flag.CommandLine.Output(), "Every flag can also be set by the environment variable in parentheses or in the -config file.")
+		flag.PrintDefaults()
+	}
+	cfg, err := config.Load(flag.CommandLine, os.Args[1:], os.LookupEnv)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+
+	// The configuration is validated, the level and format are known
+	level, _ := logging.ParseLevel(cfg.Log.Level)
+	logger, err := logging.New(os.Stderr, level, cfg.Log.Format)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+	fatal := func(msg string, err error) {
+		logger.Error(msg, "error", err)
+		os.Exit(1)
+	}
+
+	command := flag.Arg(0)
+	if command != "" && command != "migrate" && command != "fsck" {
+		flag.Usage()
+		os.Exit(2)
+	}
+
 	// Initialize the database connection
-	database, err := db.Initialize()
+	var database *db.Database
+	switch cfg.Database.Driver {
+	case db.DriverPostgres:
+		database, err = db.Initialize(cfg.Database.DSN, db.PoolOptions{
+			MaxOpenConns:    cfg.Database.MaxOpenConns,
+			MaxIdleConns:    cfg.Database.MaxIdleConns,
+			ConnMaxLifetime: cfg.Database.ConnMaxLifetime,
+		})
+	case db.DriverSQLite:
+		database, err = db.InitializeSQLite(cfg.Database.SQLitePath)
+	}
 	if err != nil {
-		log.Fatalf("Failed to initialize database: %v", err)
+		fatal("failed to initialize database", err)
 	}
 	defer database.DB.Close()
+	database.Logger = logger
+	logger.Info("connected to the database", "driver", database.Driver)
+
+	// Bring the database structure up to date
+	err = database.Migrate(context.Background())
+	if err != nil {
+		fatal("failed to migrate database", err)
+	}
+
+	if command == "migrate" {
+		logger.Info("database is up to date", "migration", db.LatestMigrationVersion())
+		return
+	}
 
 	// Initialize the file storage
-	fileStore := storage.NewFileStore("schema_uploads") // Give the base path as param in NewFileStore
+	var fileStore storage.SchemaStore
+	switch cfg.Storage.Backend {
+	case "file":
+		fileStore = &storage.FileStore{BasePath: cfg.Storage.Path, SnapshotInterval: cfg.Storage.DeltaSnapshotInterval, Logger: logger}
+	case "blob":
+		blobStore := storage.NewBlobStore(cfg.Storage.Path)
+		blobStore.Logger = logger
+		fileStore = blobStore
+	case "s3":
+		s3Store := storage.NewS3Store(cfg.Storage.S3Endpoint, cfg.Storage.S3Bucket, cfg.Storage.S3Prefix, cfg.Storage.S3Region)
+		s3Store.MaxSize = storage.MaxStoredSize(cfg.Limits.MaxUploadSize)
+		fileStore = s3Store
+	case "git":
+		fileStore, err = storage.NewGitStore(cfg.Storage.GitRepo)
+		if err != nil {
+			fatal("failed to initialize file storage", err)
+		}
+	}
+
+	// Encrypt and compress the versions on top of the storage backend, compressing before encrypting
+	var store storage.SchemaStore = fileStore
+	if cfg.Storage.Keyring != "" {
+		store, err = storage.NewEncryptedStore(store, cfg.Storage.Keyring)
+		if err != nil {
+			fatal("failed to initialize file storage", err)
+		}
+	}
+	if cfg.Storage.Compression != "" {
+		compressedStore, err := storage.NewCompressedStore(store, cfg.Storage.Compression)
+		if err != nil {
+			fatal("failed to initialize file storage", err)
+		}
+		compressedStore.MaxSize = cfg.Limits.MaxUploadSize
+		store = compressedStore
+	}
+
+	// Clean up the writes interrupted by a previous crash
+	if cleaner, ok := fileStore.(interface{ RemoveTempFiles() (int, error) }); ok {
+		removed, err := cleaner.RemoveTempFiles()
+		if err != nil {
+			fatal("failed to clean up file storage", err)
+		}
+		if removed > 0 {
+			logger.Info("removed leftover temp files from file storage", "count", removed)
+		}
+	}
+
+	if command == "fsck" {
+		code := fsck(logger, database, store, flag.Args()[1:])
+		database.DB.Close()
+		os.Exit(code)
+	}
 
 	// Create the API handler
-	apiHandler := controller.NewAPIHandler(fileStore, database)
+	apiHandler := controller.NewAPIHandler(store, database)
+	apiHandler.MaxUploadSize = cfg.Limits.MaxUploadSize
+	apiHandler.MultipartMemory = cfg.Limits.MultipartMemory
+	apiHandler.Logger = logger
+	apiHandler.AdminToken = cfg.AdminToken
+	if cfg.AdminToken == "" {
+		logger.Info("admin API disabled, set " + config.EnvName("admin-token") + " to enable it")
+	}
+
+	// Metrics of the requests and of the database, served on /metrics
+	registry := metrics.NewRegistry()
+	apiHandler.Metrics = controller.NewMetrics(registry)
+	database.QueryDuration = db.NewQueryDurationHistogram(registry)
+
+	// Resumable uploads, the abandoned ones are removed periodically
+	apiHandler.Uploads, err = storage.NewUploadSessions(cfg.Uploads.Dir, cfg.Uploads.Expiry)
+	if err != nil {
+		fatal("failed to initialize uploads", err)
+	}
+	apiHandler.Uploads.MaxSessions = cfg.Uploads.MaxSessions
+	apiHandler.Uploads.MaxBytes = cfg.Uploads.MaxBytes
+	removed, err := apiHandler.Uploads.RemoveTempFiles()
+	if err != nil {
+		fatal("failed to clean up uploads", err)
+	}
+	if removed > 0 {
+		logger.Info("removed leftover temp files from uploads", "count", removed)
+	}
+	go removeExpiredUploads(logger, apiHandler.Uploads)
 
 	// Register API routes
 	router := api.RegisterRoutes(apiHandler)
 
-	log.Println("Server listening on port 8080...")
-	log.Fatal(http.ListenAndServe(":8080", router))
+	server := &http.Server{Addr: cfg.ListenAddress, Handler: router}
+	serverErr := make(chan error, 1)
+	go func() {
+		logger.Info("server listening", "address", cfg.ListenAddress)
+		serverErr <- server.ListenAndServe()
+	}()
+
+	// On SIGINT or SIGTERM, stop accepting connections and wait for the requests in flight, such as
+	// uploads, before closing the database
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	select {
+	case err := <-serverErr:
+		fatal("server failed", err)
+	case sig := <-signals:
+		logger.Info("shutting down", "signal", sig)
+	}
+
+	// Keep serving while the load balancers see the readiness API failing and stop routing new
+	// requests here, a second signal skips the wait
+	apiHandler.StartShutdown()
+	if cfg.ShutdownDelay > 0 {
+		logger.Info("draining before shutdown", "delay", cfg.ShutdownDelay)
+		select {
+		case <-time.After(cfg.ShutdownDelay):
+		case <-signals:
+		}
+	}
+	signal.Stop(signals)
+
+	ctx, cancel := context.WithTimeout(context.Background(), cfg.ShutdownTimeout)
+	defer cancel()
+	err = server.Shutdown(ctx)
+	if err != nil {
+		logger.Warn("requests still in flight, closing their connections", "timeout", cfg.ShutdownTimeout, "error", err)
+		server.Close()
+	}
+	logger.Info("server stopped")
+}
+
+// removeExpiredUploads removes the expired upload sessions now and then every half of their expiry
+func removeExpiredUploads(logger *logging.Logger, uploads *storage.UploadSessions) {
+	ticker := time.NewTicker(uploads.TTL / 2)
+	defer ticker.Stop()
+
+	for {
+		removed, err := uploads.RemoveExpired(time.Now())
+		if err != nil {
+			logger.Error("failed to remove expired uploads", "error", err)
+		} else if removed > 0 {
+			logger.Info("removed expired uploads", "count", removed)
+		}
+		<-ticker.C
+	}
+}
+
+// fsck runs the consistency check of the database and the storage, with -normalize-names moves the
+// schemas saved under legacy names and with -rebuild recreates the missing database records. It
+// prints the report and returns the exit code, 1 if inconsistencies remain.
+func fsck(logger *logging.Logger, database db.Repository, store storage.SchemaStore, args []string) int {
+	fsckFlags := flag.NewFlagSet("fsck", flag.ExitOnError)
+	rebuild := fsckFlags.Bool("rebuild", false, "create the missing database records from the file storage")
+	normalizeNames := fsckFlags.Bool("normalize-names", false, "move the schemas saved under names that are not normalized, such as 'Dummy.json', to their normalized name")
+	fsckFlags.Parse(args)
+
+	ctx := context.Background()
+	var report service.ConsistencyReport
+	var err error
+	switch {
+	case *normalizeNames:
+		// The orphaned files of the legacy names can only get a record once they are renamed
+		report, err = service.NormalizeNames(ctx, database, store)
+		if err == nil && *rebuild {
+			renamed := report.Renamed
+			report, err = service.RebuildMetadata(ctx, database, store)
+			report.Renamed = renamed
+		}
+	case *rebuild:
+		report, err = service.RebuildMetadata(ctx, database, store)
+	default:
+		report, err = service.CheckConsistency(ctx, database, store)
+	}
+	if err != nil {
+		logger.Error("failed to check consistency", "error", err)
+		return 1
+	}
+
+	reportBytes, err := json.MarshalIndent(report, "", "  ")
+	if err != nil {
+		logger.Error("failed to marshal report", "error", err)
+		return 1
+	}
+	fmt.Println(string(reportBytes))
+
+	if !report.Consistent {
+		return 1
+	}
+	return 0
 }
@@ -0,0 +1,321 @@
+// Package metrics keeps counters and histograms and exposes them in the Prometheus text format, so
+// the server can be scraped like the other services:
+//
+//	# HELP levo_http_requests_total Requests handled, by route, method and status code.
+//	# TYPE levo_http_requests_total counter
+//	levo_http_requests_total{route="/upload/schema",method="POST",code="200"} 12
+//
+// A metric has a fixed list of label names and a series for each combination of label values it
+// was updated with. A nil *Counter or *Histogram ignores the updates, so instrumented code doesn't
+// need to check whether metrics are enabled.
+package metrics
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// ContentType is the content type of the Prometheus text format
+const ContentType = "text/plain; version=0.0.4; charset=utf-8"
+
+// Buckets of the histograms, the upper bounds of the observed values
+var (
+	// LatencyBuckets are suited to request and query durations in seconds
+	LatencyBuckets = []float64{0.001, 0.0025, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+	// SizeBuckets are suited to file sizes in bytes, from 1 KiB to 64 MiB
+	SizeBuckets = []float64{1 << 10, 4 << 10, 16 << 10, 64 << 10, 256 << 10, 1 << 20, 4 << 20, 16 << 20, 64 << 20}
+)
+
+// metric is a counter or a histogram of a registry
+type metric interface {
+	write(w *bufio.Writer)
+}
+
+// Registry keeps the metrics exposed by the server
+type Registry struct {
+	mu      sync.Mutex
+	names   map[string]bool
+	metrics []metric
+}
+
+// NewRegistry creates an empty registry
+func NewRegistry() *Registry {
+	return &Registry{names: make(map[string]bool)}
+}
+
+// register adds a metric, the names are checked when the server starts so a duplicate is a programming error
+func (r *Registry) register(name string, m metric) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.names[name] {
+		panic(fmt.Sprintf("metric '%s' is already registered", name))
+	}
+	r.names[name] = true
+	r.metrics = append(r.metrics, m)
+}
+
+// NewCounter registers a counter with the given label names
+func (r *Registry) NewCounter(name string, help string, labelNames ...string) *Counter {
+	c := &Counter{desc: desc{name: name, help: help, labelNames: labelNames}, series: make(map[string]*counterSeries)}
+	r.register(name, c)
+	return c
+}
+
+// NewHistogram registers a histogram with the given upper bounds of its buckets, in increasing
+// order, and label names
+func (r *Registry) NewHistogram(name string, help string, buckets []float64, labelNames ...string) *Histogram {
+	if !sort.Float64sAreSorted(buckets) {
+		panic(fmt.Sprintf("buckets of metric '%s' are not in increasing order", name))
+	}
+	h := &Histogram{desc: desc{name: name, help: help, labelNames: labelNames}, buckets: buckets, series: make(map[string]*histogramSeries)}
+	r.register(name, h)
+	return h
+}
+
+// WriteText writes all the metrics in the Prometheus text format, in the order they were
+// registered and with their series sorted by label values
+func (r *Registry) WriteText(w io.Writer) error {
+	r.mu.Lock()
+	metrics := append([]metric(nil), r.metrics...)
+	r.mu.Unlock()
+
+	buf := bufio.NewWriter(w)
+	for _, m := range metrics {
+		m.write(buf)
+	}
+	return buf.Flush()
+}
+
+// ServeHTTP serves the metrics to a Prometheus scraper
+func (r *Registry) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", ContentType)
+	r.WriteText(w)
+}
+
+// desc describes a metric
+type desc struct {
+	name       string
+	help       string
+	labelNames []string
+}
+
+// key returns the key of the series of the label values, checking their number
+func (d *desc) key(labelValues []string) string {
+	if len(labelValues) != len(d.labelNames) {
+		panic(fmt.Sprintf("metric '%s' has %d labels but got %d values", d.name, len(d.labelNames), len(labelValues)))
+	}
+	return strings.Join(labelValues, "\xff")
+}
+
+// writeHeader writes the HELP and TYPE lines of the metric
+func (d *desc) writeHeader(w *bufio.Writer, metricType string) {
+	help := strings.NewReplacer(`\`, `\\`, "\n", `\n`).Replace(d.help)
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", d.name, help, d.name, metricType)
+}
+
+// writeSample writes a sample line, extra is an additional label such as the "le" of a bucket
+func (d *desc) writeSample(w *bufio.Writer, suffix string, labelValues []string, extraName string, extraValue string, value float64) {
+	w.WriteString(d.name)
+	w.WriteString(suffix)
+
+	names := d.labelNames
+	values := labelValues
+	if extraName != "" {
+		names = append(append([]string(nil), names...), extraName)
+		values = append(append([]string(nil), values...), extraValue)
+	}
+	if len(names) > 0 {
+		w.WriteByte('{')
+		for i, name := range names {
+			if i > 0 {
+				w.WriteByte(',')
+			}
+			w.WriteString(name)
+			w.WriteString(`="`)
+			w.WriteString(labelValueReplacer.Replace(values[i]))
+			w.WriteByte('"')
+		}
+		w.WriteByte('}')
+	}
+
+	w.WriteByte(' ')
+	w.WriteString(formatFloat(value))
+	w.WriteByte('\n')
+}
+
+// labelValueReplacer escapes the label values of the text format
+var labelValueReplacer = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// formatFloat formats a sample value or a bucket bound
+func formatFloat(value float64) string {
+	switch {
+	case math.IsInf(value, 1):
+		return "+Inf"
+	case math.IsInf(value, -1):
+		return "-Inf"
+	case math.IsNaN(value):
+		return "NaN"
+	default:
+		return strconv.FormatFloat(value, 'g', -1, 64)
+	}
+}
+
+// Counter is a value that only goes up, such as a number of requests
+type Counter struct {
+	desc
+
+	mu     sync.Mutex
+	series map[string]*counterSeries
+}
+
+// counterSeries is the value of a counter for a combination of label values
+type counterSeries struct {
+	labelValues []string
+	value       float64
+}
+
+// Inc adds 1 to the series of the label values
+func (c *Counter) Inc(labelValues ...string) {
+	c.Add(1, labelValues...)
+}
+
+// Add adds a positive value to the series of the label values
+func (c *Counter) Add(value float64, labelValues ...string) {
+	if c == nil {
+		return
+	}
+	if value < 0 {
+		panic(fmt.Sprintf("counter '%s' can't decrease", c.name))
+	}
+
+	key := c.key(labelValues)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	s, ok := c.series[key]
+	if !ok {
+		s = &counterSeries{labelValues: append([]string(nil), labelValues...)}
+		c.series[key] = s
+	}
+	s.value += value
+}
+
+// Value returns the value of the series of the label values, 0 if it was never updated
+func (c *Counter) Value(labelValues ...string) float64 {
+	if c == nil {
+		return 0
+	}
+
+	key := c.key(labelValues)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if s, ok := c.series[key]; ok {
+		return s.value
+	}
+	return 0
+}
+
+func (c *Counter) write(w *bufio.Writer) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.writeHeader(w, "counter")
+	keys := make([]string, 0, len(c.series))
+	for key := range c.series {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		s := c.series[key]
+		c.writeSample(w, "", s.labelValues, "", "", s.value)
+	}
+}
+
+// Histogram counts observed values, such as durations or sizes, in buckets
+type Histogram struct {
+	desc
+	buckets []float64
+
+	mu     sync.Mutex
+	series map[string]*histogramSeries
+}
+
+// histogramSeries is the distribution of the values observed for a combination of label values
+type histogramSeries struct {
+	labelValues []string
+	// counts are the numbers of values in each bucket, not cumulated
+	counts []uint64
+	count  uint64
+	sum    float64
+}
+
+// Observe adds a value to the series of the label values
+func (h *Histogram) Observe(value float64, labelValues ...string) {
+	if h == nil {
+		return
+	}
+
+	key := h.key(labelValues)
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	s, ok := h.series[key]
+	if !ok {
+		s = &histogramSeries{labelValues: append([]string(nil), labelValues...), counts: make([]uint64, len(h.buckets))}
+		h.series[key] = s
+	}
+	// The values above the last bound are only in the +Inf bucket, which is the count
+	if i := sort.SearchFloat64s(h.buckets, value); i < len(h.buckets) {
+		s.counts[i]++
+	}
+	s.count++
+	s.sum += value
+}
+
+// Count returns the number of values observed in the series of the label values
+func (h *Histogram) Count(labelValues ...string) uint64 {
+	if h == nil {
+		return 0
+	}
+
+	key := h.key(labelValues)
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if s, ok := h.series[key]; ok {
+		return s.count
+	}
+	return 0
+}
+
+func (h *Histogram) write(w *bufio.Writer) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.writeHeader(w, "histogram")
+	keys := make([]string, 0, len(h.series))
+	for key := range h.series {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		s := h.series[key]
+		var cumulative uint64
+		for i, bound := range h.buckets {
+			cumulative += s.counts[i]
+			h.writeSample(w, "_bucket", s.labelValues, "le", formatFloat(bound), float64(cumulative))
+		}
+		h.writeSample(w, "_bucket", s.labelValues, "le", "+Inf", float64(s.count))
+		h.writeSample(w, "_sum", s.labelValues, "", "", s.sum)
+		h.writeSample(w, "_count", s.labelValues, "", "", float64(s.count))
+	}
+}
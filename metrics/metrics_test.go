@@ -0,0 +1,87 @@
+package metrics
+
+import (
+	"bytes"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestRegistryWriteText(t *testing.T) {
+	registry := NewRegistry()
+	requests := registry.NewCounter("test_requests_total", "Requests handled.", "route", "code")
+	duration := registry.NewHistogram("test_duration_seconds", "Time taken,\nin seconds.", []float64{0.1, 1}, "route")
+	registry.NewCounter("test_unused_total", "Never updated.")
+
+	requests.Inc("/b", "200")
+	requests.Add(2, "/a", "404")
+	requests.Inc("/b", "200")
+	requests.Inc(`/q"\`, "500")
+	duration.Observe(0.05, "/a")
+	duration.Observe(0.1, "/a")
+	duration.Observe(0.5, "/a")
+	duration.Observe(3, "/a")
+
+	var buf bytes.Buffer
+	if err := registry.WriteText(&buf); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := `# HELP test_requests_total Requests handled.
+# TYPE test_requests_total counter
+test_requests_total{route="/a",code="404"} 2
+test_requests_total{route="/b",code="200"} 2
+test_requests_total{route="/q\"\\",code="500"} 1
+# HELP test_duration_seconds Time taken,\nin seconds.
+# TYPE test_duration_seconds histogram
+test_duration_seconds_bucket{route="/a",le="0.1"} 2
+test_duration_seconds_bucket{route="/a",le="1"} 3
+test_duration_seconds_bucket{route="/a",le="+Inf"} 4
+test_duration_seconds_sum{route="/a"} 3.65
+test_duration_seconds_count{route="/a"} 4
+# HELP test_unused_total Never updated.
+# TYPE test_unused_total counter
+`
+	if buf.String() != expected {
+		t.Errorf("expected\n%s\nbut got\n%s", expected, buf.String())
+	}
+
+	if requests.Value("/b", "200") != 2 || duration.Count("/a") != 4 || duration.Count("/b") != 0 {
+		t.Error("expected the values of the series to be readable")
+	}
+}
+
+func TestRegistryServeHTTP(t *testing.T) {
+	registry := NewRegistry()
+	registry.NewCounter("test_total", "Test.").Inc()
+
+	rr := httptest.NewRecorder()
+	registry.ServeHTTP(rr, httptest.NewRequest("GET", "/metrics", nil))
+	if rr.Header().Get("Content-Type") != ContentType {
+		t.Errorf("expected the Prometheus content type but got '%s'", rr.Header().Get("Content-Type"))
+	}
+	if !bytes.Contains(rr.Body.Bytes(), []byte("\ntest_total 1\n")) {
+		t.Errorf("expected the counter in the body '%s'", rr.Body.String())
+	}
+}
+
+func TestNilMetrics(t *testing.T) {
+	var counter *Counter
+	var histogram *Histogram
+	counter.Inc("ignored")
+	histogram.Observe(1, "ignored")
+	if counter.Value("ignored") != 0 || histogram.Count("ignored") != 0 {
+		t.Error("expected nil metrics to ignore the updates")
+	}
+}
+
+func TestRegistryDuplicate(t *testing.T) {
+	registry := NewRegistry()
+	registry.NewCounter("test_total", "Test.")
+
+	defer func() {
+		if recover() == nil {
+			t.Error("expected registering a metric twice to panic")
+		}
+	}()
+	registry.NewHistogram("test_total", "Test.", LatencyBuckets)
+}
@@ -0,0 +1,78 @@
+// Package schemaname validates and normalizes the names schemas are stored under. Names become
+// directory names, object keys, git refs and URL path segments, so they are restricted to a
+// portable character set and compared case-insensitively.
+package schemaname
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// MaxLength is the maximum length of a schema name in bytes
+const MaxLength = 128
+
+// ErrInvalidName is returned for names that can't be used as a schema name
+var ErrInvalidName = errors.New("invalid schema name")
+
+// reservedNames can't be used as a schema name, with or without an extension: the device names of
+// Windows, and names that have a meaning in the storage layouts and the API routes
+var reservedNames = map[string]bool{
+	"con": true, "prn": true, "aux": true, "nul": true,
+	"com1": true, "com2": true, "com3": true, "com4": true, "com5": true, "com6": true, "com7": true, "com8": true, "com9": true,
+	"lpt1": true, "lpt2": true, "lpt3": true, "lpt4": true, "lpt5": true, "lpt6": true, "lpt7": true, "lpt8": true, "lpt9": true,
+	"blobs": true, "refs": true, "by-digest": true,
+}
+
+// Normalize returns the canonical form of a schema name, which is lower case, or an error
+// wrapping ErrInvalidName. A valid name is 1 to MaxLength bytes of ASCII letters, digits, ".", "-"
+// and "_", starts with a letter or a digit, doesn't end with "." or ".lock" and is not reserved.
+func Normalize(name string) (string, error) {
+	if name == "" {
+		return "", fmt.Errorf("%w: the name is empty", ErrInvalidName)
+	}
+	if len(name) > MaxLength {
+		return "", fmt.Errorf("%w: '%.32s...' is longer than %d bytes", ErrInvalidName, name, MaxLength)
+	}
+
+	for i := 0; i < len(name); i++ {
+		c := name[i]
+		if ('a' <= c && c <= 'z') || ('A' <= c && c <= 'Z') || ('0' <= c && c <= '9') {
+			continue
+		}
+		if i > 0 && (c == '.' || c == '-' || c == '_') {
+			continue
+		}
+		if i == 0 && (c == '.' || c == '-' || c == '_') {
+			return "", fmt.Errorf("%w: '%s' must start with a letter or a digit", ErrInvalidName, name)
+		}
+		return "", fmt.Errorf("%w: '%s' contains %q, only letters, digits, '.', '-' and '_' are allowed", ErrInvalidName, name, c)
+	}
+
+	normalized := strings.ToLower(name)
+	if strings.HasSuffix(normalized, ".") || strings.HasSuffix(normalized, ".lock") {
+		return "", fmt.Errorf("%w: '%s' can't end with '.' or '.lock'", ErrInvalidName, name)
+	}
+	base := normalized
+	if dot := strings.Index(base, "."); dot >= 0 {
+		base = base[:dot]
+	}
+	if reservedNames[base] {
+		return "", fmt.Errorf("%w: '%s' is reserved", ErrInvalidName, name)
+	}
+
+	return normalized, nil
+}
+
+// Validate checks that the name is valid and already normalized, as the names stored by the registry are
+func Validate(name string) error {
+	normalized, err := Normalize(name)
+	if err != nil {
+		return err
+	}
+	if normalized != name {
+		return fmt.Errorf("%w: '%s' is not normalized, expected '%s'", ErrInvalidName, name, normalized)
+	}
+
+	return nil
+}
@@ -0,0 +1,74 @@
+package schemaname
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestNormalize(t *testing.T) {
+	for name, expected := range map[string]string{
+		"openapi.json":                 "openapi.json",
+		"OpenAPI.JSON":                 "openapi.json",
+		"payments-v2_api.yml":          "payments-v2_api.yml",
+		"1.yaml":                       "1.yaml",
+		"a..b.json":                    "a..b.json",
+		"console.json":                 "console.json",
+		strings.Repeat("a", MaxLength): strings.Repeat("a", MaxLength),
+	} {
+		normalized, err := Normalize(name)
+		if err != nil {
+			t.Errorf("expected '%s' to be valid: %v", name, err)
+			continue
+		}
+		if normalized != expected {
+			t.Errorf("expected '%s' to be normalized to '%s' but got '%s'", name, expected, normalized)
+		}
+	}
+}
+
+func TestNormalizeMaliciousNames(t *testing.T) {
+	for _, name := range []string{
+		"",
+		".",
+		"..",
+		"../etc/passwd",
+		"..\\..\\windows\\win.ini",
+		"/etc/passwd",
+		"schemas/../../secret.json",
+		"api.json/..",
+		"C:\\api.json",
+		".hidden.json",
+		".tmp-1.json-123",
+		"-rf.json",
+		"api.json\x00.png",
+		"api json",
+		"api\n.json",
+		"%2e%2e%2fsecret.json",
+		"api.json.",
+		"main.lock",
+		"refs",
+		"blobs",
+		"by-digest",
+		"CON",
+		"nul.json",
+		"Com1.yaml",
+		"ｏｐｅｎａｐｉ.json",
+		"ope\u200bnapi.json",
+		strings.Repeat("a", MaxLength+1),
+	} {
+		_, err := Normalize(name)
+		if !errors.Is(err, ErrInvalidName) {
+			t.Errorf("expected %q to be rejected with ErrInvalidName but got %v", name, err)
+		}
+	}
+}
+
+func TestValidate(t *testing.T) {
+	if err := Validate("openapi.json"); err != nil {
+		t.Errorf("expected a normalized name to be valid: %v", err)
+	}
+	if err := Validate("OpenAPI.json"); !errors.Is(err, ErrInvalidName) {
+		t.Errorf("expected a name that is not normalized to be rejected but got %v", err)
+	}
+}
@@ -0,0 +1,92 @@
+package service
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	yaml "gopkg.in/yaml.v2"
+)
+
+// CanonicalDigest returns the hex encoded SHA-256 digest of the canonical form of the schema file.
+// The canonical form is the parsed document re-encoded as compact JSON with sorted keys, so files
+// that only differ in formatting, key order or comments have the same digest.
+func CanonicalDigest(schemaFile []byte, fileType string) (string, error) {
+	var data interface{}
+	switch fileType {
+	case "json":
+		decoder := json.NewDecoder(bytes.NewReader(schemaFile))
+		// Keep numbers as written, a float64 round trip would merge distinct large integers
+		decoder.UseNumber()
+		err := decoder.Decode(&data)
+		if err != nil {
+			return "", fmt.Errorf("%w: %v", ErrInvalidJSON, err)
+		}
+	case "yaml":
+		err := yaml.Unmarshal(schemaFile, &data)
+		if err != nil {
+			return "", fmt.Errorf("%w: %v", ErrInvalidYAML, err)
+		}
+	default:
+		return "", fmt.Errorf("unsupported file type: %s", fileType)
+	}
+
+	canonical, err := json.Marshal(canonicalKeys(data))
+	if err != nil {
+		return "", fmt.Errorf("failed to encode canonical schema: %v", err)
+	}
+
+	return Checksum(canonical), nil
+}
+
+// canonicalKeys rewrites the keys of the mappings of a decoded document in the canonical form.
+// The map[interface{}]interface{} values produced by the YAML decoder become map[string]interface{},
+// which encoding/json can marshal with sorted keys, like the maps produced by the JSON decoder.
+func canonicalKeys(value interface{}) interface{} {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		m := make(map[string]interface{}, len(v))
+		for key, item := range v {
+			m[canonicalKey(key)] = canonicalKeys(item)
+		}
+		return m
+	case map[interface{}]interface{}:
+		m := make(map[string]interface{}, len(v))
+		for key, item := range v {
+			m[canonicalKey(key)] = canonicalKeys(item)
+		}
+		return m
+	case []interface{}:
+		for i, item := range v {
+			v[i] = canonicalKeys(item)
+		}
+		return v
+	default:
+		return v
+	}
+}
+
+// canonicalKey returns the key of a mapping in the canonical form, the same for JSON and YAML.
+// Non-string keys are prefixed with their tag, e.g. "!!int 200", so that 1 and "1" or true and
+// "true" can't be taken for the same key. String keys are kept, unless they start with "!": those
+// are prefixed with "!!str ", so a string key never starts with the tag of another type.
+func canonicalKey(key interface{}) string {
+	switch k := key.(type) {
+	case string:
+		if strings.HasPrefix(k, "!") {
+			return "!!str " + k
+		}
+		return k
+	case int, int64, uint64:
+		return fmt.Sprintf("!!int %v", k)
+	case float64:
+		return fmt.Sprintf("!!float %v", k)
+	case bool:
+		return fmt.Sprintf("!!bool %v", k)
+	case nil:
+		return "!!null"
+	default:
+		return fmt.Sprintf("!!%T %v", k, k)
+	}
+}
@@ -0,0 +1,53 @@
+package service
+
+import "testing"
+
+func TestCanonicalDigest(t *testing.T) {
+	digest := func(schemaFile string, fileType string) string {
+		t.Helper()
+		d, err := CanonicalDigest([]byte(schemaFile), fileType)
+		if err != nil {
+			t.Fatalf("failed to compute digest of '%s': %v", schemaFile, err)
+		}
+		return d
+	}
+
+	base := digest(`{"openapi": "3.0.1", "info": {"title": "test", "version": 1}}`, "json")
+
+	for _, equivalent := range []struct{ schemaFile, fileType string }{
+		{"{\n  \"info\": {\"version\": 1, \"title\": \"test\"},\n  \"openapi\": \"3.0.1\"\n}\n", "json"},
+		{"# comment\nopenapi: 3.0.1\ninfo:\n  title: test\n  version: 1\n", "yaml"},
+	} {
+		if d := digest(equivalent.schemaFile, equivalent.fileType); d != base {
+			t.Errorf("expected '%s' to have the canonical digest of the base document", equivalent.schemaFile)
+		}
+	}
+
+	if d := digest(`{"openapi": "3.0.1", "info": {"title": "test", "version": 2}}`, "json"); d == base {
+		t.Error("expected a changed document to have a different digest")
+	}
+
+	// Keys of different types are different keys, even when they are written the same
+	for _, distinct := range [][]string{
+		{"responses:\n  200: ok\n", "responses:\n  \"200\": ok\n"},
+		{"flags:\n  true: on\n", "flags:\n  \"true\": on\n"},
+		{"flags:\n  1: a\n  \"1\": b\n", "flags:\n  1: b\n  \"1\": a\n"},
+		{"keys:\n  200: ok\n", "keys:\n  \"!!int 200\": ok\n"},
+	} {
+		if digest(distinct[0], "yaml") == digest(distinct[1], "yaml") {
+			t.Errorf("expected '%s' and '%s' to have different digests", distinct[0], distinct[1])
+		}
+	}
+	for _, same := range [][]string{
+		{"responses:\n  \"200\": ok\n", `{"responses": {"200": "ok"}}`},
+		{"keys:\n  \"!x\": 1\n", `{"keys": {"!x": 1}}`},
+		{"keys:\n  \"!!int 200\": ok\n", `{"keys": {"!!int 200": "ok"}}`},
+	} {
+		if digest(same[0], "yaml") != digest(same[1], "json") {
+			t.Errorf("expected the string keys of '%s' to match the keys of the JSON document '%s'", same[0], same[1])
+		}
+	}
+	if digest("keys:\n  200: ok\n", "yaml") == digest(`{"keys": {"!!int 200": "ok"}}`, "json") {
+		t.Error("expected a JSON string key to never match a YAML key of another type")
+	}
+}
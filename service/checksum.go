@@ -0,0 +1,37 @@
+package service
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+)
+
+// Checksum returns the hex encoded SHA-256 digest of the schema file
+func Checksum(schemaFile []byte) string {
+	sum := sha256.Sum256(schemaFile)
+	return hex.EncodeToString(sum[:])
+}
+
+// VerifyChecksum checks the schema file against the checksum recorded at upload, an empty
+// checksum (versions uploaded before checksums were recorded) is not verified
+func VerifyChecksum(schemaFile []byte, checksum string) error {
+	if checksum == "" {
+		return nil
+	}
+	if actual := Checksum(schemaFile); actual != checksum {
+		return fmt.Errorf("checksum mismatch: expected sha256 %s but the stored file has %s", checksum, actual)
+	}
+
+	return nil
+}
+
+// DigestHeader formats the checksum as the value of an HTTP Digest header (RFC 3230)
+func DigestHeader(checksum string) (string, error) {
+	sum, err := hex.DecodeString(checksum)
+	if err != nil {
+		return "", fmt.Errorf("invalid checksum: %v", err)
+	}
+
+	return "sha-256=" + base64.StdEncoding.EncodeToString(sum), nil
+}
@@ -0,0 +1,109 @@
+package service
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"mime"
+	"strings"
+
+	yaml "gopkg.in/yaml.v2"
+)
+
+// Formats of the schema files
+const (
+	FormatJSON = "json"
+	FormatYAML = "yaml"
+)
+
+// Errors of the schema files that are not valid JSON or YAML documents, wrapped with the details
+var (
+	// ErrEmptySchema is returned for a schema file without content
+	ErrEmptySchema = errors.New("the schema file is empty")
+	// ErrInvalidJSON is returned for a schema file that fails to parse as JSON
+	ErrInvalidJSON = errors.New("failed to parse JSON schema")
+	// ErrInvalidYAML is returned for a schema file that fails to parse as YAML
+	ErrInvalidYAML = errors.New("failed to parse YAML schema")
+	// ErrNotADocument is returned for a schema file that parses as a plain value, such as text
+	ErrNotADocument = errors.New("the schema file is neither a JSON nor a YAML document")
+)
+
+// DetectFormat returns the format of a schema file, FormatJSON or FormatYAML. A JSON or YAML
+// Content-Type is trusted if the file parses in that format, otherwise the format is detected from
+// the content: a file that is a valid JSON document is JSON, and a file that is a YAML mapping or
+// sequence is YAML. The file name is never used, so ".yml" or extension-less files are accepted.
+func DetectFormat(schemaFile []byte, contentType string) (string, error) {
+	switch declaredFormat(contentType) {
+	case FormatJSON:
+		if err := ValidateJSONSchema(schemaFile); err != nil {
+			return "", err
+		}
+		return FormatJSON, nil
+	case FormatYAML:
+		if err := validateYAMLDocument(schemaFile); err != nil {
+			return "", err
+		}
+		return FormatYAML, nil
+	}
+
+	content := bytes.TrimSpace(schemaFile)
+	if len(content) == 0 {
+		return "", ErrEmptySchema
+	}
+
+	// JSON is a subset of YAML, check for it first so JSON files keep their format
+	var jsonErr error
+	if content[0] == '{' || content[0] == '[' {
+		var data interface{}
+		jsonErr = json.Unmarshal(content, &data)
+		if jsonErr == nil {
+			return FormatJSON, nil
+		}
+	}
+
+	err := validateYAMLDocument(content)
+	if err != nil {
+		if jsonErr != nil {
+			return "", fmt.Errorf("%w: %v", ErrInvalidJSON, jsonErr)
+		}
+		return "", err
+	}
+
+	return FormatYAML, nil
+}
+
+// validateYAMLDocument checks that the file is a YAML mapping or sequence, plain text parses as a YAML string
+func validateYAMLDocument(schemaFile []byte) error {
+	var data interface{}
+	err := yaml.Unmarshal(schemaFile, &data)
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrInvalidYAML, err)
+	}
+
+	switch data.(type) {
+	case map[interface{}]interface{}, []interface{}:
+		return nil
+	default:
+		return ErrNotADocument
+	}
+}
+
+// declaredFormat returns the format named by a Content-Type, or an empty string for generic types
+// such as "application/octet-stream" or "text/plain"
+func declaredFormat(contentType string) string {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return ""
+	}
+
+	switch {
+	case mediaType == "application/json" || mediaType == "text/json" || strings.HasSuffix(mediaType, "+json"):
+		return FormatJSON
+	case mediaType == "application/yaml" || mediaType == "application/x-yaml" || mediaType == "text/yaml" ||
+		mediaType == "text/x-yaml" || strings.HasSuffix(mediaType, "+yaml"):
+		return FormatYAML
+	default:
+		return ""
+	}
+}
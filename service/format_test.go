@@ -0,0 +1,48 @@
+package service
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestDetectFormat(t *testing.T) {
+	for _, test := range []struct {
+		schemaFile, contentType, format string
+	}{
+		{`{"openapi": "3.0.1"}`, "", FormatJSON},
+		{"\n  [1, 2]\n", "application/octet-stream", FormatJSON},
+		{"openapi: 3.0.1\ninfo:\n  title: test\n", "", FormatYAML},
+		{"- one\n- two\n", "text/plain; charset=utf-8", FormatYAML},
+		{"{openapi: 3.0.1}", "", FormatYAML},
+		{`{"openapi": "3.0.1"}`, "application/x-yaml", FormatYAML},
+		{`{"openapi": "3.0.1"}`, "application/vnd.oai.openapi+json;version=3.0", FormatJSON},
+	} {
+		format, err := DetectFormat([]byte(test.schemaFile), test.contentType)
+		if err != nil {
+			t.Errorf("failed to detect the format of '%s' (%s): %v", test.schemaFile, test.contentType, err)
+			continue
+		}
+		if format != test.format {
+			t.Errorf("expected '%s' (%s) to be %s but got %s", test.schemaFile, test.contentType, test.format, format)
+		}
+	}
+
+	for _, test := range []struct {
+		schemaFile, contentType string
+		expected                error
+	}{
+		{"", "", ErrEmptySchema},
+		{"just some notes", "", ErrNotADocument},
+		{`{"openapi": `, "", ErrInvalidJSON},
+		{"openapi: [3.0.1", "", ErrInvalidYAML},
+		{"openapi: 3.0.1", "application/json", ErrInvalidJSON},
+		{"plain text", "text/yaml", ErrNotADocument},
+	} {
+		format, err := DetectFormat([]byte(test.schemaFile), test.contentType)
+		if err == nil {
+			t.Errorf("expected '%s' (%s) to be rejected but it was detected as %s", test.schemaFile, test.contentType, format)
+		} else if !errors.Is(err, test.expected) {
+			t.Errorf("expected '%s' (%s) to be rejected with '%v' but got '%v'", test.schemaFile, test.contentType, test.expected, err)
+		}
+	}
+}
@@ -0,0 +1,348 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+
+	"example.com/levo_app/db"
+	"example.com/levo_app/schemaname"
+	"example.com/levo_app/storage"
+)
+
+// SchemaVersion identifies one version of a schema file
+type SchemaVersion struct {
+	Filename string `json:"filename"`
+	Version  int64  `json:"version"`
+}
+
+// LegacyName is a schema recorded or stored under a name accepted before names were normalized,
+// such as "Dummy.json", which the API can't reach until NormalizeNames renames it
+type LegacyName struct {
+	Name       string `json:"name"`
+	Normalized string `json:"normalized"`
+	// Collision is set when the versions can't be moved because the normalized name has other
+	// versions, or is the normalized name of another legacy name. They have to be merged by hand.
+	Collision bool `json:"collision,omitempty"`
+}
+
+// ConsistencyReport lists the differences between the metadata database and the schema storage
+type ConsistencyReport struct {
+	// Consistent is true when the database and the storage agree
+	Consistent bool `json:"consistent"`
+	// OrphanedFiles are stored versions without a metadata record
+	OrphanedFiles []SchemaVersion `json:"orphaned_files"`
+	// MissingFiles are metadata records whose version is not in the storage
+	MissingFiles []SchemaVersion `json:"missing_files"`
+	// ChecksumMismatches are stored versions whose content doesn't match the checksum of their record
+	ChecksumMismatches []SchemaVersion `json:"checksum_mismatches"`
+	// LegacyNames are the schemas that are not under their normalized name
+	LegacyNames []LegacyName `json:"legacy_names"`
+	// Rebuilt are the orphaned files a metadata record was created for by RebuildMetadata
+	Rebuilt []SchemaVersion `json:"rebuilt,omitempty"`
+	// Renamed are the legacy names moved to their normalized name by NormalizeNames
+	Renamed []LegacyName `json:"renamed,omitempty"`
+}
+
+// CheckConsistency compares every metadata record with the versions in the storage, the versions
+// under legacy names included
+func CheckConsistency(ctx context.Context, repo db.Repository, store storage.SchemaStore) (ConsistencyReport, error) {
+	report := ConsistencyReport{
+		OrphanedFiles:      []SchemaVersion{},
+		MissingFiles:       []SchemaVersion{},
+		ChecksumMismatches: []SchemaVersion{},
+		LegacyNames:        []LegacyName{},
+	}
+	ctx = storage.WithLegacyNames(ctx)
+
+	schemas, err := repo.ListSchemas(ctx)
+	if err != nil {
+		return report, err
+	}
+	recorded := make(map[SchemaVersion]bool, len(schemas))
+	for _, schema := range schemas {
+		recorded[SchemaVersion{Filename: schema.Filename, Version: schema.Version}] = true
+	}
+
+	stored, err := listStoredVersions(ctx, store)
+	if err != nil {
+		return report, err
+	}
+	storedSet := make(map[SchemaVersion]bool, len(stored))
+	for _, sv := range stored {
+		storedSet[sv] = true
+		if !recorded[sv] {
+			report.OrphanedFiles = append(report.OrphanedFiles, sv)
+		}
+	}
+
+	for _, schema := range schemas {
+		sv := SchemaVersion{Filename: schema.Filename, Version: schema.Version}
+		if !storedSet[sv] {
+			report.MissingFiles = append(report.MissingFiles, sv)
+			continue
+		}
+		if schema.Checksum == "" {
+			continue
+		}
+
+		schemaFile, err := store.GetSchema(ctx, schema.Filename, schema.Version)
+		if err != nil {
+			return report, err
+		}
+		if VerifyChecksum(schemaFile, schema.Checksum) != nil {
+			report.ChecksumMismatches = append(report.ChecksumMismatches, sv)
+		}
+	}
+
+	report.LegacyNames, err = findLegacyNames(ctx, schemas, stored, store)
+	if err != nil {
+		return report, err
+	}
+	report.Consistent = len(report.OrphanedFiles) == 0 && len(report.MissingFiles) == 0 && len(report.ChecksumMismatches) == 0 &&
+		len(report.LegacyNames) == 0
+
+	return report, nil
+}
+
+// RebuildMetadata creates the missing metadata records of the orphaned files in the storage, which
+// recovers the database after it was lost or restored from an older backup. Records whose file is
+// missing or corrupted are left untouched and reported, the files have to be restored instead.
+// The creation time of the original upload is unknown, rebuilt records are timestamped with the
+// time of the rebuild and get the checksum of the file as it is now.
+// Uploads in progress look like orphaned files, so the rebuild should run while uploads are stopped.
+// The orphaned files under legacy names are left for NormalizeNames to move first.
+func RebuildMetadata(ctx context.Context, repo db.Repository, store storage.SchemaStore) (ConsistencyReport, error) {
+	report, err := CheckConsistency(ctx, repo, store)
+	if err != nil {
+		return report, err
+	}
+
+	timestamp := time.Now()
+	orphaned := []SchemaVersion{}
+	for _, sv := range report.OrphanedFiles {
+		if schemaname.Validate(sv.Filename) != nil {
+			orphaned = append(orphaned, sv)
+			continue
+		}
+
+		schemaFile, err := store.GetSchema(ctx, sv.Filename, sv.Version)
+		if err != nil {
+			return report, err
+		}
+
+		// The format is recorded if it can be detected, the file was validated when it was uploaded
+		format, _ := DetectFormat(schemaFile, "")
+		err = repo.SaveSchema(ctx, db.Schema{
+			Version:   sv.Version,
+			Filename:  sv.Filename,
+			Timestamp: timestamp,
+			Checksum:  Checksum(schemaFile),
+			Format:    format,
+		})
+		if err != nil {
+			return report, fmt.Errorf("failed to rebuild '%s' version '%d': %v", sv.Filename, sv.Version, err)
+		}
+		report.Rebuilt = append(report.Rebuilt, sv)
+	}
+	report.OrphanedFiles = orphaned
+	report.Consistent = len(report.OrphanedFiles) == 0 && len(report.MissingFiles) == 0 && len(report.ChecksumMismatches) == 0 &&
+		len(report.LegacyNames) == 0
+
+	return report, nil
+}
+
+// NormalizeNames moves the versions of the legacy names to their normalized name: every stored
+// version is copied to the normalized name and deleted, then the records are renamed. Running it
+// again after an interruption finishes the move. The collisions are left untouched and reported,
+// and like RebuildMetadata it should run while uploads are stopped.
+func NormalizeNames(ctx context.Context, repo db.Repository, store storage.SchemaStore) (ConsistencyReport, error) {
+	report, err := CheckConsistency(ctx, repo, store)
+	if err != nil {
+		return report, err
+	}
+
+	var renamed []LegacyName
+	for _, legacy := range report.LegacyNames {
+		if legacy.Collision {
+			continue
+		}
+		err := renameSchema(storage.WithLegacyNames(ctx), repo, store, legacy)
+		if err != nil {
+			return report, fmt.Errorf("failed to rename '%s' to '%s': %v", legacy.Name, legacy.Normalized, err)
+		}
+		renamed = append(renamed, legacy)
+	}
+
+	// The versions of the renamed schemas are checked again under their new name
+	report, err = CheckConsistency(ctx, repo, store)
+	report.Renamed = renamed
+	return report, err
+}
+
+// renameSchema moves the versions of a legacy name that doesn't collide to its normalized name
+func renameSchema(ctx context.Context, repo db.Repository, store storage.SchemaStore, legacy LegacyName) error {
+	records, err := repo.ListSchemaVersions(ctx, legacy.Name)
+	if err != nil {
+		return err
+	}
+	formats := make(map[int64]string, len(records))
+	for _, record := range records {
+		formats[record.Version] = record.Format
+	}
+	// The normalized name has records when a previous run was interrupted after renaming them,
+	// only the old files are left to delete then
+	latest, err := repo.GetLatestSchemaVersion(ctx, legacy.Normalized)
+	if err != nil {
+		return err
+	}
+	copyFiles := latest == 0
+
+	versions, err := store.ListVersions(ctx, legacy.Name)
+	if err != nil {
+		return err
+	}
+	for _, version := range versions {
+		schemaFile, err := store.GetSchema(ctx, legacy.Name, version)
+		if err != nil {
+			return err
+		}
+		format := formats[version]
+		if format == "" {
+			format, _ = DetectFormat(schemaFile, "")
+		}
+
+		if copyFiles {
+			err = store.SaveSchema(ctx, schemaFile, legacy.Normalized, format, version)
+			if errors.Is(err, storage.ErrVersionExists) {
+				// Copied by an interrupted run, the normalized name has no records yet
+				err = store.DeleteSchema(ctx, legacy.Normalized, version)
+				if err == nil {
+					err = store.SaveSchema(ctx, schemaFile, legacy.Normalized, format, version)
+				}
+			}
+			if err != nil {
+				return err
+			}
+		}
+
+		err = store.DeleteSchema(ctx, legacy.Name, version)
+		if err != nil {
+			return err
+		}
+		// On a case-insensitive file system both names are the same file, which was just deleted
+		exists, err := store.SchemaExists(ctx, legacy.Normalized, version)
+		if err == nil && !exists {
+			err = store.SaveSchema(ctx, schemaFile, legacy.Normalized, format, version)
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	if len(records) > 0 {
+		return repo.RenameSchema(ctx, legacy.Name, legacy.Normalized)
+	}
+	return nil
+}
+
+// findLegacyNames returns the names of the records and of the stored versions that are valid but
+// not normalized, and whether their versions collide with the versions of their normalized name
+func findLegacyNames(ctx context.Context, schemas []db.Schema, stored []SchemaVersion, store storage.SchemaStore) ([]LegacyName, error) {
+	records := make(map[string]map[int64]db.Schema)
+	for _, schema := range schemas {
+		if records[schema.Filename] == nil {
+			records[schema.Filename] = make(map[int64]db.Schema)
+		}
+		records[schema.Filename][schema.Version] = schema
+	}
+	storedVersions := make(map[string][]int64)
+	for _, sv := range stored {
+		storedVersions[sv.Filename] = append(storedVersions[sv.Filename], sv.Version)
+	}
+
+	// Several legacy names can have the same normalized name, such as "Dummy.json" and "DUMMY.json"
+	var names []string
+	byNormalized := make(map[string][]string)
+	for _, name := range schemaNames(records, storedVersions) {
+		normalized, err := schemaname.Normalize(name)
+		if err != nil || normalized == name {
+			continue
+		}
+		names = append(names, name)
+		byNormalized[normalized] = append(byNormalized[normalized], name)
+	}
+
+	legacyNames := []LegacyName{}
+	for _, name := range names {
+		normalized, _ := schemaname.Normalize(name)
+		legacy := LegacyName{Name: name, Normalized: normalized}
+		switch {
+		case len(byNormalized[normalized]) > 1:
+			legacy.Collision = true
+		case len(records[normalized]) > 0 && len(records[name]) > 0:
+			legacy.Collision = true
+		case len(records[normalized]) > 0:
+			// Files without records are only the leftovers of an interrupted rename if the versions
+			// of the normalized name have the same content
+			for _, version := range storedVersions[name] {
+				record, ok := records[normalized][version]
+				if !ok || record.Checksum == "" {
+					legacy.Collision = true
+					break
+				}
+				schemaFile, err := store.GetSchema(ctx, name, version)
+				if err != nil {
+					return nil, err
+				}
+				if VerifyChecksum(schemaFile, record.Checksum) != nil {
+					legacy.Collision = true
+					break
+				}
+			}
+		}
+		legacyNames = append(legacyNames, legacy)
+	}
+
+	return legacyNames, nil
+}
+
+// schemaNames returns the sorted names of the records and of the stored versions
+func schemaNames(records map[string]map[int64]db.Schema, storedVersions map[string][]int64) []string {
+	seen := make(map[string]bool)
+	var names []string
+	for name := range records {
+		seen[name] = true
+		names = append(names, name)
+	}
+	for name := range storedVersions {
+		if !seen[name] {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// listStoredVersions returns every version of every schema in the storage
+func listStoredVersions(ctx context.Context, store storage.SchemaStore) ([]SchemaVersion, error) {
+	filenames, err := store.ListSchemas(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	var stored []SchemaVersion
+	for _, filename := range filenames {
+		versions, err := store.ListVersions(ctx, filename)
+		if err != nil {
+			return nil, err
+		}
+		for _, version := range versions {
+			stored = append(stored, SchemaVersion{Filename: filename, Version: version})
+		}
+	}
+
+	return stored, nil
+}
@@ -0,0 +1,201 @@
+package service
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"example.com/levo_app/db"
+	"example.com/levo_app/storage"
+)
+
+func TestCheckConsistencyAndRebuild(t *testing.T) {
+	ctx := context.Background()
+	repo := db.NewMemoryRepository()
+	store := storage.NewMemoryStore()
+
+	// dummy.json 1 is consistent, 2 lost its record and 3 lost its file
+	for _, version := range []int64{1, 2} {
+		if err := store.SaveSchema(ctx, []byte(`{}`), "dummy.json", "json", version); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, version := range []int64{1, 3} {
+		if err := repo.SaveSchema(ctx, db.Schema{Version: version, Filename: "dummy.json", Timestamp: time.Now()}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	report, err := CheckConsistency(ctx, repo, store)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Consistent {
+		t.Error("expected the report to be inconsistent")
+	}
+	if !reflect.DeepEqual(report.OrphanedFiles, []SchemaVersion{{Filename: "dummy.json", Version: 2}}) {
+		t.Errorf("unexpected orphaned files %v", report.OrphanedFiles)
+	}
+	if !reflect.DeepEqual(report.MissingFiles, []SchemaVersion{{Filename: "dummy.json", Version: 3}}) {
+		t.Errorf("unexpected missing files %v", report.MissingFiles)
+	}
+
+	report, err = RebuildMetadata(ctx, repo, store)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(report.Rebuilt, []SchemaVersion{{Filename: "dummy.json", Version: 2}}) {
+		t.Errorf("unexpected rebuilt records %v", report.Rebuilt)
+	}
+	schema, err := repo.GetSchema(ctx, "dummy.json", 2)
+	if err != nil {
+		t.Errorf("expected the record of version 2 to be rebuilt: %v", err)
+	}
+	if schema.Checksum != Checksum([]byte(`{}`)) {
+		t.Errorf("expected the rebuilt record to have the checksum of the file but got '%s'", schema.Checksum)
+	}
+	if schema.Format != FormatJSON {
+		t.Errorf("expected the rebuilt record to have the format of the file but got '%s'", schema.Format)
+	}
+
+	// Only the missing file remains
+	report, err = CheckConsistency(ctx, repo, store)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(report.OrphanedFiles) != 0 || len(report.MissingFiles) != 1 {
+		t.Errorf("unexpected report after rebuild %+v", report)
+	}
+}
+
+func TestCheckConsistencyChecksumMismatch(t *testing.T) {
+	ctx := context.Background()
+	repo := db.NewMemoryRepository()
+	store := storage.NewMemoryStore()
+
+	if err := store.SaveSchema(ctx, []byte(`{"corrupted": true}`), "dummy.json", "json", 1); err != nil {
+		t.Fatal(err)
+	}
+	schema := db.Schema{Version: 1, Filename: "dummy.json", Timestamp: time.Now(), Checksum: Checksum([]byte(`{}`))}
+	if err := repo.SaveSchema(ctx, schema); err != nil {
+		t.Fatal(err)
+	}
+
+	report, err := CheckConsistency(ctx, repo, store)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Consistent || !reflect.DeepEqual(report.ChecksumMismatches, []SchemaVersion{{Filename: "dummy.json", Version: 1}}) {
+		t.Errorf("expected a checksum mismatch but got %+v", report)
+	}
+}
+
+func TestNormalizeNames(t *testing.T) {
+	ctx := context.Background()
+	database, err := db.InitializeSQLite(":memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer database.DB.Close()
+	if err := database.Migrate(ctx); err != nil {
+		t.Fatal(err)
+	}
+	basePath := t.TempDir()
+	store := storage.NewFileStore(basePath)
+
+	// Versions recorded and stored by a release that didn't normalize names, the store only saves
+	// normalized names so the legacy directories are renamed afterwards
+	legacy := func(name string, recorded bool, contents ...string) {
+		t.Helper()
+		for i, content := range contents {
+			version := int64(i + 1)
+			if err := store.SaveSchema(ctx, []byte(content), "legacy", "json", version); err != nil {
+				t.Fatal(err)
+			}
+			if recorded {
+				_, err := database.DB.Exec("INSERT INTO schemas (version, filename, created_on, checksum, format) VALUES ($1, $2, $3, $4, $5)",
+					version, name, time.Now(), Checksum([]byte(content)), FormatJSON)
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+		}
+		if err := os.Rename(filepath.Join(basePath, "legacy"), filepath.Join(basePath, name)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	upload := func(name string, contents ...string) {
+		t.Helper()
+		for i, content := range contents {
+			version := int64(i + 1)
+			if err := store.SaveSchema(ctx, []byte(content), name, "json", version); err != nil {
+				t.Fatal(err)
+			}
+			if err := database.SaveSchema(ctx, db.Schema{Version: version, Filename: name, Timestamp: time.Now(), Checksum: Checksum([]byte(content))}); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	legacy("Dummy.json", true, `{"v": 1}`, `{"v": 2}`)
+	// Two legacy names of the same schema
+	legacy("Orders.json", false, `{}`)
+	legacy("ORDERS.json", false, `{}`)
+	// A legacy name and versions uploaded since under the normalized name
+	legacy("Pets.json", true, `{"pets": 1}`)
+	upload("pets.json", `{"pets": 2}`)
+	// The files left by a rename interrupted after the records were renamed
+	legacy("Users.json", false, `{"users": 1}`)
+	upload("users.json", `{"users": 1}`)
+
+	report, err := CheckConsistency(ctx, database, store)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []LegacyName{
+		{Name: "Dummy.json", Normalized: "dummy.json"},
+		{Name: "ORDERS.json", Normalized: "orders.json", Collision: true},
+		{Name: "Orders.json", Normalized: "orders.json", Collision: true},
+		{Name: "Pets.json", Normalized: "pets.json", Collision: true},
+		{Name: "Users.json", Normalized: "users.json"},
+	}
+	if report.Consistent || !reflect.DeepEqual(report.LegacyNames, expected) {
+		t.Errorf("expected the legacy names %v but got %v", expected, report.LegacyNames)
+	}
+	if len(report.MissingFiles) != 0 || len(report.ChecksumMismatches) != 0 {
+		t.Errorf("expected the versions of the legacy names to be found but got %+v", report)
+	}
+
+	report, err = NormalizeNames(ctx, database, store)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(report.Renamed, []LegacyName{expected[0], expected[4]}) {
+		t.Errorf("unexpected renamed names %v", report.Renamed)
+	}
+	if !reflect.DeepEqual(report.LegacyNames, expected[1:4]) {
+		t.Errorf("expected the collisions to be left but got %v", report.LegacyNames)
+	}
+
+	// The renamed versions are reachable under their normalized name, and only there
+	versions, err := database.GetAllVersionsForSchema(ctx, "dummy.json")
+	if err != nil || !reflect.DeepEqual(versions, []int64{1, 2}) {
+		t.Errorf("expected the records of dummy.json versions 1 and 2 but got %v, %v", versions, err)
+	}
+	schemaFile, err := store.GetSchema(ctx, "dummy.json", 2)
+	if err != nil || string(schemaFile) != `{"v": 2}` {
+		t.Errorf("expected version 2 of dummy.json to be stored but got '%s', %v", schemaFile, err)
+	}
+	for name, expected := range map[string]int{"Dummy.json": 0, "Users.json": 0, "Pets.json": 1} {
+		versions, err := store.ListVersions(storage.WithLegacyNames(ctx), name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(versions) != expected {
+			t.Errorf("expected %d versions left under '%s' but got %v", expected, name, versions)
+		}
+	}
+}
@@ -0,0 +1,380 @@
+package storage
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+
+	"example.com/levo_app/logging"
+)
+
+// DigestStore is implemented by the stores that can serve a schema file by the SHA-256 digest of its content
+type DigestStore interface {
+	// GetBlob retrieves the content with the given hex encoded SHA-256 digest
+	GetBlob(ctx context.Context, digest string) ([]byte, error)
+}
+
+// BlobStore is a content-addressed schema store. The content of a file is stored once, keyed by
+// its SHA-256 digest, no matter how many schemas or versions share it:
+//
+//	blobs/sha256/<first 2 digest chars>/<digest>       the content
+//	blobs/sha256/<first 2 digest chars>/<digest>.refs  the number of versions referencing it
+//	refs/<filename>/<version>.<filetype>               the digest of the content of a version
+//
+// A blob is removed when its last reference is deleted. Reference counts are updated before a
+// reference is written and after it is removed, so a crash can leak a blob but never remove one
+// that is still referenced. The counts are guarded by a mutex, a base path must not be shared by
+// several processes.
+type BlobStore struct {
+	BasePath string
+
+	// Logger writes the failures the store recovers from, the lines of a request use the logger of
+	// its context. A nil Logger discards them.
+	Logger *logging.Logger
+
+	mu sync.Mutex
+}
+
+var _ SchemaStore = (*BlobStore)(nil)
+var _ DigestStore = (*BlobStore)(nil)
+var _ SchemaReplacer = (*BlobStore)(nil)
+
+// NewBlobStore creates a new content-addressed store
+func NewBlobStore(basePath string) *BlobStore {
+	return &BlobStore{BasePath: basePath}
+}
+
+// SaveSchema stores the content as a blob, unless a blob with the same digest exists, and references it from the version
+func (bs *BlobStore) SaveSchema(ctx context.Context, schemaFile []byte, filename string, filetype string, version int64) error {
+	if err := checkName(filename); err != nil {
+		return err
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	refDir := filepath.Join(bs.BasePath, "refs", filename)
+	refPath := filepath.Join(refDir, strconv.FormatInt(version, 10)+"."+filetype)
+
+	bs.mu.Lock()
+	defer bs.mu.Unlock()
+
+	if _, err := bs.refPath(filename, version); err == nil {
+		return fmt.Errorf("schema file '%s' version '%d': %w", filename, version, ErrVersionExists)
+	}
+
+	digest, err := bs.saveBlob(schemaFile)
+	if err != nil {
+		return err
+	}
+
+	err = os.MkdirAll(refDir, 0755)
+	if err == nil {
+		err = writeFileAtomic(refDir, refPath, []byte(digest))
+	}
+	if err != nil {
+		if rollbackErr := bs.addRefs(digest, -1); rollbackErr != nil {
+			logging.FromContext(ctx, bs.Logger).Error("failed to release blob reference", "digest", digest, "error", rollbackErr)
+		}
+		if errors.Is(err, ErrVersionExists) {
+			return fmt.Errorf("schema file '%s' version '%d': %w", filename, version, ErrVersionExists)
+		}
+		return fmt.Errorf("failed to save schema reference: %v", err)
+	}
+
+	return nil
+}
+
+// ReplaceSchema points the reference of the version to a blob of the new content and releases the old blob
+func (bs *BlobStore) ReplaceSchema(ctx context.Context, schemaFile []byte, filename string, version int64) error {
+	if err := checkName(filename); err != nil {
+		return err
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	bs.mu.Lock()
+	defer bs.mu.Unlock()
+
+	refPath, err := bs.refPath(filename, version)
+	if err != nil {
+		return err
+	}
+	oldDigest, err := bs.readRef(filename, version)
+	if err != nil {
+		return err
+	}
+
+	digest, err := bs.saveBlob(schemaFile)
+	if err != nil {
+		return err
+	}
+	err = replaceFileAtomic(filepath.Dir(refPath), refPath, []byte(digest))
+	if err != nil {
+		if rollbackErr := bs.addRefs(digest, -1); rollbackErr != nil {
+			logging.FromContext(ctx, bs.Logger).Error("failed to release blob reference", "digest", digest, "error", rollbackErr)
+		}
+		return fmt.Errorf("failed to replace schema reference: %v", err)
+	}
+
+	return bs.addRefs(oldDigest, -1)
+}
+
+// saveBlob stores the content as a blob unless it exists and adds a reference to it. The caller must hold mu.
+func (bs *BlobStore) saveBlob(content []byte) (string, error) {
+	sum := sha256.Sum256(content)
+	digest := hex.EncodeToString(sum[:])
+	blobDir := bs.blobDir(digest)
+	err := os.MkdirAll(blobDir, 0755)
+	if err != nil {
+		return "", fmt.Errorf("failed to create directory: %v", err)
+	}
+
+	err = writeFileAtomic(blobDir, filepath.Join(blobDir, digest), content)
+	if err != nil && !errors.Is(err, ErrVersionExists) {
+		return "", fmt.Errorf("failed to save blob: %v", err)
+	}
+
+	err = bs.addRefs(digest, 1)
+	if err != nil {
+		return "", err
+	}
+
+	return digest, nil
+}
+
+// GetSchema resolves the reference of the version and reads its blob
+func (bs *BlobStore) GetSchema(ctx context.Context, filename string, version int64) ([]byte, error) {
+	if err := checkStoredName(ctx, filename); err != nil {
+		return nil, err
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	digest, err := bs.readRef(filename, version)
+	if err != nil {
+		return nil, err
+	}
+
+	return bs.GetBlob(ctx, digest)
+}
+
+// GetBlob reads the blob with the given digest
+func (bs *BlobStore) GetBlob(ctx context.Context, digest string) ([]byte, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	if !isDigest(digest) {
+		return nil, fmt.Errorf("invalid sha256 digest '%s'", digest)
+	}
+
+	content, err := ioutil.ReadFile(filepath.Join(bs.blobDir(digest), digest))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, fmt.Errorf("blob '%s' does not exist: %w", digest, ErrSchemaNotFound)
+		}
+		return nil, fmt.Errorf("failed to read blob: %v", err)
+	}
+
+	return content, nil
+}
+
+// DeleteSchema removes the reference of the version, and the blob if it was the last reference
+func (bs *BlobStore) DeleteSchema(ctx context.Context, filename string, version int64) error {
+	if err := checkStoredName(ctx, filename); err != nil {
+		return err
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	bs.mu.Lock()
+	defer bs.mu.Unlock()
+
+	refPath, err := bs.refPath(filename, version)
+	if err != nil {
+		if errors.Is(err, ErrSchemaNotFound) {
+			return nil
+		}
+		return err
+	}
+	digest, err := bs.readRef(filename, version)
+	if err != nil {
+		return err
+	}
+
+	err = os.Remove(refPath)
+	if err != nil {
+		return fmt.Errorf("failed to delete schema: %v", err)
+	}
+
+	return bs.addRefs(digest, -1)
+}
+
+// ListSchemas lists the schema files that have references
+func (bs *BlobStore) ListSchemas(ctx context.Context) ([]string, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	return listSchemaDirs(ctx, filepath.Join(bs.BasePath, "refs"))
+}
+
+// ListVersions lists the versions referenced for the schema file
+func (bs *BlobStore) ListVersions(ctx context.Context, filename string) ([]int64, error) {
+	if err := checkStoredName(ctx, filename); err != nil {
+		return nil, err
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	return listVersionFiles(filepath.Join(bs.BasePath, "refs", filename))
+}
+
+// SchemaExists checks whether the version has a reference
+func (bs *BlobStore) SchemaExists(ctx context.Context, filename string, version int64) (bool, error) {
+	if err := checkStoredName(ctx, filename); err != nil {
+		return false, err
+	}
+	if err := ctx.Err(); err != nil {
+		return false, err
+	}
+
+	_, err := bs.refPath(filename, version)
+	if err != nil {
+		if errors.Is(err, ErrSchemaNotFound) {
+			return false, nil
+		}
+		return false, err
+	}
+
+	return true, nil
+}
+
+// RemoveTempFiles deletes the temp files left behind by writes that were interrupted by a crash
+func (bs *BlobStore) RemoveTempFiles() (int, error) {
+	return removeTempFiles(bs.BasePath)
+}
+
+// blobDir returns the directory of a blob, blobs are spread over 256 directories by digest prefix
+func (bs *BlobStore) blobDir(digest string) string {
+	return filepath.Join(bs.BasePath, "blobs", "sha256", digest[:2])
+}
+
+// refPath finds the reference file of a version, whatever its file type
+func (bs *BlobStore) refPath(filename string, version int64) (string, error) {
+	refDir := filepath.Join(bs.BasePath, "refs", filename)
+	entries, err := ioutil.ReadDir(refDir)
+	if err != nil && !os.IsNotExist(err) {
+		return "", fmt.Errorf("failed to read schema references: %v", err)
+	}
+
+	prefix := strconv.FormatInt(version, 10)
+	for _, entry := range entries {
+		name := entry.Name()
+		if strings.TrimSuffix(name, path.Ext(name)) == prefix {
+			return filepath.Join(refDir, name), nil
+		}
+	}
+
+	return "", fmt.Errorf("schema file '%s' version '%d' does not exist: %w", filename, version, ErrSchemaNotFound)
+}
+
+// readRef returns the digest referenced by a version
+func (bs *BlobStore) readRef(filename string, version int64) (string, error) {
+	refPath, err := bs.refPath(filename, version)
+	if err != nil {
+		return "", err
+	}
+
+	content, err := ioutil.ReadFile(refPath)
+	if err != nil {
+		return "", fmt.Errorf("failed to read schema reference: %v", err)
+	}
+	digest := strings.TrimSpace(string(content))
+	if !isDigest(digest) {
+		return "", fmt.Errorf("schema reference '%s' is corrupted", refPath)
+	}
+
+	return digest, nil
+}
+
+// addRefs adds delta to the reference count of the blob and removes the blob when no reference is left.
+// The caller must hold mu.
+func (bs *BlobStore) addRefs(digest string, delta int) error {
+	blobDir := bs.blobDir(digest)
+	countPath := filepath.Join(blobDir, digest+".refs")
+
+	count := 0
+	content, err := ioutil.ReadFile(countPath)
+	if err == nil {
+		count, err = strconv.Atoi(strings.TrimSpace(string(content)))
+		if err != nil {
+			return fmt.Errorf("reference count of blob '%s' is corrupted: %v", digest, err)
+		}
+	} else if !os.IsNotExist(err) {
+		return fmt.Errorf("failed to read reference count: %v", err)
+	}
+
+	count += delta
+	if count <= 0 {
+		err = os.Remove(filepath.Join(blobDir, digest))
+		if err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("failed to delete blob: %v", err)
+		}
+		err = os.Remove(countPath)
+		if err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("failed to delete reference count: %v", err)
+		}
+		return nil
+	}
+
+	err = replaceFileAtomic(blobDir, countPath, []byte(strconv.Itoa(count)))
+	if err != nil {
+		return fmt.Errorf("failed to save reference count: %v", err)
+	}
+
+	return nil
+}
+
+// RefCount returns the number of versions referencing the blob with the given digest
+func (bs *BlobStore) RefCount(digest string) (int, error) {
+	if !isDigest(digest) {
+		return 0, fmt.Errorf("invalid sha256 digest '%s'", digest)
+	}
+
+	content, err := ioutil.ReadFile(filepath.Join(bs.blobDir(digest), digest+".refs"))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return 0, nil
+		}
+		return 0, fmt.Errorf("failed to read reference count: %v", err)
+	}
+
+	return strconv.Atoi(strings.TrimSpace(string(content)))
+}
+
+// isDigest checks that the value is a lower case hex encoded SHA-256 digest
+func isDigest(value string) bool {
+	if len(value) != sha256.Size*2 {
+		return false
+	}
+	for _, c := range value {
+		if (c < '0' || c > '9') && (c < 'a' || c > 'f') {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,205 @@
+package storage
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// Supported compressions of CompressedStore
+const (
+	CompressionGzip = "gzip"
+	CompressionZstd = "zstd"
+)
+
+// DefaultMaxDecompressedSize is the default maximum size of a decompressed version, the default
+// maximum upload size
+const DefaultMaxDecompressedSize = 10 << 20
+
+// ErrDecompressedTooLarge is returned when a stored file decompresses to more than the maximum size
+var ErrDecompressedTooLarge = errors.New("decompressed file is larger than the maximum size")
+
+// Magic numbers at the start of the compressed files, schema files are text and never start with them
+var (
+	gzipMagic = []byte{0x1f, 0x8b}
+	zstdMagic = []byte{0x28, 0xb5, 0x2f, 0xfd}
+)
+
+// The zstd encoder is safe for concurrent use of EncodeAll
+var zstdEncoder, _ = zstd.NewWriter(nil)
+
+// CompressedReader is implemented by the stores that can return a version as it is stored, without decompressing it
+type CompressedReader interface {
+	// GetCompressedSchema returns the stored bytes of a version and their compression, which is
+	// empty when the version is stored uncompressed
+	GetCompressedSchema(ctx context.Context, filename string, version int64) ([]byte, string, error)
+}
+
+// CompressedStore compresses the schema files before saving them to another store and decompresses
+// them when they are read. The compression of a version is detected from its content, so the
+// compression can be changed or enabled on an existing store: the versions saved before keep the
+// compression they were saved with, uncompressed ones included.
+// Compressed files don't share lines, a FileStore with delta storage saves them whole.
+type CompressedStore struct {
+	Store SchemaStore
+
+	// Compression is the compression of the saved versions, CompressionGzip or CompressionZstd
+	Compression string
+
+	// MaxSize is the maximum size of a decompressed version in bytes, set to the maximum upload
+	// size so a corrupted or forged file can't exhaust the memory. Zero means DefaultMaxDecompressedSize.
+	MaxSize int64
+}
+
+var _ SchemaStore = (*CompressedStore)(nil)
+var _ CompressedReader = (*CompressedStore)(nil)
+
+// NewCompressedStore creates a store compressing the versions saved to the given store
+func NewCompressedStore(store SchemaStore, compression string) (*CompressedStore, error) {
+	if compression != CompressionGzip && compression != CompressionZstd {
+		return nil, fmt.Errorf("unsupported compression %q, expected %s or %s", compression, CompressionGzip, CompressionZstd)
+	}
+
+	return &CompressedStore{Store: store, Compression: compression}, nil
+}
+
+// Unwrap returns the store the compressed versions are saved to
+func (cs *CompressedStore) Unwrap() SchemaStore {
+	return cs.Store
+}
+
+// SaveSchema compresses the schema file and saves it to the underlying store
+func (cs *CompressedStore) SaveSchema(ctx context.Context, schemaFile []byte, filename string, filetype string, version int64) error {
+	var compressed []byte
+	switch cs.Compression {
+	case CompressionGzip:
+		var buf bytes.Buffer
+		gzipWriter := gzip.NewWriter(&buf)
+		if _, err := gzipWriter.Write(schemaFile); err != nil {
+			return fmt.Errorf("failed to compress schema file: %v", err)
+		}
+		if err := gzipWriter.Close(); err != nil {
+			return fmt.Errorf("failed to compress schema file: %v", err)
+		}
+		compressed = buf.Bytes()
+	case CompressionZstd:
+		compressed = zstdEncoder.EncodeAll(schemaFile, nil)
+	default:
+		return fmt.Errorf("unsupported compression %q", cs.Compression)
+	}
+
+	return cs.Store.SaveSchema(ctx, compressed, filename, filetype, version)
+}
+
+// GetSchema reads the schema file from the underlying store and decompresses it
+func (cs *CompressedStore) GetSchema(ctx context.Context, filename string, version int64) ([]byte, error) {
+	stored, err := cs.Store.GetSchema(ctx, filename, version)
+	if err != nil {
+		return nil, err
+	}
+
+	maxSize := cs.MaxSize
+	if maxSize <= 0 {
+		maxSize = DefaultMaxDecompressedSize
+	}
+	schemaFile, err := Decompress(stored, maxSize)
+	if err != nil {
+		return nil, fmt.Errorf("schema file '%s' version '%d': %w", filename, version, err)
+	}
+
+	return schemaFile, nil
+}
+
+// GetCompressedSchema reads the schema file from the underlying store without decompressing it
+func (cs *CompressedStore) GetCompressedSchema(ctx context.Context, filename string, version int64) ([]byte, string, error) {
+	stored, err := cs.Store.GetSchema(ctx, filename, version)
+	if err != nil {
+		return nil, "", err
+	}
+
+	return stored, compressionOf(stored), nil
+}
+
+// DeleteSchema removes the schema file from the underlying store
+func (cs *CompressedStore) DeleteSchema(ctx context.Context, filename string, version int64) error {
+	return cs.Store.DeleteSchema(ctx, filename, version)
+}
+
+// ListSchemas returns the names of the schema files of the underlying store
+func (cs *CompressedStore) ListSchemas(ctx context.Context) ([]string, error) {
+	return cs.Store.ListSchemas(ctx)
+}
+
+// ListVersions returns the versions of a schema file of the underlying store
+func (cs *CompressedStore) ListVersions(ctx context.Context, filename string) ([]int64, error) {
+	return cs.Store.ListVersions(ctx, filename)
+}
+
+// SchemaExists reports whether the underlying store has the given version of a schema file
+func (cs *CompressedStore) SchemaExists(ctx context.Context, filename string, version int64) (bool, error) {
+	return cs.Store.SchemaExists(ctx, filename, version)
+}
+
+// Decompress decompresses a file compressed by a CompressedStore, uncompressed files are returned
+// as they are. It fails with ErrDecompressedTooLarge when the file decompresses to more than maxSize bytes.
+func Decompress(stored []byte, maxSize int64) ([]byte, error) {
+	switch compressionOf(stored) {
+	case CompressionGzip:
+		gzipReader, err := gzip.NewReader(bytes.NewReader(stored))
+		if err != nil {
+			return nil, fmt.Errorf("failed to decompress gzip file: %v", err)
+		}
+		defer gzipReader.Close()
+
+		decompressed, err := readLimited(gzipReader, maxSize)
+		if err != nil {
+			return nil, fmt.Errorf("failed to decompress gzip file: %w", err)
+		}
+		return decompressed, nil
+	case CompressionZstd:
+		// DecodeAll has no output limit, the streaming decoder is read through a limit instead
+		zstdReader, err := zstd.NewReader(bytes.NewReader(stored), zstd.WithDecoderConcurrency(1))
+		if err != nil {
+			return nil, fmt.Errorf("failed to decompress zstd file: %v", err)
+		}
+		defer zstdReader.Close()
+
+		decompressed, err := readLimited(zstdReader, maxSize)
+		if err != nil {
+			return nil, fmt.Errorf("failed to decompress zstd file: %w", err)
+		}
+		return decompressed, nil
+	default:
+		return stored, nil
+	}
+}
+
+// readLimited reads r to the end, failing with ErrDecompressedTooLarge after maxSize bytes
+func readLimited(r io.Reader, maxSize int64) ([]byte, error) {
+	content, err := ioutil.ReadAll(io.LimitReader(r, maxSize+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(content)) > maxSize {
+		return nil, ErrDecompressedTooLarge
+	}
+	return content, nil
+}
+
+// compressionOf detects the compression of a stored file from its magic number
+func compressionOf(stored []byte) string {
+	switch {
+	case bytes.HasPrefix(stored, gzipMagic):
+		return CompressionGzip
+	case bytes.HasPrefix(stored, zstdMagic):
+		return CompressionZstd
+	default:
+		return ""
+	}
+}
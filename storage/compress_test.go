@@ -0,0 +1,87 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"testing"
+)
+
+func TestCompressedStore(t *testing.T) {
+	for _, compression := range []string{CompressionGzip, CompressionZstd} {
+		t.Run(compression, func(t *testing.T) {
+			store, err := NewCompressedStore(NewFileStore(t.TempDir()), compression)
+			if err != nil {
+				t.Fatal(err)
+			}
+			testSchemaStore(t, store)
+		})
+	}
+
+	if _, err := NewCompressedStore(NewMemoryStore(), "lz4"); err == nil {
+		t.Error("expected an unsupported compression to be rejected")
+	}
+}
+
+func TestCompressedStoreMixedCompressions(t *testing.T) {
+	ctx := context.Background()
+	memoryStore := NewMemoryStore()
+	content := bytes.Repeat([]byte(`{"openapi": "3.0.1"}`+"\n"), 100)
+
+	// Version 1 was saved before compression was enabled, version 2 with gzip and version 3 with zstd
+	if err := memoryStore.SaveSchema(ctx, content, "dummy.json", "json", 1); err != nil {
+		t.Fatal(err)
+	}
+	for version, compression := range map[int64]string{2: CompressionGzip, 3: CompressionZstd} {
+		store := &CompressedStore{Store: memoryStore, Compression: compression}
+		if err := store.SaveSchema(ctx, content, "dummy.json", "json", version); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	store := &CompressedStore{Store: memoryStore, Compression: CompressionGzip}
+	for version, expected := range map[int64]string{1: "", 2: CompressionGzip, 3: CompressionZstd} {
+		got, err := store.GetSchema(ctx, "dummy.json", version)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, content) {
+			t.Errorf("version %d was not decompressed", version)
+		}
+
+		stored, compression, err := store.GetCompressedSchema(ctx, "dummy.json", version)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if compression != expected {
+			t.Errorf("expected version %d to be stored with compression %q but got %q", version, expected, compression)
+		}
+		if compression != "" && len(stored) >= len(content) {
+			t.Errorf("expected version %d to be compressed but it takes %d bytes", version, len(stored))
+		}
+	}
+}
+
+func TestCompressedStoreMaxSize(t *testing.T) {
+	ctx := context.Background()
+	// A small file decompressing to more than the maximum size, like a decompression bomb
+	content := bytes.Repeat([]byte(" "), 1<<20)
+
+	for _, compression := range []string{CompressionGzip, CompressionZstd} {
+		t.Run(compression, func(t *testing.T) {
+			store := &CompressedStore{Store: NewMemoryStore(), Compression: compression, MaxSize: 1 << 20}
+			if err := store.SaveSchema(ctx, content, "dummy.json", "json", 1); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := store.GetSchema(ctx, "dummy.json", 1); err != nil {
+				t.Errorf("expected a version of the maximum size to be read but got: %v", err)
+			}
+
+			store.MaxSize = 1<<20 - 1
+			_, err := store.GetSchema(ctx, "dummy.json", 1)
+			if !errors.Is(err, ErrDecompressedTooLarge) {
+				t.Errorf("expected ErrDecompressedTooLarge but got: %v", err)
+			}
+		})
+	}
+}
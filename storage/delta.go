@@ -0,0 +1,256 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+)
+
+// deltaSuffix is appended to the version file name when the version is stored as a delta
+const deltaSuffix = ".delta"
+
+// maxDeltaEdits bounds the work and memory of diffLines, about maxDeltaEdits² ints, versions
+// differing in more lines are stored as snapshots
+const maxDeltaEdits = 1000
+
+// delta is the content of a ".delta" version file: the version is rebuilt by copying line ranges of
+// the previous version and inserting new lines. Lines keep their line endings, so the rebuilt file
+// is byte for byte the uploaded one and its checksum can be verified.
+type delta struct {
+	// Size is the size of the rebuilt file, used to report space savings without rebuilding it
+	Size int       `json:"size"`
+	Ops  []deltaOp `json:"ops"`
+}
+
+// deltaOp either copies Copy[1] lines of the previous version starting at line Copy[0], or inserts the Insert lines
+type deltaOp struct {
+	Copy   []int    `json:"c,omitempty"`
+	Insert []string `json:"i,omitempty"`
+}
+
+// makeDelta computes the delta from base to target, ok is false when a delta would not be smaller than target
+func makeDelta(base []byte, target []byte) (encoded []byte, ok bool, err error) {
+	baseLines := splitLines(base)
+	targetLines := splitLines(target)
+
+	match, ok := diffLines(baseLines, targetLines, maxDeltaEdits)
+	if !ok {
+		return nil, false, nil
+	}
+
+	d := delta{Size: len(target), Ops: []deltaOp{}}
+	for j := 0; j < len(targetLines); {
+		if match[j] < 0 {
+			var insert []string
+			for ; j < len(targetLines) && match[j] < 0; j++ {
+				insert = append(insert, targetLines[j])
+			}
+			d.Ops = append(d.Ops, deltaOp{Insert: insert})
+			continue
+		}
+
+		start, count := match[j], 0
+		for ; j < len(targetLines) && match[j] == start+count; j++ {
+			count++
+		}
+		d.Ops = append(d.Ops, deltaOp{Copy: []int{start, count}})
+	}
+
+	encoded, err = json.Marshal(d)
+	if err != nil {
+		return nil, false, fmt.Errorf("failed to encode delta: %v", err)
+	}
+
+	return encoded, len(encoded) < len(target), nil
+}
+
+// applyDelta rebuilds a version from the previous version and its encoded delta
+func applyDelta(base []byte, encoded []byte) ([]byte, error) {
+	var d delta
+	err := json.Unmarshal(encoded, &d)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode delta: %v", err)
+	}
+
+	baseLines := splitLines(base)
+	var buf bytes.Buffer
+	buf.Grow(d.Size)
+	for _, op := range d.Ops {
+		if op.Copy == nil {
+			for _, line := range op.Insert {
+				buf.WriteString(line)
+			}
+			continue
+		}
+
+		if len(op.Copy) != 2 || op.Copy[0] < 0 || op.Copy[1] < 0 || op.Copy[0]+op.Copy[1] > len(baseLines) {
+			return nil, fmt.Errorf("delta copies lines %v outside of the previous version", op.Copy)
+		}
+		for _, line := range baseLines[op.Copy[0] : op.Copy[0]+op.Copy[1]] {
+			buf.WriteString(line)
+		}
+	}
+
+	if buf.Len() != d.Size {
+		return nil, fmt.Errorf("delta rebuilt %d bytes instead of %d", buf.Len(), d.Size)
+	}
+
+	return buf.Bytes(), nil
+}
+
+// splitLines splits the content after every newline, the last line may not end with one
+func splitLines(content []byte) []string {
+	var lines []string
+	for len(content) > 0 {
+		i := bytes.IndexByte(content, '\n')
+		if i < 0 {
+			lines = append(lines, string(content))
+			break
+		}
+		lines = append(lines, string(content[:i+1]))
+		content = content[i+1:]
+	}
+	return lines
+}
+
+// diffLines finds a longest common subsequence of a and b with the Myers algorithm. It returns for
+// each line of b the index of the matching line of a, or -1 for inserted lines. ok is false when a
+// and b differ by more than maxEdits inserted or deleted lines.
+func diffLines(a []string, b []string, maxEdits int) (match []int, ok bool) {
+	n, m := len(a), len(b)
+	limit := n + m
+	if limit > maxEdits {
+		limit = maxEdits
+	}
+
+	offset := limit + 1
+	v := make([]int, 2*limit+3)
+	// trace[d] is the window v[-d..d] before step d, the only part of v the walk back reads for that step
+	var trace [][]int
+	end := -1
+	for d := 0; d <= limit && end < 0; d++ {
+		trace = append(trace, append([]int(nil), v[offset-d:offset+d+1]...))
+		for k := -d; k <= d; k += 2 {
+			var x int
+			if k == -d || (k != d && v[offset+k-1] < v[offset+k+1]) {
+				x = v[offset+k+1]
+			} else {
+				x = v[offset+k-1] + 1
+			}
+			y := x - k
+			for x < n && y < m && a[x] == b[y] {
+				x++
+				y++
+			}
+			v[offset+k] = x
+			if x >= n && y >= m {
+				end = d
+				break
+			}
+		}
+	}
+	if end < 0 {
+		return nil, false
+	}
+
+	// Walk the trace back from (n, m), marking the diagonal moves as matching lines
+	match = make([]int, m)
+	for j := range match {
+		match[j] = -1
+	}
+	x, y := n, m
+	for d := end; d > 0; d-- {
+		window := trace[d]
+		k := x - y
+		var prevK int
+		if k == -d || (k != d && window[d+k-1] < window[d+k+1]) {
+			prevK = k + 1
+		} else {
+			prevK = k - 1
+		}
+		prevX := window[d+prevK]
+		prevY := prevX - prevK
+		for x > prevX && y > prevY {
+			x--
+			y--
+			match[y] = x
+		}
+		x, y = prevX, prevY
+	}
+	for x > 0 && y > 0 {
+		x--
+		y--
+		match[y] = x
+	}
+
+	return match, true
+}
+
+// SpaceUsage reports how much space the stored versions take compared to their uploaded size
+type SpaceUsage struct {
+	Versions     int     `json:"versions"`
+	Deltas       int     `json:"deltas"`
+	LogicalBytes int64   `json:"logical_bytes"`
+	StoredBytes  int64   `json:"stored_bytes"`
+	SavedBytes   int64   `json:"saved_bytes"`
+	SavedPercent float64 `json:"saved_percent"`
+}
+
+// SpaceReporter is implemented by the stores that can report their space usage
+type SpaceReporter interface {
+	SpaceUsage(ctx context.Context) (SpaceUsage, error)
+}
+
+var _ SpaceReporter = (*FileStore)(nil)
+
+// SpaceUsage adds up the size of every stored version file and the size of the versions they hold
+func (fs *FileStore) SpaceUsage(ctx context.Context) (SpaceUsage, error) {
+	var usage SpaceUsage
+
+	filenames, err := fs.ListSchemas(ctx)
+	if err != nil {
+		return usage, err
+	}
+	for _, filename := range filenames {
+		entries, err := ioutil.ReadDir(filepath.Join(fs.BasePath, filename))
+		if err != nil {
+			return usage, fmt.Errorf("failed to list schema versions: %v", err)
+		}
+
+		for _, entry := range entries {
+			if entry.IsDir() || strings.HasPrefix(entry.Name(), tempFilePrefix) {
+				continue
+			}
+			usage.Versions++
+			usage.StoredBytes += entry.Size()
+
+			if !strings.HasSuffix(entry.Name(), deltaSuffix) {
+				usage.LogicalBytes += entry.Size()
+				continue
+			}
+
+			encodedDelta, err := ioutil.ReadFile(filepath.Join(fs.BasePath, filename, entry.Name()))
+			if err != nil {
+				return usage, fmt.Errorf("failed to read delta: %v", err)
+			}
+			var d delta
+			err = json.Unmarshal(encodedDelta, &d)
+			if err != nil {
+				return usage, fmt.Errorf("failed to decode delta '%s': %v", entry.Name(), err)
+			}
+			usage.Deltas++
+			usage.LogicalBytes += int64(d.Size)
+		}
+	}
+
+	usage.SavedBytes = usage.LogicalBytes - usage.StoredBytes
+	if usage.LogicalBytes > 0 {
+		usage.SavedPercent = float64(usage.SavedBytes) * 100 / float64(usage.LogicalBytes)
+	}
+
+	return usage, nil
+}
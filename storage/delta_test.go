@@ -0,0 +1,157 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestDeltaRoundTrip(t *testing.T) {
+	random := rand.New(rand.NewSource(1))
+	words := []string{"openapi", "paths", "get", "post", "{", "}", ""}
+
+	randomLines := func(n int) []string {
+		lines := make([]string, n)
+		for i := range lines {
+			lines[i] = words[random.Intn(len(words))] + "\n"
+		}
+		return lines
+	}
+
+	for i := 0; i < 200; i++ {
+		baseLines := randomLines(random.Intn(40))
+		targetLines := append([]string(nil), baseLines...)
+		for edits := random.Intn(5); edits > 0; edits-- {
+			at := 0
+			if len(targetLines) > 0 {
+				at = random.Intn(len(targetLines))
+			}
+			if random.Intn(2) == 0 && len(targetLines) > 0 {
+				targetLines = append(targetLines[:at], targetLines[at+1:]...)
+			} else {
+				targetLines = append(targetLines[:at], append(randomLines(1), targetLines[at:]...)...)
+			}
+		}
+		base := []byte(strings.Join(baseLines, ""))
+		// The last line doesn't always end with a newline
+		target := []byte(strings.TrimSuffix(strings.Join(targetLines, ""), "\n"))
+
+		encoded, _, err := makeDelta(base, target)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if encoded == nil {
+			t.Fatalf("expected a delta of '%s' and '%s'", base, target)
+		}
+		got, err := applyDelta(base, encoded)
+		if err != nil {
+			t.Fatalf("failed to apply delta %s: %v", encoded, err)
+		}
+		if !bytes.Equal(got, target) {
+			t.Fatalf("expected '%s' but delta %s rebuilt '%s'", target, encoded, got)
+		}
+	}
+}
+
+func TestDiffLinesMemory(t *testing.T) {
+	// Versions without a common line make diffLines run up to its limit
+	a := make([]string, 5000)
+	b := make([]string, 5000)
+	for i := range a {
+		a[i] = "a" + strconv.Itoa(i) + "\n"
+		b[i] = "b" + strconv.Itoa(i) + "\n"
+	}
+
+	var before, after runtime.MemStats
+	runtime.ReadMemStats(&before)
+	_, ok := diffLines(a, b, maxDeltaEdits)
+	runtime.ReadMemStats(&after)
+
+	if ok {
+		t.Error("expected versions without a common line to exceed the edit limit")
+	}
+	if allocated := after.TotalAlloc - before.TotalAlloc; allocated > 12<<20 {
+		t.Errorf("expected diffLines to allocate less than 12 MiB but it allocated %d bytes", allocated)
+	}
+}
+
+func TestFileStoreDeltas(t *testing.T) {
+	testSchemaStore(t, &FileStore{BasePath: t.TempDir(), SnapshotInterval: 3})
+
+	ctx := context.Background()
+	fileStore := &FileStore{BasePath: t.TempDir(), SnapshotInterval: 3}
+
+	original, err := ioutil.ReadFile(filepath.Join("..", "schema_uploads", "openapi.json", "1.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Every version changes a few lines of the previous one
+	versions := [][]byte{original}
+	for i := 1; i < 5; i++ {
+		lines := strings.SplitAfter(string(versions[i-1]), "\n")
+		lines[10*i] = "        \"x-version\": \"" + strings.Repeat("v", i) + "\",\n"
+		lines = append(lines[:100*i], lines[100*i+1:]...)
+		versions = append(versions, []byte(strings.Join(lines, "")))
+	}
+	for i, content := range versions {
+		if err := fileStore.SaveSchema(ctx, content, "openapi.json", "json", int64(i+1)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, name := range []string{"1.json", "2.json.delta", "3.json.delta", "4.json", "5.json.delta"} {
+		if _, err := os.Stat(filepath.Join(fileStore.BasePath, "openapi.json", name)); err != nil {
+			t.Errorf("expected version file %s: %v", name, err)
+		}
+	}
+	for i, content := range versions {
+		got, err := fileStore.GetSchema(ctx, "openapi.json", int64(i+1))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, content) {
+			t.Errorf("version %d was not rebuilt byte for byte", i+1)
+		}
+	}
+
+	usage, err := fileStore.SpaceUsage(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if usage.Versions != 5 || usage.Deltas != 3 || usage.SavedPercent < 50 {
+		t.Errorf("expected 3 deltas saving more than half of the space but got %+v", usage)
+	}
+
+	// Deleting a version keeps the versions that were stored as deltas of it readable
+	if err := fileStore.DeleteSchema(ctx, "openapi.json", 2); err != nil {
+		t.Fatal(err)
+	}
+	got, err := fileStore.GetSchema(ctx, "openapi.json", 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, versions[2]) {
+		t.Error("version 3 was not kept after deleting version 2")
+	}
+
+	// A replacement of a delta interrupted before removing it leaves both files of the version
+	if err := ioutil.WriteFile(filepath.Join(fileStore.BasePath, "openapi.json", "5.json"), versions[4], 0o644); err != nil {
+		t.Fatal(err)
+	}
+	listed, err := fileStore.ListVersions(ctx, "openapi.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(listed, []int64{1, 3, 4, 5}) {
+		t.Errorf("expected versions [1 3 4 5] but got %v", listed)
+	}
+}
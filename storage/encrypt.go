@@ -0,0 +1,338 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"strconv"
+	"sync"
+
+	yaml "gopkg.in/yaml.v2"
+)
+
+// encryptedMagic starts every file encrypted by an EncryptedStore. The header of an encrypted file is
+// the magic, the length of the key ID in one byte and the key ID, followed by the GCM nonce and the
+// sealed content.
+var encryptedMagic = []byte("LEVOENC1")
+
+// KeyRotator is implemented by the stores that can re-encrypt their versions under a new key
+type KeyRotator interface {
+	// RotateKeys reloads the keys and re-encrypts every version that is not encrypted with the primary key
+	RotateKeys(ctx context.Context) (KeyRotation, error)
+}
+
+// KeyRotation reports the outcome of a key rotation
+type KeyRotation struct {
+	// Primary is the ID of the key every version is encrypted with after the rotation
+	Primary string `json:"primary"`
+	// Versions is the number of versions checked
+	Versions int `json:"versions"`
+	// Reencrypted is the number of versions that were re-encrypted with the primary key
+	Reencrypted int `json:"reencrypted"`
+}
+
+// Keyring holds the AES keys of an EncryptedStore by key ID
+type Keyring struct {
+	// Primary is the ID of the key new versions are encrypted with
+	Primary string
+
+	keys map[string]cipher.AEAD
+}
+
+// keyringFile is the YAML format of a keyring file, keys are base64 encoded and 16, 24 or 32 bytes long:
+//
+//	primary: "2026-10"
+//	keys:
+//	  "2026-09": 6D3Zr5Rc...
+//	  "2026-10": qm9yZ1Vh...
+type keyringFile struct {
+	Primary string            `yaml:"primary"`
+	Keys    map[string]string `yaml:"keys"`
+}
+
+// LoadKeyring reads a keyring file
+func LoadKeyring(keyringPath string) (*Keyring, error) {
+	content, err := ioutil.ReadFile(keyringPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read keyring: %v", err)
+	}
+
+	return ParseKeyring(content)
+}
+
+// ParseKeyring parses the content of a keyring file
+func ParseKeyring(content []byte) (*Keyring, error) {
+	var file keyringFile
+	err := yaml.UnmarshalStrict(content, &file)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse keyring: %v", err)
+	}
+
+	keyring := &Keyring{Primary: file.Primary, keys: make(map[string]cipher.AEAD, len(file.Keys))}
+	for keyID, encodedKey := range file.Keys {
+		if keyID == "" || len(keyID) > 255 {
+			return nil, fmt.Errorf("keyring key ID '%s' must be 1 to 255 bytes long", keyID)
+		}
+		key, err := base64.StdEncoding.DecodeString(encodedKey)
+		if err != nil {
+			return nil, fmt.Errorf("keyring key '%s' is not base64 encoded: %v", keyID, err)
+		}
+		block, err := aes.NewCipher(key)
+		if err != nil {
+			return nil, fmt.Errorf("keyring key '%s' is not an AES key: %v", keyID, err)
+		}
+		aead, err := cipher.NewGCM(block)
+		if err != nil {
+			return nil, fmt.Errorf("keyring key '%s': %v", keyID, err)
+		}
+		keyring.keys[keyID] = aead
+	}
+	if _, ok := keyring.keys[keyring.Primary]; !ok {
+		return nil, fmt.Errorf("keyring primary key '%s' is not in the keys", keyring.Primary)
+	}
+
+	return keyring, nil
+}
+
+// EncryptedStore encrypts the schema files with AES-GCM before saving them to another store and
+// decrypts them when they are read. Every version records the ID of the key it was encrypted with,
+// so the keys of older versions can stay in the keyring while new versions use the primary key.
+// The content is bound to its schema file name and version, an encrypted file copied over another
+// version fails to decrypt. Versions saved before encryption was enabled are read as they are.
+//
+// To rotate keys, add a new key to the keyring file, make it the primary key and call RotateKeys,
+// which re-encrypts the versions in place while the store keeps serving them. The old key can be
+// removed from the keyring file once the rotation succeeded.
+//
+// Encrypted contents are unique, a BlobStore can't deduplicate them and a FileStore with delta
+// storage saves them whole.
+type EncryptedStore struct {
+	Store SchemaStore
+
+	// KeyringPath is the keyring file, it is read again by RotateKeys
+	KeyringPath string
+
+	mu      sync.RWMutex
+	keyring *Keyring
+}
+
+var _ SchemaStore = (*EncryptedStore)(nil)
+var _ KeyRotator = (*EncryptedStore)(nil)
+
+// NewEncryptedStore creates a store encrypting the versions saved to the given store with the keys of the keyring file
+func NewEncryptedStore(store SchemaStore, keyringPath string) (*EncryptedStore, error) {
+	keyring, err := LoadKeyring(keyringPath)
+	if err != nil {
+		return nil, err
+	}
+
+	return &EncryptedStore{Store: store, KeyringPath: keyringPath, keyring: keyring}, nil
+}
+
+// Unwrap returns the store the encrypted versions are saved to
+func (es *EncryptedStore) Unwrap() SchemaStore {
+	return es.Store
+}
+
+// SaveSchema encrypts the schema file with the primary key and saves it to the underlying store
+func (es *EncryptedStore) SaveSchema(ctx context.Context, schemaFile []byte, filename string, filetype string, version int64) error {
+	encrypted, err := es.encrypt(schemaFile, filename, version)
+	if err != nil {
+		return err
+	}
+
+	return es.Store.SaveSchema(ctx, encrypted, filename, filetype, version)
+}
+
+// GetSchema reads the schema file from the underlying store and decrypts it
+func (es *EncryptedStore) GetSchema(ctx context.Context, filename string, version int64) ([]byte, error) {
+	stored, err := es.Store.GetSchema(ctx, filename, version)
+	if err != nil {
+		return nil, err
+	}
+
+	return es.decrypt(stored, filename, version)
+}
+
+// KeyID returns the ID of the key a version is encrypted with, or an empty string if it is not encrypted
+func (es *EncryptedStore) KeyID(ctx context.Context, filename string, version int64) (string, error) {
+	stored, err := es.Store.GetSchema(ctx, filename, version)
+	if err != nil {
+		return "", err
+	}
+
+	keyID, _, err := parseEncryptedHeader(stored)
+	return keyID, err
+}
+
+// DeleteSchema removes the schema file from the underlying store
+func (es *EncryptedStore) DeleteSchema(ctx context.Context, filename string, version int64) error {
+	return es.Store.DeleteSchema(ctx, filename, version)
+}
+
+// ListSchemas returns the names of the schema files of the underlying store
+func (es *EncryptedStore) ListSchemas(ctx context.Context) ([]string, error) {
+	return es.Store.ListSchemas(ctx)
+}
+
+// ListVersions returns the versions of a schema file of the underlying store
+func (es *EncryptedStore) ListVersions(ctx context.Context, filename string) ([]int64, error) {
+	return es.Store.ListVersions(ctx, filename)
+}
+
+// SchemaExists reports whether the underlying store has the given version of a schema file
+func (es *EncryptedStore) SchemaExists(ctx context.Context, filename string, version int64) (bool, error) {
+	return es.Store.SchemaExists(ctx, filename, version)
+}
+
+// RotateKeys reads the keyring file again and re-encrypts the versions that are not encrypted with
+// its primary key, unencrypted versions included. New versions are encrypted with the new primary
+// key as soon as the keyring is read. A rotation that fails halfway can simply be run again.
+func (es *EncryptedStore) RotateKeys(ctx context.Context) (KeyRotation, error) {
+	keyring, err := LoadKeyring(es.KeyringPath)
+	if err != nil {
+		return KeyRotation{}, err
+	}
+	es.mu.Lock()
+	es.keyring = keyring
+	es.mu.Unlock()
+
+	rotation := KeyRotation{Primary: keyring.Primary}
+	replacer, ok := es.Store.(SchemaReplacer)
+	if !ok {
+		return rotation, errors.New("the storage can't replace stored versions")
+	}
+
+	filenames, err := es.Store.ListSchemas(ctx)
+	if err != nil {
+		return rotation, err
+	}
+	for _, filename := range filenames {
+		versions, err := es.Store.ListVersions(ctx, filename)
+		if err != nil {
+			return rotation, err
+		}
+
+		for _, version := range versions {
+			rotation.Versions++
+
+			stored, err := es.Store.GetSchema(ctx, filename, version)
+			if err != nil {
+				if errors.Is(err, ErrSchemaNotFound) {
+					// deleted since it was listed
+					continue
+				}
+				return rotation, err
+			}
+			keyID, _, err := parseEncryptedHeader(stored)
+			if err != nil {
+				return rotation, fmt.Errorf("schema file '%s' version '%d': %v", filename, version, err)
+			}
+			if keyID == keyring.Primary {
+				continue
+			}
+
+			schemaFile, err := es.decrypt(stored, filename, version)
+			if err != nil {
+				return rotation, err
+			}
+			encrypted, err := es.encrypt(schemaFile, filename, version)
+			if err != nil {
+				return rotation, err
+			}
+			err = replacer.ReplaceSchema(ctx, encrypted, filename, version)
+			if err != nil {
+				if errors.Is(err, ErrSchemaNotFound) {
+					continue
+				}
+				return rotation, err
+			}
+			rotation.Reencrypted++
+		}
+	}
+
+	return rotation, nil
+}
+
+// encrypt seals the schema file with the primary key
+func (es *EncryptedStore) encrypt(schemaFile []byte, filename string, version int64) ([]byte, error) {
+	es.mu.RLock()
+	keyID := es.keyring.Primary
+	aead := es.keyring.keys[keyID]
+	es.mu.RUnlock()
+
+	header := append(append([]byte(nil), encryptedMagic...), byte(len(keyID)))
+	header = append(header, keyID...)
+
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, fmt.Errorf("failed to generate nonce: %v", err)
+	}
+
+	encrypted := append(header, nonce...)
+	return aead.Seal(encrypted, nonce, schemaFile, additionalData(header, filename, version)), nil
+}
+
+// decrypt opens a file sealed by encrypt, files without an encryption header are returned as they are
+func (es *EncryptedStore) decrypt(stored []byte, filename string, version int64) ([]byte, error) {
+	keyID, headerLen, err := parseEncryptedHeader(stored)
+	if err != nil {
+		return nil, fmt.Errorf("schema file '%s' version '%d': %v", filename, version, err)
+	}
+	if keyID == "" {
+		return stored, nil
+	}
+
+	es.mu.RLock()
+	aead, ok := es.keyring.keys[keyID]
+	es.mu.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("schema file '%s' version '%d' is encrypted with key '%s' which is not in the keyring", filename, version, keyID)
+	}
+
+	header := stored[:headerLen]
+	sealed := stored[headerLen:]
+	if len(sealed) < aead.NonceSize() {
+		return nil, fmt.Errorf("schema file '%s' version '%d' is truncated", filename, version)
+	}
+	nonce := sealed[:aead.NonceSize()]
+
+	schemaFile, err := aead.Open(nil, nonce, sealed[aead.NonceSize():], additionalData(header, filename, version))
+	if err != nil {
+		return nil, fmt.Errorf("failed to decrypt schema file '%s' version '%d': %v", filename, version, err)
+	}
+
+	return schemaFile, nil
+}
+
+// parseEncryptedHeader returns the key ID and the length of the header of an encrypted file, the key ID is empty for unencrypted files
+func parseEncryptedHeader(stored []byte) (string, int, error) {
+	if !bytes.HasPrefix(stored, encryptedMagic) {
+		return "", 0, nil
+	}
+	if len(stored) <= len(encryptedMagic) {
+		return "", 0, errors.New("encryption header is truncated")
+	}
+
+	keyIDLen := int(stored[len(encryptedMagic)])
+	headerLen := len(encryptedMagic) + 1 + keyIDLen
+	if keyIDLen == 0 || len(stored) < headerLen {
+		return "", 0, errors.New("encryption header is corrupted")
+	}
+
+	return string(stored[len(encryptedMagic)+1 : headerLen]), headerLen, nil
+}
+
+// additionalData authenticates the header and the location of an encrypted file along with its content
+func additionalData(header []byte, filename string, version int64) []byte {
+	data := append([]byte(nil), header...)
+	data = append(data, filename...)
+	data = append(data, 0)
+	return strconv.AppendInt(data, version, 10)
+}
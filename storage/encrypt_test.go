@@ -0,0 +1,150 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// writeKeyring writes a keyring file with a key per ID, derived from the ID, and returns its path
+func writeKeyring(t *testing.T, keyringPath string, primary string, keyIDs ...string) string {
+	t.Helper()
+
+	content := "primary: " + primary + "\nkeys:\n"
+	for _, keyID := range keyIDs {
+		key := bytes.Repeat([]byte(keyID), 32)[:32]
+		content += "  " + keyID + ": " + base64.StdEncoding.EncodeToString(key) + "\n"
+	}
+	if err := ioutil.WriteFile(keyringPath, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	return keyringPath
+}
+
+func TestEncryptedStore(t *testing.T) {
+	keyringPath := writeKeyring(t, filepath.Join(t.TempDir(), "keyring.yaml"), "k1", "k1")
+	encryptedStore, err := NewEncryptedStore(NewFileStore(t.TempDir()), keyringPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	testSchemaStore(t, encryptedStore)
+}
+
+func TestEncryptedStoreAuthenticatesContent(t *testing.T) {
+	ctx := context.Background()
+	memoryStore := NewMemoryStore()
+	keyringPath := writeKeyring(t, filepath.Join(t.TempDir(), "keyring.yaml"), "k1", "k1")
+	encryptedStore, err := NewEncryptedStore(memoryStore, keyringPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	content := []byte(`{"openapi": "3.0.1", "info": {"title": "unreleased"}}`)
+
+	for _, version := range []int64{1, 2} {
+		if err := encryptedStore.SaveSchema(ctx, content, "dummy.json", "json", version); err != nil {
+			t.Fatal(err)
+		}
+	}
+	stored, err := memoryStore.GetSchema(ctx, "dummy.json", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(stored, []byte("unreleased")) {
+		t.Errorf("expected the stored file to be encrypted but got '%s'", stored)
+	}
+
+	// A version can't be passed off as another one
+	if err := memoryStore.ReplaceSchema(ctx, stored, "dummy.json", 2); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := encryptedStore.GetSchema(ctx, "dummy.json", 2); err == nil {
+		t.Error("expected a version copied over another one to fail to decrypt")
+	}
+
+	// Modified files fail to decrypt
+	stored[len(stored)-1] ^= 1
+	if err := memoryStore.ReplaceSchema(ctx, stored, "dummy.json", 1); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := encryptedStore.GetSchema(ctx, "dummy.json", 1); err == nil {
+		t.Error("expected a modified file to fail to decrypt")
+	}
+}
+
+func TestEncryptedStoreRotateKeys(t *testing.T) {
+	ctx := context.Background()
+	keyringPath := filepath.Join(t.TempDir(), "keyring.yaml")
+	writeKeyring(t, keyringPath, "k1", "k1")
+	fileStore := &FileStore{BasePath: t.TempDir(), SnapshotInterval: 2}
+
+	// Version 1 was saved before encryption was enabled, it is the base of the delta of version 2
+	lines := strings.Repeat("line\n", 100)
+	contents := [][]byte{[]byte(lines + "v1\n"), []byte(lines + "v2\n"), []byte(lines + "v3\n")}
+	if err := fileStore.SaveSchema(ctx, contents[0], "dummy.yaml", "yaml", 1); err != nil {
+		t.Fatal(err)
+	}
+	if err := fileStore.SaveSchema(ctx, contents[1], "dummy.yaml", "yaml", 2); err != nil {
+		t.Fatal(err)
+	}
+	encryptedStore, err := NewEncryptedStore(fileStore, keyringPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := encryptedStore.SaveSchema(ctx, contents[2], "dummy.yaml", "yaml", 3); err != nil {
+		t.Fatal(err)
+	}
+
+	writeKeyring(t, keyringPath, "k2", "k1", "k2")
+	rotation, err := encryptedStore.RotateKeys(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rotation.Primary != "k2" || rotation.Versions != 3 || rotation.Reencrypted != 3 {
+		t.Errorf("expected 3 versions re-encrypted with k2 but got %+v", rotation)
+	}
+
+	// Once every version is encrypted with the new key, the old one is not needed anymore
+	writeKeyring(t, keyringPath, "k2", "k2")
+	rotation, err = encryptedStore.RotateKeys(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rotation.Reencrypted != 0 {
+		t.Errorf("expected nothing to re-encrypt but got %+v", rotation)
+	}
+	for i, content := range contents {
+		version := int64(i + 1)
+		keyID, err := encryptedStore.KeyID(ctx, "dummy.yaml", version)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if keyID != "k2" {
+			t.Errorf("expected version %d to be encrypted with k2 but got '%s'", version, keyID)
+		}
+		got, err := encryptedStore.GetSchema(ctx, "dummy.yaml", version)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, content) {
+			t.Errorf("expected version %d to be '%s' but got '%s'", version, content, got)
+		}
+	}
+}
+
+func TestParseKeyring(t *testing.T) {
+	for name, content := range map[string]string{
+		"missing primary": "primary: k2\nkeys:\n  k1: " + base64.StdEncoding.EncodeToString(make([]byte, 32)),
+		"short key":       "primary: k1\nkeys:\n  k1: " + base64.StdEncoding.EncodeToString(make([]byte, 8)),
+		"not base64":      "primary: k1\nkeys:\n  k1: '%%%'",
+		"unknown field":   "primary: k1\nkey: {}",
+	} {
+		if _, err := ParseKeyring([]byte(content)); err == nil {
+			t.Errorf("expected the keyring with a %s to be rejected", name)
+		}
+	}
+}
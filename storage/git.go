@@ -0,0 +1,364 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// gitVersionRefs is the namespace of the refs naming the commit of every version
+const gitVersionRefs = "refs/schemas/"
+
+// GitStore stores the schema files in a local bare git repository. Every schema file is a file at
+// the root of the tree of the branch, and every uploaded version is a commit changing it, so
+// "git log" and "git blame" show the history of a schema, and the repository can be mirrored with
+// "git push --mirror". The commit of a version is named by the ref
+// "refs/schemas/<filename>/<version>", which the store reads versions through.
+//
+// Deleting a version removes its ref and commits the content of the previous remaining version,
+// the deleted content stays in the history. Git is run as a command, it must be installed.
+type GitStore struct {
+	// RepoPath is the path of the bare repository
+	RepoPath string
+	// Branch is the branch the versions are committed to
+	Branch string
+	// AuthorName and AuthorEmail are the identity of the commits
+	AuthorName  string
+	AuthorEmail string
+
+	mu sync.Mutex
+}
+
+var _ SchemaStore = (*GitStore)(nil)
+
+// gitTreeEntry is an entry of "git ls-tree" output
+type gitTreeEntry struct {
+	mode, objectType, object, name string
+}
+
+// NewGitStore creates a store committing to the "main" branch of the bare repository, which is created if needed
+func NewGitStore(repoPath string) (*GitStore, error) {
+	gs := &GitStore{
+		RepoPath:    repoPath,
+		Branch:      "main",
+		AuthorName:  "Levo Schema Registry",
+		AuthorEmail: "schema-registry@localhost",
+	}
+
+	if _, err := os.Stat(repoPath); os.IsNotExist(err) {
+		_, err = exec.Command("git", "init", "--quiet", "--bare", repoPath).CombinedOutput()
+		if err != nil {
+			return nil, fmt.Errorf("failed to create git repository: %v", err)
+		}
+		_, err = gs.git(context.Background(), nil, "symbolic-ref", "HEAD", "refs/heads/"+gs.Branch)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if _, err := gs.git(context.Background(), nil, "rev-parse", "--git-dir"); err != nil {
+		return nil, err
+	}
+
+	return gs, nil
+}
+
+// SaveSchema commits the schema file to the branch and creates the ref of the version
+func (gs *GitStore) SaveSchema(ctx context.Context, schemaFile []byte, filename string, filetype string, version int64) error {
+	if err := checkName(filename); err != nil {
+		return err
+	}
+	gs.mu.Lock()
+	defer gs.mu.Unlock()
+
+	exists, err := gs.SchemaExists(ctx, filename, version)
+	if err != nil {
+		return err
+	}
+	if exists {
+		return fmt.Errorf("schema file '%s' version '%d': %w", filename, version, ErrVersionExists)
+	}
+
+	blob, err := gs.gitLine(ctx, schemaFile, "hash-object", "-w", "--stdin")
+	if err != nil {
+		return fmt.Errorf("failed to save schema file: %v", err)
+	}
+
+	sum := sha256.Sum256(schemaFile)
+	message := fmt.Sprintf("Upload %s version %d\n\nSchema: %s\nVersion: %d\nFile-Type: %s\nChecksum: sha256:%s\n",
+		filename, version, filename, version, filetype, hex.EncodeToString(sum[:]))
+	commit, err := gs.commitFile(ctx, filename, blob, message, gitVersionRef(filename, version))
+	if err != nil {
+		return fmt.Errorf("failed to save schema file: %v", err)
+	}
+	if commit == "" {
+		return fmt.Errorf("schema file '%s' version '%d': %w", filename, version, ErrVersionExists)
+	}
+
+	return nil
+}
+
+// GetSchema reads the file of the version from the commit its ref names
+func (gs *GitStore) GetSchema(ctx context.Context, filename string, version int64) ([]byte, error) {
+	if err := checkStoredName(ctx, filename); err != nil {
+		return nil, err
+	}
+	blob, err := gs.gitLine(ctx, nil, "rev-parse", "--quiet", "--verify", gitVersionRef(filename, version)+":"+filename)
+	if err != nil {
+		var exitErr *exec.ExitError
+		if errors.As(err, &exitErr) && exitErr.ExitCode() == 1 {
+			return nil, fmt.Errorf("schema file '%s' version '%d' does not exist: %w", filename, version, ErrSchemaNotFound)
+		}
+		return nil, fmt.Errorf("failed to read schema file: %v", err)
+	}
+
+	schemaFile, err := gs.git(ctx, nil, "cat-file", "blob", blob)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read schema file: %v", err)
+	}
+
+	return schemaFile, nil
+}
+
+// DeleteSchema removes the ref of the version and commits the content of the latest remaining
+// version of the schema file, or removes the file if no version remains
+func (gs *GitStore) DeleteSchema(ctx context.Context, filename string, version int64) error {
+	if err := checkStoredName(ctx, filename); err != nil {
+		return err
+	}
+	gs.mu.Lock()
+	defer gs.mu.Unlock()
+
+	exists, err := gs.SchemaExists(ctx, filename, version)
+	if err != nil || !exists {
+		return err
+	}
+
+	versions, err := gs.ListVersions(ctx, filename)
+	if err != nil {
+		return err
+	}
+	blob := ""
+	for i := len(versions) - 1; i >= 0; i-- {
+		if versions[i] == version {
+			continue
+		}
+		blob, err = gs.gitLine(ctx, nil, "rev-parse", "--verify", gitVersionRef(filename, versions[i])+":"+filename)
+		if err != nil {
+			return fmt.Errorf("failed to delete schema: %v", err)
+		}
+		break
+	}
+
+	message := fmt.Sprintf("Delete %s version %d\n\nSchema: %s\nVersion: %d\n", filename, version, filename, version)
+	_, err = gs.commitFile(ctx, filename, blob, message, "")
+	if err != nil {
+		return fmt.Errorf("failed to delete schema: %v", err)
+	}
+
+	_, err = gs.git(ctx, nil, "update-ref", "-d", gitVersionRef(filename, version))
+	if err != nil {
+		return fmt.Errorf("failed to delete schema: %v", err)
+	}
+
+	return nil
+}
+
+// ListSchemas lists the schema files that have version refs
+func (gs *GitStore) ListSchemas(ctx context.Context) ([]string, error) {
+	refs, err := gs.listRefs(ctx, gitVersionRefs)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list schemas: %v", err)
+	}
+
+	seen := map[string]bool{}
+	filenames := []string{}
+	for _, ref := range refs {
+		slash := strings.LastIndex(ref, "/")
+		if slash < 0 || seen[ref[:slash]] || checkStoredName(ctx, ref[:slash]) != nil {
+			continue
+		}
+		seen[ref[:slash]] = true
+		filenames = append(filenames, ref[:slash])
+	}
+	sort.Strings(filenames)
+
+	return filenames, nil
+}
+
+// ListVersions lists the versions that have a ref
+func (gs *GitStore) ListVersions(ctx context.Context, filename string) ([]int64, error) {
+	if err := checkStoredName(ctx, filename); err != nil {
+		return nil, err
+	}
+	refs, err := gs.listRefs(ctx, gitVersionRefs+filename+"/")
+	if err != nil {
+		return nil, fmt.Errorf("failed to list schema versions: %v", err)
+	}
+
+	versions := []int64{}
+	for _, ref := range refs {
+		version, err := strconv.ParseInt(ref, 10, 64)
+		if err != nil {
+			// not a version ref
+			continue
+		}
+		versions = append(versions, version)
+	}
+	sort.Slice(versions, func(i, j int) bool { return versions[i] < versions[j] })
+
+	return versions, nil
+}
+
+// SchemaExists checks whether the version has a ref
+func (gs *GitStore) SchemaExists(ctx context.Context, filename string, version int64) (bool, error) {
+	if err := checkStoredName(ctx, filename); err != nil {
+		return false, err
+	}
+	_, err := gs.git(ctx, nil, "rev-parse", "--quiet", "--verify", gitVersionRef(filename, version)+"^{commit}")
+	if err != nil {
+		var exitErr *exec.ExitError
+		if errors.As(err, &exitErr) && exitErr.ExitCode() == 1 {
+			return false, nil
+		}
+		return false, fmt.Errorf("failed to check schema file: %v", err)
+	}
+
+	return true, nil
+}
+
+// commitFile commits the tree of the branch with the file set to the blob, or removed if the blob
+// is empty, and moves the branch to the commit. If versionRef is set, the ref is created for the
+// commit in the same transaction, and the branch is not moved if it exists. It returns the commit, or an
+// empty string if versionRef exists. The caller must hold mu.
+func (gs *GitStore) commitFile(ctx context.Context, filename string, blob string, message string, versionRef string) (string, error) {
+	branchRef := "refs/heads/" + gs.Branch
+	parent := ""
+	if commit, err := gs.gitLine(ctx, nil, "rev-parse", "--quiet", "--verify", branchRef+"^{commit}"); err == nil {
+		parent = commit
+	}
+
+	var entries []gitTreeEntry
+	if parent != "" {
+		listing, err := gs.git(ctx, nil, "ls-tree", "-z", parent)
+		if err != nil {
+			return "", err
+		}
+		for _, line := range strings.Split(strings.TrimSuffix(string(listing), "\x00"), "\x00") {
+			if line == "" {
+				continue
+			}
+			var entry gitTreeEntry
+			meta, name, _ := strings.Cut(line, "\t")
+			fields := strings.Fields(meta)
+			if len(fields) != 3 {
+				return "", fmt.Errorf("unexpected ls-tree output '%s'", line)
+			}
+			entry.mode, entry.objectType, entry.object, entry.name = fields[0], fields[1], fields[2], name
+			if entry.name != filename {
+				entries = append(entries, entry)
+			}
+		}
+	}
+	if blob != "" {
+		entries = append(entries, gitTreeEntry{mode: "100644", objectType: "blob", object: blob, name: filename})
+	}
+
+	var treeInput bytes.Buffer
+	for _, entry := range entries {
+		fmt.Fprintf(&treeInput, "%s %s %s\t%s\x00", entry.mode, entry.objectType, entry.object, entry.name)
+	}
+	tree, err := gs.gitLine(ctx, treeInput.Bytes(), "mktree", "-z")
+	if err != nil {
+		return "", err
+	}
+
+	args := []string{"commit-tree", tree, "-m", message}
+	if parent != "" {
+		args = append(args, "-p", parent)
+	}
+	commit, err := gs.gitLine(ctx, nil, args...)
+	if err != nil {
+		return "", err
+	}
+
+	// Both refs are updated atomically, the branch only if it didn't move and the version ref only if it doesn't exist
+	zero := strings.Repeat("0", len(commit))
+	oldParent := parent
+	if oldParent == "" {
+		oldParent = zero
+	}
+	updates := fmt.Sprintf("update %s %s %s\n", branchRef, commit, oldParent)
+	if versionRef != "" {
+		updates += fmt.Sprintf("create %s %s\n", versionRef, commit)
+	}
+	_, err = gs.git(ctx, []byte(updates), "update-ref", "--stdin")
+	if err != nil {
+		if versionRef != "" && strings.Contains(err.Error(), "already exists") {
+			return "", nil
+		}
+		return "", err
+	}
+
+	return commit, nil
+}
+
+// listRefs lists the names of the refs under the prefix, without the prefix
+func (gs *GitStore) listRefs(ctx context.Context, prefix string) ([]string, error) {
+	output, err := gs.git(ctx, nil, "for-each-ref", "--format=%(refname)", prefix)
+	if err != nil {
+		return nil, err
+	}
+
+	var refs []string
+	for _, ref := range strings.Split(string(output), "\n") {
+		if ref != "" {
+			refs = append(refs, strings.TrimPrefix(ref, prefix))
+		}
+	}
+
+	return refs, nil
+}
+
+// gitLine runs a git command printing a single line, like an object name, and returns the line
+func (gs *GitStore) gitLine(ctx context.Context, stdin []byte, args ...string) (string, error) {
+	output, err := gs.git(ctx, stdin, args...)
+	return strings.TrimSpace(string(output)), err
+}
+
+// git runs a git command on the repository with the given standard input and returns its output
+func (gs *GitStore) git(ctx context.Context, stdin []byte, args ...string) ([]byte, error) {
+	cmd := exec.CommandContext(ctx, "git", append([]string{"--git-dir", gs.RepoPath}, args...)...)
+	cmd.Env = append(os.Environ(),
+		"GIT_AUTHOR_NAME="+gs.AuthorName, "GIT_AUTHOR_EMAIL="+gs.AuthorEmail,
+		"GIT_COMMITTER_NAME="+gs.AuthorName, "GIT_COMMITTER_EMAIL="+gs.AuthorEmail,
+	)
+	if stdin != nil {
+		cmd.Stdin = bytes.NewReader(stdin)
+	}
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+
+	output, err := cmd.Output()
+	if err != nil {
+		if stderr.Len() > 0 {
+			return nil, fmt.Errorf("git %s: %w: %s", args[0], err, strings.TrimSpace(stderr.String()))
+		}
+		return nil, fmt.Errorf("git %s: %w", args[0], err)
+	}
+
+	return output, nil
+}
+
+// gitVersionRef returns the ref of the commit of a version
+func gitVersionRef(filename string, version int64) string {
+	return gitVersionRefs + filename + "/" + strconv.FormatInt(version, 10)
+}
@@ -0,0 +1,73 @@
+package storage
+
+import (
+	"context"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func newTestGitStore(t *testing.T) *GitStore {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git is not installed")
+	}
+
+	gitStore, err := NewGitStore(filepath.Join(t.TempDir(), "schemas.git"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return gitStore
+}
+
+func TestGitStore(t *testing.T) {
+	testSchemaStore(t, newTestGitStore(t))
+}
+
+func TestGitStoreHistory(t *testing.T) {
+	ctx := context.Background()
+	gitStore := newTestGitStore(t)
+
+	for version, content := range []string{"openapi: 3.0.0\n", "openapi: 3.0.1\n", "openapi: 3.1.0\n"} {
+		if err := gitStore.SaveSchema(ctx, []byte(content), "dummy.yaml", "yaml", int64(version+1)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := gitStore.SaveSchema(ctx, []byte("{}"), "other.json", "json", 1); err != nil {
+		t.Fatal(err)
+	}
+
+	// Deleting the latest version brings the previous one back on the branch
+	if err := gitStore.DeleteSchema(ctx, "dummy.yaml", 3); err != nil {
+		t.Fatal(err)
+	}
+
+	log, err := gitStore.git(ctx, nil, "log", "--format=%s", "main", "--", "dummy.yaml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := "Delete dummy.yaml version 3\nUpload dummy.yaml version 3\nUpload dummy.yaml version 2\nUpload dummy.yaml version 1\n"
+	if string(log) != expected {
+		t.Errorf("expected history\n%s\nbut got\n%s", expected, log)
+	}
+
+	message, err := gitStore.git(ctx, nil, "log", "-1", "--format=%B", gitVersionRef("dummy.yaml", 2))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(message), "Version: 2\nFile-Type: yaml\nChecksum: sha256:") {
+		t.Errorf("expected the upload metadata in the commit message but got '%s'", message)
+	}
+
+	latest, err := gitStore.git(ctx, nil, "show", "main:dummy.yaml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(latest) != "openapi: 3.0.1\n" {
+		t.Errorf("expected version 2 on the branch but got '%s'", latest)
+	}
+	other, err := gitStore.GetSchema(ctx, "other.json", 1)
+	if err != nil || string(other) != "{}" {
+		t.Errorf("expected the other schema to be kept, got '%s' and %v", other, err)
+	}
+}
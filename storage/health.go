@@ -0,0 +1,70 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// WriteChecker is implemented by the stores that can check that new versions can be saved
+type WriteChecker interface {
+	// CheckWritable fails if a version couldn't be saved now, e.g. if the storage directory is read-only
+	CheckWritable(ctx context.Context) error
+}
+
+var _ WriteChecker = (*FileStore)(nil)
+var _ WriteChecker = (*BlobStore)(nil)
+var _ WriteChecker = (*GitStore)(nil)
+var _ WriteChecker = (*UploadSessions)(nil)
+
+// CheckWritable checks the first store implementing WriteChecker in the chain of wrapped stores,
+// stores that can't be checked are assumed to be writable
+func CheckWritable(ctx context.Context, store SchemaStore) error {
+	for ; store != nil; store = Unwrap(store) {
+		if checker, ok := store.(WriteChecker); ok {
+			return checker.CheckWritable(ctx)
+		}
+	}
+
+	return nil
+}
+
+// CheckWritable checks that files can be created in the base directory
+func (fs *FileStore) CheckWritable(ctx context.Context) error {
+	return checkDirWritable(ctx, fs.BasePath)
+}
+
+// CheckWritable checks that files can be created in the base directory
+func (bs *BlobStore) CheckWritable(ctx context.Context) error {
+	return checkDirWritable(ctx, bs.BasePath)
+}
+
+// CheckWritable checks that objects can be created in the repository
+func (gs *GitStore) CheckWritable(ctx context.Context) error {
+	return checkDirWritable(ctx, filepath.Join(gs.RepoPath, "objects"))
+}
+
+// CheckWritable checks that chunks can be saved in the upload directory
+func (us *UploadSessions) CheckWritable(ctx context.Context) error {
+	return checkDirWritable(ctx, us.Dir)
+}
+
+// checkDirWritable creates and removes a temp file in dirPath, creating dirPath if needed. The
+// temp file is removed with the other temp files if the check is interrupted by a crash.
+func checkDirWritable(ctx context.Context, dirPath string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	err := os.MkdirAll(dirPath, 0755)
+	if err != nil {
+		return fmt.Errorf("directory '%s' can't be created: %v", dirPath, err)
+	}
+	tmpPath, err := writeTempFile(dirPath, filepath.Join(dirPath, "write-check"), nil)
+	if err != nil {
+		return fmt.Errorf("directory '%s' is not writable: %v", dirPath, err)
+	}
+
+	return os.Remove(tmpPath)
+}
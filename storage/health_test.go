@@ -0,0 +1,38 @@
+package storage
+
+import (
+	"context"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+)
+
+func TestCheckWritable(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+
+	// The base directory is created if it doesn't exist yet, through the wrapping stores
+	fileStore := NewFileStore(filepath.Join(dir, "schemas"))
+	compressedStore, err := NewCompressedStore(fileStore, CompressionGzip)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := CheckWritable(ctx, compressedStore); err != nil {
+		t.Errorf("expected the storage to be writable: %v", err)
+	}
+	if entries, _ := ioutil.ReadDir(fileStore.BasePath); len(entries) != 0 {
+		t.Errorf("expected the check to leave no file but found %d", len(entries))
+	}
+
+	// A base path under a file can't be created, even by root
+	if err := ioutil.WriteFile(filepath.Join(dir, "file"), nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := CheckWritable(ctx, NewBlobStore(filepath.Join(dir, "file", "schemas"))); err == nil {
+		t.Error("expected a storage under a file not to be writable")
+	}
+
+	if err := CheckWritable(ctx, NewMemoryStore()); err != nil {
+		t.Errorf("expected the memory storage to be writable: %v", err)
+	}
+}
@@ -0,0 +1,162 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+)
+
+// MemoryStore is a thread-safe in-memory schema store, useful for tests and embedding
+type MemoryStore struct {
+	mu      sync.RWMutex
+	schemas map[string]map[int64][]byte
+}
+
+var _ SchemaStore = (*MemoryStore)(nil)
+var _ SchemaReplacer = (*MemoryStore)(nil)
+
+// NewMemoryStore creates a new empty in-memory store
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{schemas: make(map[string]map[int64][]byte)}
+}
+
+// SaveSchema stores a copy of the schema file in memory, stored versions are never overwritten
+func (ms *MemoryStore) SaveSchema(ctx context.Context, schemaFile []byte, filename string, filetype string, version int64) error {
+	if err := checkName(filename); err != nil {
+		return err
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	versions, ok := ms.schemas[filename]
+	if !ok {
+		versions = make(map[int64][]byte)
+		ms.schemas[filename] = versions
+	}
+	if _, ok := versions[version]; ok {
+		return fmt.Errorf("schema file '%s' version '%d': %w", filename, version, ErrVersionExists)
+	}
+	versions[version] = append([]byte(nil), schemaFile...)
+
+	return nil
+}
+
+// GetSchema returns a copy of the stored schema file
+func (ms *MemoryStore) GetSchema(ctx context.Context, filename string, version int64) ([]byte, error) {
+	if err := checkStoredName(ctx, filename); err != nil {
+		return nil, err
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	ms.mu.RLock()
+	defer ms.mu.RUnlock()
+
+	schemaFile, ok := ms.schemas[filename][version]
+	if !ok {
+		return nil, fmt.Errorf("schema file '%s' version '%d' does not exist: %w", filename, version, ErrSchemaNotFound)
+	}
+
+	return append([]byte(nil), schemaFile...), nil
+}
+
+// ReplaceSchema replaces the stored copy of a schema file
+func (ms *MemoryStore) ReplaceSchema(ctx context.Context, schemaFile []byte, filename string, version int64) error {
+	if err := checkName(filename); err != nil {
+		return err
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	if _, ok := ms.schemas[filename][version]; !ok {
+		return fmt.Errorf("schema file '%s' version '%d' does not exist: %w", filename, version, ErrSchemaNotFound)
+	}
+	ms.schemas[filename][version] = append([]byte(nil), schemaFile...)
+
+	return nil
+}
+
+// DeleteSchema removes the schema file from memory, deleting a missing version is not an error
+func (ms *MemoryStore) DeleteSchema(ctx context.Context, filename string, version int64) error {
+	if err := checkStoredName(ctx, filename); err != nil {
+		return err
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	delete(ms.schemas[filename], version)
+	if len(ms.schemas[filename]) == 0 {
+		delete(ms.schemas, filename)
+	}
+
+	return nil
+}
+
+// ListSchemas returns the names of the schema files in memory in ascending order
+func (ms *MemoryStore) ListSchemas(ctx context.Context) ([]string, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	ms.mu.RLock()
+	defer ms.mu.RUnlock()
+
+	filenames := make([]string, 0, len(ms.schemas))
+	for filename := range ms.schemas {
+		filenames = append(filenames, filename)
+	}
+	sort.Strings(filenames)
+
+	return filenames, nil
+}
+
+// ListVersions returns the stored versions of the schema file in ascending order
+func (ms *MemoryStore) ListVersions(ctx context.Context, filename string) ([]int64, error) {
+	if err := checkStoredName(ctx, filename); err != nil {
+		return nil, err
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	ms.mu.RLock()
+	defer ms.mu.RUnlock()
+
+	versions := make([]int64, 0, len(ms.schemas[filename]))
+	for version := range ms.schemas[filename] {
+		versions = append(versions, version)
+	}
+	sort.Slice(versions, func(i, j int) bool { return versions[i] < versions[j] })
+
+	return versions, nil
+}
+
+// SchemaExists reports whether the version of the schema file is stored
+func (ms *MemoryStore) SchemaExists(ctx context.Context, filename string, version int64) (bool, error) {
+	if err := checkStoredName(ctx, filename); err != nil {
+		return false, err
+	}
+	if err := ctx.Err(); err != nil {
+		return false, err
+	}
+
+	ms.mu.RLock()
+	defer ms.mu.RUnlock()
+
+	_, ok := ms.schemas[filename][version]
+	return ok, nil
+}
@@ -0,0 +1,457 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// S3Store stores the schema files as objects of a bucket of an S3-compatible object storage, so
+// several replicas of the server can share them. Every version is an object named
+// "<prefix><filename>/<version>", with the file type as its content type. Buckets are addressed
+// path-style (<endpoint>/<bucket>/<key>), which AWS S3 as well as MinIO and most other
+// S3-compatible storages support.
+//
+// Versions are written with "If-None-Match: *", so the storage refuses to overwrite them, on
+// storages that don't support conditional writes the version allocation of the database is the
+// only protection.
+type S3Store struct {
+	// Endpoint is the URL of the storage, like https://s3.eu-west-1.amazonaws.com or http://localhost:9000
+	Endpoint string
+	Bucket   string
+	// Prefix is prepended to the object keys, so that a bucket can be shared
+	Prefix string
+	Region string
+	// MaxSize bounds the size of the objects read, so that a tampered object can't exhaust the
+	// memory of the server, 0 reads objects of any size
+	MaxSize int64
+
+	// Requests are signed with AWS signature version 4 when the access key is set, and sent anonymously otherwise
+	AccessKeyID     string
+	SecretAccessKey string
+	SessionToken    string
+
+	Client *http.Client
+}
+
+var _ SchemaStore = (*S3Store)(nil)
+var _ SchemaReplacer = (*S3Store)(nil)
+
+// ErrObjectTooLarge is returned when a stored object is larger than the maximum size of the store
+var ErrObjectTooLarge = errors.New("stored object is larger than the maximum size")
+
+// MaxStoredSize returns the maximum size of the stored file of a version of at most maxSize bytes,
+// leaving room for the header of the encryption and the framing of the compression
+func MaxStoredSize(maxSize int64) int64 {
+	return maxSize + maxSize/1000 + 4<<10
+}
+
+// NewS3Store creates a store for the bucket of the storage at the endpoint and region. An empty
+// region is read from the AWS_REGION environment variable and defaults to us-east-1, the
+// credentials are read from the AWS_ACCESS_KEY_ID, AWS_SECRET_ACCESS_KEY and AWS_SESSION_TOKEN
+// environment variables.
+func NewS3Store(endpoint string, bucket string, prefix string, region string) *S3Store {
+	if region == "" {
+		region = os.Getenv("AWS_REGION")
+	}
+	if region == "" {
+		region = "us-east-1"
+	}
+	if prefix != "" && !strings.HasSuffix(prefix, "/") {
+		prefix += "/"
+	}
+
+	return &S3Store{
+		Endpoint:        strings.TrimSuffix(endpoint, "/"),
+		Bucket:          bucket,
+		Prefix:          prefix,
+		Region:          region,
+		AccessKeyID:     os.Getenv("AWS_ACCESS_KEY_ID"),
+		SecretAccessKey: os.Getenv("AWS_SECRET_ACCESS_KEY"),
+		SessionToken:    os.Getenv("AWS_SESSION_TOKEN"),
+		Client:          &http.Client{Timeout: time.Minute},
+	}
+}
+
+// s3Error is the error document returned by the storage
+type s3Error struct {
+	Code    string `xml:"Code"`
+	Message string `xml:"Message"`
+}
+
+// listBucketResult is the result document of ListObjectsV2
+type listBucketResult struct {
+	IsTruncated           bool   `xml:"IsTruncated"`
+	NextContinuationToken string `xml:"NextContinuationToken"`
+	Contents              []struct {
+		Key string `xml:"Key"`
+	} `xml:"Contents"`
+	CommonPrefixes []struct {
+		Prefix string `xml:"Prefix"`
+	} `xml:"CommonPrefixes"`
+}
+
+// SaveSchema uploads the schema file as the object of the version, unless the object exists
+func (s3 *S3Store) SaveSchema(ctx context.Context, schemaFile []byte, filename string, filetype string, version int64) error {
+	if err := checkName(filename); err != nil {
+		return err
+	}
+	header := http.Header{}
+	header.Set("Content-Type", "application/"+filetype)
+	header.Set("If-None-Match", "*")
+
+	resp, err := s3.do(ctx, http.MethodPut, s3.versionKey(filename, version), nil, header, schemaFile)
+	if err != nil {
+		return fmt.Errorf("failed to save schema file: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusPreconditionFailed {
+		return fmt.Errorf("schema file '%s' version '%d': %w", filename, version, ErrVersionExists)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("failed to save schema file: %v", readS3Error(resp))
+	}
+
+	return nil
+}
+
+// GetSchema downloads the object of the version
+func (s3 *S3Store) GetSchema(ctx context.Context, filename string, version int64) ([]byte, error) {
+	if err := checkStoredName(ctx, filename); err != nil {
+		return nil, err
+	}
+	resp, err := s3.do(ctx, http.MethodGet, s3.versionKey(filename, version), nil, nil, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read schema file: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, fmt.Errorf("schema file '%s' version '%d' does not exist: %w", filename, version, ErrSchemaNotFound)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("failed to read schema file: %v", readS3Error(resp))
+	}
+
+	body := io.Reader(resp.Body)
+	if s3.MaxSize > 0 {
+		body = io.LimitReader(resp.Body, s3.MaxSize+1)
+	}
+	schemaFile, err := ioutil.ReadAll(body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read schema file: %v", err)
+	}
+	if s3.MaxSize > 0 && int64(len(schemaFile)) > s3.MaxSize {
+		return nil, fmt.Errorf("schema file '%s' version '%d': %w", filename, version, ErrObjectTooLarge)
+	}
+
+	return schemaFile, nil
+}
+
+// ReplaceSchema overwrites the object of a stored version
+func (s3 *S3Store) ReplaceSchema(ctx context.Context, schemaFile []byte, filename string, version int64) error {
+	if err := checkName(filename); err != nil {
+		return err
+	}
+	resp, err := s3.do(ctx, http.MethodHead, s3.versionKey(filename, version), nil, nil, nil)
+	if err != nil {
+		return fmt.Errorf("failed to replace schema file: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return fmt.Errorf("schema file '%s' version '%d' does not exist: %w", filename, version, ErrSchemaNotFound)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("failed to replace schema file: %s", resp.Status)
+	}
+
+	header := http.Header{}
+	header.Set("Content-Type", resp.Header.Get("Content-Type"))
+	resp, err = s3.do(ctx, http.MethodPut, s3.versionKey(filename, version), nil, header, schemaFile)
+	if err != nil {
+		return fmt.Errorf("failed to replace schema file: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("failed to replace schema file: %v", readS3Error(resp))
+	}
+
+	return nil
+}
+
+// DeleteSchema deletes the object of the version, deleting a missing version is not an error
+func (s3 *S3Store) DeleteSchema(ctx context.Context, filename string, version int64) error {
+	if err := checkStoredName(ctx, filename); err != nil {
+		return err
+	}
+	resp, err := s3.do(ctx, http.MethodDelete, s3.versionKey(filename, version), nil, nil, nil)
+	if err != nil {
+		return fmt.Errorf("failed to delete schema: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusNoContent && resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusNotFound {
+		return fmt.Errorf("failed to delete schema: %v", readS3Error(resp))
+	}
+
+	return nil
+}
+
+// ListSchemas lists the schema files that have objects under the prefix
+func (s3 *S3Store) ListSchemas(ctx context.Context) ([]string, error) {
+	filenames := []string{}
+	err := s3.listObjects(ctx, s3.Prefix, func(result listBucketResult) {
+		for _, commonPrefix := range result.CommonPrefixes {
+			filename := strings.TrimSuffix(strings.TrimPrefix(commonPrefix.Prefix, s3.Prefix), "/")
+			if checkStoredName(ctx, filename) != nil {
+				// not written by the store
+				continue
+			}
+			filenames = append(filenames, filename)
+		}
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to list schemas: %v", err)
+	}
+	sort.Strings(filenames)
+
+	return filenames, nil
+}
+
+// ListVersions lists the versions of the objects of the schema file
+func (s3 *S3Store) ListVersions(ctx context.Context, filename string) ([]int64, error) {
+	if err := checkStoredName(ctx, filename); err != nil {
+		return nil, err
+	}
+	prefix := s3.Prefix + filename + "/"
+	versions := []int64{}
+	err := s3.listObjects(ctx, prefix, func(result listBucketResult) {
+		for _, object := range result.Contents {
+			version, err := strconv.ParseInt(strings.TrimPrefix(object.Key, prefix), 10, 64)
+			if err != nil {
+				// not a version object
+				continue
+			}
+			versions = append(versions, version)
+		}
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to list schema versions: %v", err)
+	}
+	sort.Slice(versions, func(i, j int) bool { return versions[i] < versions[j] })
+
+	return versions, nil
+}
+
+// SchemaExists checks whether the object of the version exists
+func (s3 *S3Store) SchemaExists(ctx context.Context, filename string, version int64) (bool, error) {
+	if err := checkStoredName(ctx, filename); err != nil {
+		return false, err
+	}
+	resp, err := s3.do(ctx, http.MethodHead, s3.versionKey(filename, version), nil, nil, nil)
+	if err != nil {
+		return false, fmt.Errorf("failed to check schema file: %v", err)
+	}
+	resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return true, nil
+	case http.StatusNotFound:
+		return false, nil
+	default:
+		return false, fmt.Errorf("failed to check schema file: %s", resp.Status)
+	}
+}
+
+// versionKey returns the object key of a version
+func (s3 *S3Store) versionKey(filename string, version int64) string {
+	return s3.Prefix + filename + "/" + strconv.FormatInt(version, 10)
+}
+
+// listObjects calls ListObjectsV2 for the objects under the prefix, one level deep, and passes every page of results to fn
+func (s3 *S3Store) listObjects(ctx context.Context, prefix string, fn func(listBucketResult)) error {
+	query := url.Values{}
+	query.Set("list-type", "2")
+	query.Set("prefix", prefix)
+	query.Set("delimiter", "/")
+
+	for {
+		resp, err := s3.do(ctx, http.MethodGet, "", query, nil, nil)
+		if err != nil {
+			return err
+		}
+		if resp.StatusCode != http.StatusOK {
+			err = readS3Error(resp)
+			resp.Body.Close()
+			return err
+		}
+
+		var result listBucketResult
+		err = xml.NewDecoder(resp.Body).Decode(&result)
+		resp.Body.Close()
+		if err != nil {
+			return fmt.Errorf("failed to parse object list: %v", err)
+		}
+		fn(result)
+
+		if !result.IsTruncated || result.NextContinuationToken == "" {
+			return nil
+		}
+		query.Set("continuation-token", result.NextContinuationToken)
+	}
+}
+
+// do sends a signed request for the object key of the bucket, or for the bucket itself if the key is empty
+func (s3 *S3Store) do(ctx context.Context, method string, key string, query url.Values, header http.Header, body []byte) (*http.Response, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	objectPath := "/" + s3.Bucket
+	if key != "" {
+		objectPath += "/" + key
+	}
+	rawURL := s3.Endpoint + s3EscapePath(objectPath)
+	if len(query) > 0 {
+		rawURL += "?" + s3CanonicalQuery(query)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, rawURL, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	for name, values := range header {
+		req.Header[name] = values
+	}
+	if s3.AccessKeyID != "" {
+		s3.sign(req, body, time.Now())
+	}
+
+	client := s3.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+
+	return client.Do(req)
+}
+
+// sign adds the AWS signature version 4 headers to the request, every header set on the request is signed
+func (s3 *S3Store) sign(req *http.Request, body []byte, now time.Time) {
+	payloadHash := sha256.Sum256(body)
+	amzDate := now.UTC().Format("20060102T150405Z")
+	date := amzDate[:8]
+
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", hex.EncodeToString(payloadHash[:]))
+	if s3.SessionToken != "" {
+		req.Header.Set("X-Amz-Security-Token", s3.SessionToken)
+	}
+
+	headers := map[string]string{"host": req.URL.Host}
+	for name, values := range req.Header {
+		headers[strings.ToLower(name)] = strings.TrimSpace(strings.Join(values, ","))
+	}
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var canonicalHeaders strings.Builder
+	for _, name := range names {
+		canonicalHeaders.WriteString(name + ":" + headers[name] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		s3EscapePath(req.URL.Path),
+		s3CanonicalQuery(req.URL.Query()),
+		canonicalHeaders.String(),
+		signedHeaders,
+		hex.EncodeToString(payloadHash[:]),
+	}, "\n")
+	canonicalRequestHash := sha256.Sum256([]byte(canonicalRequest))
+
+	scope := date + "/" + s3.Region + "/s3/aws4_request"
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(canonicalRequestHash[:])
+
+	signingKey := hmacSHA256([]byte("AWS4"+s3.SecretAccessKey), date)
+	signingKey = hmacSHA256(signingKey, s3.Region)
+	signingKey = hmacSHA256(signingKey, "s3")
+	signingKey = hmacSHA256(signingKey, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(signingKey, stringToSign))
+
+	req.Header.Set("Authorization", "AWS4-HMAC-SHA256 Credential="+s3.AccessKeyID+"/"+scope+
+		",SignedHeaders="+signedHeaders+",Signature="+signature)
+}
+
+// hmacSHA256 computes the HMAC-SHA256 of the data with the key
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+// s3Escape percent-encodes everything but the unreserved characters, as the signature requires
+func s3Escape(s string, keepSlash bool) string {
+	var escaped strings.Builder
+	for _, c := range []byte(s) {
+		if ('A' <= c && c <= 'Z') || ('a' <= c && c <= 'z') || ('0' <= c && c <= '9') ||
+			c == '-' || c == '_' || c == '.' || c == '~' || (keepSlash && c == '/') {
+			escaped.WriteByte(c)
+		} else {
+			fmt.Fprintf(&escaped, "%%%02X", c)
+		}
+	}
+	return escaped.String()
+}
+
+// s3EscapePath percent-encodes an object path, keeping its slashes
+func s3EscapePath(objectPath string) string {
+	return s3Escape(objectPath, true)
+}
+
+// s3CanonicalQuery encodes the query sorted by name, as the signature requires
+func s3CanonicalQuery(query url.Values) string {
+	names := make([]string, 0, len(query))
+	for name := range query {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var params []string
+	for _, name := range names {
+		for _, value := range query[name] {
+			params = append(params, s3Escape(name, false)+"="+s3Escape(value, false))
+		}
+	}
+	return strings.Join(params, "&")
+}
+
+// readS3Error reads the error document of a failed request
+func readS3Error(resp *http.Response) error {
+	body, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 64<<10))
+
+	var s3Err s3Error
+	if xml.Unmarshal(body, &s3Err) == nil && s3Err.Code != "" {
+		return fmt.Errorf("%s: %s: %s", resp.Status, s3Err.Code, s3Err.Message)
+	}
+	return fmt.Errorf("%s", resp.Status)
+}
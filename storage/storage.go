@@ -1,32 +1,131 @@
-
 package storage
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"io/ioutil"
 	"os"
+	"path"
 	"path/filepath"
+	"sort"
 	"strconv"
 	"strings"
-	"path"
+
+	"example.com/levo_app/logging"
+	"example.com/levo_app/schemaname"
 )
 
+// ErrSchemaNotFound is returned when the requested schema version is not present in the store
+var ErrSchemaNotFound = errors.New("schema not found")
+
+// ErrVersionExists is returned when saving a schema version that is already stored, versions are immutable
+var ErrVersionExists = errors.New("schema version already exists")
+
+// tempFilePrefix marks files that are still being written, they are never served
+const tempFilePrefix = ".tmp-"
+
+// SchemaStore is the interface implemented by every schema storage backend
+type SchemaStore interface {
+	// SaveSchema stores the given version of a schema file, it fails with ErrVersionExists if the version is already stored
+	SaveSchema(ctx context.Context, schemaFile []byte, filename string, filetype string, version int64) error
+	// GetSchema retrieves the given version of a schema file
+	GetSchema(ctx context.Context, filename string, version int64) ([]byte, error)
+	// DeleteSchema removes the given version of a schema file
+	DeleteSchema(ctx context.Context, filename string, version int64) error
+	// ListSchemas returns the names of all the stored schema files in ascending order
+	ListSchemas(ctx context.Context) ([]string, error)
+	// ListVersions returns the stored versions of a schema file in ascending order
+	ListVersions(ctx context.Context, filename string) ([]int64, error)
+	// SchemaExists reports whether the given version of a schema file is stored
+	SchemaExists(ctx context.Context, filename string, version int64) (bool, error)
+}
+
+// SchemaReplacer is implemented by the stores that can replace the content of a stored version,
+// which re-encoding the stored versions, like a key rotation, requires
+type SchemaReplacer interface {
+	// ReplaceSchema atomically replaces the content of a stored version, it fails with ErrSchemaNotFound if the version is not stored
+	ReplaceSchema(ctx context.Context, schemaFile []byte, filename string, version int64) error
+}
+
+// checkName rejects the schema file names that are not valid normalized schema names, so that a
+// name can never address a path or a key outside of the schema file
+func checkName(filename string) error {
+	if err := schemaname.Validate(filename); err != nil {
+		return fmt.Errorf("schema file name: %w", err)
+	}
+
+	return nil
+}
+
+// legacyNamesKey is the context key set by WithLegacyNames
+type legacyNamesKey struct{}
+
+// WithLegacyNames returns a context in which the stores also read, list and delete the versions
+// stored under the names accepted before names were normalized, valid names that are not lower
+// case such as "Dummy.json", so that service.NormalizeNames can move them to their normalized
+// name. New versions are never saved under such a name.
+func WithLegacyNames(ctx context.Context) context.Context {
+	return context.WithValue(ctx, legacyNamesKey{}, true)
+}
+
+// checkStoredName is checkName for reading, listing and deleting the stored versions, which also
+// accepts the legacy names in a context returned by WithLegacyNames
+func checkStoredName(ctx context.Context, filename string) error {
+	if legacy, _ := ctx.Value(legacyNamesKey{}).(bool); legacy {
+		if _, err := schemaname.Normalize(filename); err == nil {
+			return nil
+		}
+	}
+
+	return checkName(filename)
+}
+
+// Unwrap returns the store wrapped by a store like CompressedStore or EncryptedStore, or nil if the store wraps none
+func Unwrap(store SchemaStore) SchemaStore {
+	wrapper, ok := store.(interface{ Unwrap() SchemaStore })
+	if !ok {
+		return nil
+	}
+
+	return wrapper.Unwrap()
+}
+
 // FileStore represents the file storage
 type FileStore struct {
 	BasePath string
+
+	// SnapshotInterval enables delta storage when greater than 0: every SnapshotInterval-th version
+	// (1, 1+SnapshotInterval, ...) is stored whole and the versions in between as line deltas
+	// against their previous version, in "<version>.<filetype>.delta" files.
+	SnapshotInterval int64
+
+	// Logger writes the debug lines of the store, the lines of a request use the logger of its
+	// context. A nil Logger discards them.
+	Logger *logging.Logger
 }
 
+var _ SchemaStore = (*FileStore)(nil)
+var _ SchemaReplacer = (*FileStore)(nil)
+
 // NewFileStore creates a new file store
 func NewFileStore(basePath string) *FileStore {
 	return &FileStore{BasePath: basePath}
 }
 
-func (fs *FileStore) SaveSchema(schemaFile []byte, filename string, filetype string, version int64) error {
+// SaveSchema saves the schema file under a directory named after the file, one file per version
+func (fs *FileStore) SaveSchema(ctx context.Context, schemaFile []byte, filename string, filetype string, version int64) error {
+	if err := checkName(filename); err != nil {
+		return err
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
 	// Create a new directory for each new file
 	dirPath := filepath.Join(fs.BasePath, filename)
 	err := os.MkdirAll(dirPath, 0755)
 	if err != nil {
-		fmt.Println("failed to create directory:", err)
 		return fmt.Errorf("failed to create directory: %v", err)
 	}
 
@@ -35,46 +134,385 @@ func (fs *FileStore) SaveSchema(schemaFile []byte, filename string, filetype str
 
 	filePath := filepath.Join(dirPath, newFilename)
 
-	err = ioutil.WriteFile(filePath, schemaFile, 0644)
+	content, filePath, err := fs.encodeVersion(ctx, schemaFile, filename, filePath, version)
 	if err != nil {
-		fmt.Println("failed to save schema file:", err)
+		return err
+	}
+
+	err = writeFileAtomic(dirPath, filePath, content)
+	if err != nil {
+		if errors.Is(err, ErrVersionExists) {
+			return fmt.Errorf("schema file '%s' version '%d': %w", filename, version, ErrVersionExists)
+		}
 		return fmt.Errorf("failed to save schema file: %v", err)
 	}
 
 	return nil
 }
 
+// writeFileAtomic writes the content to a temp file in dirPath, syncs it and links it to filePath,
+// so a crash never leaves a partially written file under filePath. Unlike a rename, the link fails
+// if filePath already exists.
+func writeFileAtomic(dirPath string, filePath string, content []byte) error {
+	tmpPath, err := writeTempFile(dirPath, filePath, content)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmpPath)
+
+	err = os.Link(tmpPath, filePath)
+	if err != nil {
+		if os.IsExist(err) {
+			return ErrVersionExists
+		}
+		return err
+	}
+
+	return syncDir(dirPath)
+}
+
+// replaceFileAtomic is like writeFileAtomic but replaces filePath if it exists
+func replaceFileAtomic(dirPath string, filePath string, content []byte) error {
+	tmpPath, err := writeTempFile(dirPath, filePath, content)
+	if err != nil {
+		return err
+	}
+
+	err = os.Rename(tmpPath, filePath)
+	if err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+
+	return syncDir(dirPath)
+}
+
+// writeTempFile writes and syncs the content to a new temp file next to filePath and returns its path
+func writeTempFile(dirPath string, filePath string, content []byte) (string, error) {
+	tmpFile, err := ioutil.TempFile(dirPath, tempFilePrefix+filepath.Base(filePath)+"-")
+	if err != nil {
+		return "", err
+	}
+	tmpPath := tmpFile.Name()
+
+	_, err = tmpFile.Write(content)
+	if err == nil {
+		err = tmpFile.Sync()
+	}
+	if closeErr := tmpFile.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Chmod(tmpPath, 0644)
+	}
+	if err != nil {
+		os.Remove(tmpPath)
+		return "", err
+	}
+
+	return tmpPath, nil
+}
+
+// syncDir flushes the directory entries so a new file survives a crash
+func syncDir(dirPath string) error {
+	dir, err := os.Open(dirPath)
+	if err != nil {
+		return err
+	}
+	defer dir.Close()
+
+	return dir.Sync()
+}
+
+// RemoveTempFiles deletes the temp files left behind by writes that were interrupted by a crash.
+// It must run before the store serves uploads, typically at startup, and returns the number of files removed.
+func (fs *FileStore) RemoveTempFiles() (int, error) {
+	return removeTempFiles(fs.BasePath)
+}
+
+// removeTempFiles deletes all the temp files under basePath
+func removeTempFiles(basePath string) (int, error) {
+	removed := 0
+	err := filepath.Walk(basePath, func(filePath string, info os.FileInfo, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		if info.IsDir() || !strings.HasPrefix(info.Name(), tempFilePrefix) {
+			return nil
+		}
+
+		err = os.Remove(filePath)
+		if err != nil {
+			return err
+		}
+		removed++
+		return nil
+	})
+	if err != nil {
+		return removed, fmt.Errorf("failed to remove temp files: %v", err)
+	}
+
+	return removed, nil
+}
+
 // GetSchema retrieves the schema file from the file store
-func (fs *FileStore) GetSchema(filename string, version int64) ([]byte, error) {
-	dirPath := filepath.Join(fs.BasePath, filename)
-	fileType := strings.ToLower(path.Ext(filename))
-	filePath := filepath.Join(dirPath, strconv.FormatInt(version, 10) + fileType)
+func (fs *FileStore) GetSchema(ctx context.Context, filename string, version int64) ([]byte, error) {
+	if err := checkStoredName(ctx, filename); err != nil {
+		return nil, err
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
 
+	filePath := fs.versionPath(filename, version)
 	schemaFile, err := ioutil.ReadFile(filePath)
+	if err == nil {
+		return schemaFile, nil
+	}
+	if !os.IsNotExist(err) {
+		return nil, fmt.Errorf("failed to read schema file: %v", err)
+	}
+
+	// Not a snapshot, the version may be stored as a delta of the previous one
+	encodedDelta, err := ioutil.ReadFile(filePath + deltaSuffix)
 	if err != nil {
 		if os.IsNotExist(err) {
-			fmt.Println("schema file does not exist")
-			return nil, fmt.Errorf("schema file '%s' version '%d' does not exist", filename, version)
+			return nil, fmt.Errorf("schema file '%s' version '%d' does not exist: %w", filename, version, ErrSchemaNotFound)
 		}
 		return nil, fmt.Errorf("failed to read schema file: %v", err)
 	}
 
-	return schemaFile, nil
+	base, err := fs.GetSchema(ctx, filename, version-1)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read the base of schema file '%s' version '%d': %v", filename, version, err)
+	}
+
+	return applyDelta(base, encodedDelta)
 }
 
+// encodeVersion decides how a new version is stored, and returns the content and path of its file.
+// Versions are stored whole unless delta storage is enabled, the version is not a snapshot and the
+// delta is smaller than the version.
+func (fs *FileStore) encodeVersion(ctx context.Context, schemaFile []byte, filename string, filePath string, version int64) ([]byte, string, error) {
+	existing, err := fs.SchemaExists(ctx, filename, version)
+	if err != nil {
+		return nil, "", err
+	}
+	if existing {
+		return nil, "", fmt.Errorf("schema file '%s' version '%d': %w", filename, version, ErrVersionExists)
+	}
+
+	if fs.SnapshotInterval <= 0 || (version-1)%fs.SnapshotInterval == 0 {
+		return schemaFile, filePath, nil
+	}
+
+	base, err := fs.GetSchema(ctx, filename, version-1)
+	if err != nil {
+		if errors.Is(err, ErrSchemaNotFound) {
+			return schemaFile, filePath, nil
+		}
+		return nil, "", err
+	}
+
+	encodedDelta, ok, err := makeDelta(base, schemaFile)
+	if err != nil || !ok {
+		return schemaFile, filePath, err
+	}
+
+	return encodedDelta, filePath + deltaSuffix, nil
+}
 
 // DeleteSchema deletes the schema file with the specified filename and version from the storage
-func (fs *FileStore) DeleteSchema(filename string, version int64) error {
-	fileType := strings.ToLower(path.Ext(filename))
-	dirPath := filepath.Join(fs.BasePath, filename, strconv.FormatInt(version, 10) + fileType)
-	err := os.RemoveAll(dirPath)
+func (fs *FileStore) DeleteSchema(ctx context.Context, filename string, version int64) error {
+	if err := checkStoredName(ctx, filename); err != nil {
+		return err
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	// A delta of the next version needs this one, store the next version whole first
+	err := fs.storeWhole(ctx, filename, version+1)
 	if err != nil {
-		fmt.Println("failed to delete schema:", err)
 		return fmt.Errorf("failed to delete schema: %v", err)
 	}
 
-	fmt.Println("Schema deleted successfully from storage")
+	filePath := fs.versionPath(filename, version)
+	for _, versionFile := range []string{filePath, filePath + deltaSuffix} {
+		err := os.RemoveAll(versionFile)
+		if err != nil {
+			return fmt.Errorf("failed to delete schema: %v", err)
+		}
+	}
+
+	logging.FromContext(ctx, fs.Logger).Debug("schema deleted from storage", "name", filename, "version", version)
 
 	return nil
 }
 
+// ReplaceSchema replaces the content of a stored version, the version is stored whole afterwards
+func (fs *FileStore) ReplaceSchema(ctx context.Context, schemaFile []byte, filename string, version int64) error {
+	if err := checkName(filename); err != nil {
+		return err
+	}
+	exists, err := fs.SchemaExists(ctx, filename, version)
+	if err != nil {
+		return err
+	}
+	if !exists {
+		return fmt.Errorf("schema file '%s' version '%d' does not exist: %w", filename, version, ErrSchemaNotFound)
+	}
+
+	// A delta of the next version is based on the current content
+	err = fs.storeWhole(ctx, filename, version+1)
+	if err != nil {
+		return fmt.Errorf("failed to replace schema: %v", err)
+	}
+
+	filePath := fs.versionPath(filename, version)
+	err = replaceFileAtomic(filepath.Dir(filePath), filePath, schemaFile)
+	if err != nil {
+		return fmt.Errorf("failed to replace schema: %v", err)
+	}
+	err = os.RemoveAll(filePath + deltaSuffix)
+	if err != nil {
+		return fmt.Errorf("failed to replace schema: %v", err)
+	}
+
+	return nil
+}
+
+// storeWhole replaces the delta of a version with the whole version, versions that are not deltas are left as they are
+func (fs *FileStore) storeWhole(ctx context.Context, filename string, version int64) error {
+	filePath := fs.versionPath(filename, version)
+	if _, err := os.Stat(filePath + deltaSuffix); err != nil {
+		return nil
+	}
+
+	schemaFile, err := fs.GetSchema(ctx, filename, version)
+	if err != nil {
+		return err
+	}
+	err = writeFileAtomic(filepath.Dir(filePath), filePath, schemaFile)
+	if err != nil && !errors.Is(err, ErrVersionExists) {
+		return err
+	}
+
+	return os.Remove(filePath + deltaSuffix)
+}
+
+// ListSchemas lists the schema file directories under the base path
+func (fs *FileStore) ListSchemas(ctx context.Context) ([]string, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	return listSchemaDirs(ctx, fs.BasePath)
+}
+
+// listSchemaDirs lists the directories of dirPath, one per schema file
+func listSchemaDirs(ctx context.Context, dirPath string) ([]string, error) {
+	entries, err := ioutil.ReadDir(dirPath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return []string{}, nil
+		}
+		return nil, fmt.Errorf("failed to list schemas: %v", err)
+	}
+
+	filenames := []string{}
+	for _, entry := range entries {
+		// Directories that are not named after a valid schema name were not created by the store
+		if !entry.IsDir() || checkStoredName(ctx, entry.Name()) != nil {
+			continue
+		}
+		filenames = append(filenames, entry.Name())
+	}
+
+	return filenames, nil
+}
+
+// ListVersions lists the versions stored in the directory of the given schema file
+func (fs *FileStore) ListVersions(ctx context.Context, filename string) ([]int64, error) {
+	if err := checkStoredName(ctx, filename); err != nil {
+		return nil, err
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	return listVersionFiles(filepath.Join(fs.BasePath, filename))
+}
+
+// listVersionFiles lists the versions of the "<version>.<filetype>" files in dirPath in ascending order
+func listVersionFiles(dirPath string) ([]int64, error) {
+	entries, err := ioutil.ReadDir(dirPath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return []int64{}, nil
+		}
+		return nil, fmt.Errorf("failed to list schema versions: %v", err)
+	}
+
+	versions := []int64{}
+	seen := make(map[int64]bool)
+	for _, entry := range entries {
+		if entry.IsDir() || strings.HasPrefix(entry.Name(), tempFilePrefix) {
+			continue
+		}
+		name := strings.TrimSuffix(entry.Name(), deltaSuffix)
+		name = strings.TrimSuffix(name, path.Ext(name))
+		version, err := strconv.ParseInt(name, 10, 64)
+		if err != nil {
+			// not a version file
+			continue
+		}
+		// A storeWhole interrupted before removing the delta leaves both files of the version
+		if seen[version] {
+			continue
+		}
+		seen[version] = true
+		versions = append(versions, version)
+	}
+	sort.Slice(versions, func(i, j int) bool { return versions[i] < versions[j] })
+
+	return versions, nil
+}
+
+// SchemaExists checks whether the version file of the given schema file exists
+func (fs *FileStore) SchemaExists(ctx context.Context, filename string, version int64) (bool, error) {
+	if err := checkStoredName(ctx, filename); err != nil {
+		return false, err
+	}
+	if err := ctx.Err(); err != nil {
+		return false, err
+	}
+
+	filePath := fs.versionPath(filename, version)
+	for _, versionFile := range []string{filePath, filePath + deltaSuffix} {
+		_, err := os.Stat(versionFile)
+		if err == nil {
+			return true, nil
+		}
+		if !os.IsNotExist(err) {
+			return false, fmt.Errorf("failed to stat schema file: %v", err)
+		}
+	}
+
+	return false, nil
+}
+
+// versionPath returns the path of the file of a version, without the delta suffix, whatever the
+// file type it was saved with. If the version is not stored, the returned path has no file type.
+func (fs *FileStore) versionPath(filename string, version int64) string {
+	prefix := filepath.Join(fs.BasePath, filename, strconv.FormatInt(version, 10))
+	matches, _ := filepath.Glob(prefix + ".*")
+	if len(matches) > 0 {
+		return strings.TrimSuffix(matches[0], deltaSuffix)
+	}
+
+	return prefix
+}
@@ -0,0 +1,223 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"example.com/levo_app/schemaname"
+)
+
+// testSchemaStore runs the behaviour every SchemaStore implementation must share
+func testSchemaStore(t *testing.T, store SchemaStore) {
+	ctx := context.Background()
+	content := []byte(`{"openapi": "3.0.1"}`)
+
+	for _, version := range []int64{2, 1} {
+		if err := store.SaveSchema(ctx, content, "dummy.json", "json", version); err != nil {
+			t.Fatalf("failed to save version %d: %v", version, err)
+		}
+	}
+
+	got, err := store.GetSchema(ctx, "dummy.json", 1)
+	if err != nil {
+		t.Fatalf("failed to get schema: %v", err)
+	}
+	if !bytes.Equal(got, content) {
+		t.Errorf("expected content '%s' but got '%s'", content, got)
+	}
+
+	versions, err := store.ListVersions(ctx, "dummy.json")
+	if err != nil {
+		t.Fatalf("failed to list versions: %v", err)
+	}
+	if !reflect.DeepEqual(versions, []int64{1, 2}) {
+		t.Errorf("expected versions [1 2] but got %v", versions)
+	}
+
+	if err := store.DeleteSchema(ctx, "dummy.json", 2); err != nil {
+		t.Fatalf("failed to delete schema: %v", err)
+	}
+	exists, err := store.SchemaExists(ctx, "dummy.json", 2)
+	if err != nil {
+		t.Fatalf("failed to check schema: %v", err)
+	}
+	if exists {
+		t.Error("expected version 2 to be deleted")
+	}
+
+	_, err = store.GetSchema(ctx, "dummy.json", 2)
+	if !errors.Is(err, ErrSchemaNotFound) {
+		t.Errorf("expected ErrSchemaNotFound but got %v", err)
+	}
+
+	// The file type is not part of the schema name
+	yamlContent := []byte("openapi: 3.0.1\n")
+	if err := store.SaveSchema(ctx, yamlContent, "payments-api", "yaml", 1); err != nil {
+		t.Fatalf("failed to save a schema without extension: %v", err)
+	}
+	got, err = store.GetSchema(ctx, "payments-api", 1)
+	if err != nil || !bytes.Equal(got, yamlContent) {
+		t.Errorf("expected content '%s' but got '%s' and %v", yamlContent, got, err)
+	}
+	err = store.SaveSchema(ctx, content, "payments-api", "json", 1)
+	if !errors.Is(err, ErrVersionExists) {
+		t.Errorf("expected ErrVersionExists for a version saved with another file type but got %v", err)
+	}
+
+	// Names that could escape the storage are rejected
+	for _, filename := range []string{"../escape.json", "..", "dir/escape.json", "Dummy.json"} {
+		err = store.SaveSchema(ctx, content, filename, "json", 1)
+		if !errors.Is(err, schemaname.ErrInvalidName) {
+			t.Errorf("expected saving '%s' to fail with ErrInvalidName but got %v", filename, err)
+		}
+		_, err = store.GetSchema(ctx, filename, 1)
+		if !errors.Is(err, schemaname.ErrInvalidName) {
+			t.Errorf("expected reading '%s' to fail with ErrInvalidName but got %v", filename, err)
+		}
+	}
+
+	versions, err = store.ListVersions(ctx, "missing.json")
+	if err != nil {
+		t.Fatalf("failed to list versions of a missing schema: %v", err)
+	}
+	if len(versions) != 0 {
+		t.Errorf("expected no versions but got %v", versions)
+	}
+}
+
+func TestFileStore(t *testing.T) {
+	basePath := filepath.Join(t.TempDir(), "schema_uploads")
+	testSchemaStore(t, NewFileStore(basePath))
+
+	if _, err := os.Stat(filepath.Join(basePath, "..", "escape.json")); !os.IsNotExist(err) {
+		t.Errorf("expected nothing to be written outside of the base path, stat returned %v", err)
+	}
+}
+
+func TestMemoryStore(t *testing.T) {
+	testSchemaStore(t, NewMemoryStore())
+}
+
+func TestFileStoreRefusesOverwrite(t *testing.T) {
+	ctx := context.Background()
+	fileStore := NewFileStore(t.TempDir())
+
+	if err := fileStore.SaveSchema(ctx, []byte(`{"v": 1}`), "dummy.json", "json", 1); err != nil {
+		t.Fatal(err)
+	}
+	err := fileStore.SaveSchema(ctx, []byte(`{"v": 2}`), "dummy.json", "json", 1)
+	if !errors.Is(err, ErrVersionExists) {
+		t.Errorf("expected ErrVersionExists but got %v", err)
+	}
+
+	got, err := fileStore.GetSchema(ctx, "dummy.json", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != `{"v": 1}` {
+		t.Errorf("expected the first version to be kept but got '%s'", got)
+	}
+}
+
+func TestFileStoreRemoveTempFiles(t *testing.T) {
+	ctx := context.Background()
+	fileStore := NewFileStore(t.TempDir())
+
+	if err := fileStore.SaveSchema(ctx, []byte(`{}`), "dummy.json", "json", 1); err != nil {
+		t.Fatal(err)
+	}
+
+	// Simulate a crash in the middle of writing version 2
+	tmpPath := filepath.Join(fileStore.BasePath, "dummy.json", tempFilePrefix+"2.json-123")
+	if err := ioutil.WriteFile(tmpPath, []byte(`{"trunc`), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	versions, err := fileStore.ListVersions(ctx, "dummy.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(versions, []int64{1}) {
+		t.Errorf("expected temp files to be ignored but got versions %v", versions)
+	}
+
+	removed, err := fileStore.RemoveTempFiles()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if removed != 1 {
+		t.Errorf("expected 1 removed temp file but got %d", removed)
+	}
+	if _, err := os.Stat(tmpPath); !os.IsNotExist(err) {
+		t.Errorf("expected temp file to be removed, stat returned %v", err)
+	}
+}
+
+func TestBlobStore(t *testing.T) {
+	testSchemaStore(t, NewBlobStore(t.TempDir()))
+}
+
+func TestBlobStoreDeduplication(t *testing.T) {
+	ctx := context.Background()
+	blobStore := NewBlobStore(t.TempDir())
+	content := []byte(`{"openapi": "3.0.1"}`)
+	sum := sha256.Sum256(content)
+	digest := hex.EncodeToString(sum[:])
+
+	for _, sv := range []struct {
+		filename string
+		version  int64
+	}{{"dummy.json", 1}, {"dummy.json", 2}, {"other.json", 1}} {
+		if err := blobStore.SaveSchema(ctx, content, sv.filename, "json", sv.version); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	blobs, err := filepath.Glob(filepath.Join(blobStore.BasePath, "blobs", "sha256", "*", digest))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(blobs) != 1 {
+		t.Errorf("expected the content to be stored once but found %v", blobs)
+	}
+	if count, _ := blobStore.RefCount(digest); count != 3 {
+		t.Errorf("expected 3 references but got %d", count)
+	}
+
+	got, err := blobStore.GetBlob(ctx, digest)
+	if err != nil || !bytes.Equal(got, content) {
+		t.Errorf("expected the blob to be served by digest, got '%s' and %v", got, err)
+	}
+
+	// Replacing the content of a version releases its reference to the blob
+	if err := blobStore.ReplaceSchema(ctx, []byte(`{"openapi": "3.1.0"}`), "other.json", 1); err != nil {
+		t.Fatal(err)
+	}
+	if count, _ := blobStore.RefCount(digest); count != 2 {
+		t.Errorf("expected 2 references after the replacement but got %d", count)
+	}
+
+	// The blob is kept until its last reference is deleted
+	for _, filename := range []string{"dummy.json", "other.json"} {
+		if err := blobStore.DeleteSchema(ctx, filename, 1); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := blobStore.GetSchema(ctx, "dummy.json", 2); err != nil {
+		t.Errorf("expected version 2 to still be readable: %v", err)
+	}
+	if err := blobStore.DeleteSchema(ctx, "dummy.json", 2); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := blobStore.GetBlob(ctx, digest); !errors.Is(err, ErrSchemaNotFound) {
+		t.Errorf("expected the unreferenced blob to be removed but got %v", err)
+	}
+}
@@ -0,0 +1,461 @@
+package storage
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Errors of the upload sessions
+var (
+	// ErrUploadNotFound is returned for upload sessions that don't exist, were finished or expired
+	ErrUploadNotFound = errors.New("upload session not found")
+	// ErrUploadOffsetMismatch is returned when a chunk doesn't start where the uploaded content ends
+	ErrUploadOffsetMismatch = errors.New("upload offset doesn't match the uploaded size")
+	// ErrUploadTooLarge is returned when a chunk would make the upload larger than allowed
+	ErrUploadTooLarge = errors.New("upload is larger than allowed")
+	// ErrUploadIncomplete is returned when reading an upload that hasn't reached its declared length
+	ErrUploadIncomplete = errors.New("upload is incomplete")
+	// ErrUploadLimit is returned when the sessions in progress reach MaxSessions or MaxBytes
+	ErrUploadLimit = errors.New("too many uploads in progress")
+)
+
+// Suffixes of the files of an upload session in UploadSessions.Dir
+const (
+	uploadInfoSuffix = ".json"
+	uploadPartSuffix = ".part"
+)
+
+// Upload describes an upload session
+type Upload struct {
+	ID string `json:"id"`
+	// Name is the schema the uploaded file is saved to
+	Name string `json:"name"`
+	// OriginalFilename is the name of the uploaded file, it may be empty
+	OriginalFilename string `json:"original_filename,omitempty"`
+	// ContentType is the media type of the uploaded file, it may be empty
+	ContentType string `json:"content_type,omitempty"`
+	// Length is the size of the complete file, or -1 if it was not declared
+	Length int64 `json:"length"`
+	// Offset is the size uploaded so far
+	Offset    int64     `json:"offset"`
+	CreatedAt time.Time `json:"created_at"`
+	// ExpiresAt is when the session is removed unless more content is uploaded
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+// UploadSessions keeps the files of resumable uploads in a directory until they are complete. Each
+// session is an "<id>.json" file describing it and an "<id>.part" file the chunks are appended to.
+// The size of the part file is the offset of the upload, so after a crash the upload resumes from
+// whatever was written. Sessions without activity for TTL expire.
+type UploadSessions struct {
+	Dir string
+	TTL time.Duration
+
+	// MaxSessions is the maximum number of sessions in progress, zero means no limit
+	MaxSessions int
+	// MaxBytes is the maximum size of all the uploads in progress, zero means no limit. Each chunk
+	// is checked against the size uploaded when it starts, so concurrent chunks may exceed it together.
+	MaxBytes int64
+
+	// createMu serializes the creations, so they can't exceed MaxSessions together
+	createMu sync.Mutex
+
+	mu    sync.Mutex
+	locks map[string]*uploadLock
+}
+
+// uploadLock serializes the requests of an upload session, it is dropped when no request holds or waits for it
+type uploadLock struct {
+	sync.Mutex
+	refs int
+}
+
+// NewUploadSessions creates the directory of the upload sessions if it doesn't exist
+func NewUploadSessions(dir string, ttl time.Duration) (*UploadSessions, error) {
+	err := os.MkdirAll(dir, 0755)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create upload directory: %v", err)
+	}
+
+	return &UploadSessions{Dir: dir, TTL: ttl, locks: make(map[string]*uploadLock)}, nil
+}
+
+// Create starts an upload session for the given schema, length is -1 if the size of the file is not
+// known. It fails with ErrUploadLimit when the sessions in progress reach MaxSessions or MaxBytes.
+func (us *UploadSessions) Create(name string, originalFilename string, contentType string, length int64) (Upload, error) {
+	if err := checkName(name); err != nil {
+		return Upload{}, err
+	}
+
+	us.createMu.Lock()
+	defer us.createMu.Unlock()
+	if us.MaxSessions > 0 || us.MaxBytes > 0 {
+		sessions, size, err := us.usage()
+		if err != nil {
+			return Upload{}, err
+		}
+		if us.MaxSessions > 0 && sessions >= us.MaxSessions {
+			return Upload{}, fmt.Errorf("%w: the limit is %d sessions", ErrUploadLimit, us.MaxSessions)
+		}
+		if us.MaxBytes > 0 && size >= us.MaxBytes {
+			return Upload{}, fmt.Errorf("%w: the limit is %d bytes", ErrUploadLimit, us.MaxBytes)
+		}
+	}
+
+	idBytes := make([]byte, 16)
+	if _, err := rand.Read(idBytes); err != nil {
+		return Upload{}, fmt.Errorf("failed to generate upload ID: %v", err)
+	}
+	now := time.Now()
+	upload := Upload{
+		ID:               hex.EncodeToString(idBytes),
+		Name:             name,
+		OriginalFilename: originalFilename,
+		ContentType:      contentType,
+		Length:           length,
+		CreatedAt:        now,
+		ExpiresAt:        now.Add(us.TTL),
+	}
+
+	err := ioutil.WriteFile(us.path(upload.ID, uploadPartSuffix), nil, 0644)
+	if err != nil {
+		return Upload{}, fmt.Errorf("failed to create upload: %v", err)
+	}
+	err = us.writeInfo(upload)
+	if err != nil {
+		os.Remove(us.path(upload.ID, uploadPartSuffix))
+		return Upload{}, err
+	}
+
+	return upload, nil
+}
+
+// Get returns an upload session
+func (us *UploadSessions) Get(id string) (Upload, error) {
+	unlock, err := us.lock(id)
+	if err != nil {
+		return Upload{}, err
+	}
+	defer unlock()
+
+	return us.readInfo(id)
+}
+
+// Append adds a chunk at the given offset, which must be the size uploaded so far, and returns the
+// session with its new offset. The upload can't grow past its declared length nor maxSize, and
+// the uploads in progress can't grow past MaxBytes.
+func (us *UploadSessions) Append(id string, offset int64, chunk io.Reader, maxSize int64) (Upload, error) {
+	unlock, err := us.lock(id)
+	if err != nil {
+		return Upload{}, err
+	}
+	defer unlock()
+
+	upload, err := us.readInfo(id)
+	if err != nil {
+		return Upload{}, err
+	}
+	if offset != upload.Offset {
+		return upload, fmt.Errorf("%w: the upload is at offset %d", ErrUploadOffsetMismatch, upload.Offset)
+	}
+	if upload.Length >= 0 && upload.Length < maxSize {
+		maxSize = upload.Length
+	}
+	limit := maxSize - upload.Offset
+	limitErr := fmt.Errorf("%w: the limit is %d bytes", ErrUploadTooLarge, maxSize)
+	if us.MaxBytes > 0 {
+		_, size, err := us.usage()
+		if err != nil {
+			return upload, err
+		}
+		if remaining := us.MaxBytes - size; remaining < limit {
+			limit = remaining
+			if limit < 0 {
+				limit = 0
+			}
+			limitErr = fmt.Errorf("%w: the limit is %d bytes", ErrUploadLimit, us.MaxBytes)
+		}
+	}
+
+	partFile, err := os.OpenFile(us.path(id, uploadPartSuffix), os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return upload, fmt.Errorf("failed to open upload: %v", err)
+	}
+	defer partFile.Close()
+
+	// Read one byte more than allowed to find out if the chunk is too large
+	written, err := io.Copy(partFile, io.LimitReader(chunk, limit+1))
+	if err == nil && written > limit {
+		err = limitErr
+	}
+	if err == nil {
+		err = partFile.Sync()
+	}
+	if err != nil {
+		// Drop the chunk, a client resuming after a failed chunk sends it again
+		if truncateErr := partFile.Truncate(upload.Offset); truncateErr != nil {
+			return upload, fmt.Errorf("failed to truncate upload after error %v: %v", err, truncateErr)
+		}
+		if err == limitErr {
+			return upload, err
+		}
+		return upload, fmt.Errorf("failed to write upload: %v", err)
+	}
+
+	upload.Offset += written
+	upload.ExpiresAt = time.Now().Add(us.TTL)
+	err = us.writeInfo(upload)
+	if err != nil {
+		return upload, err
+	}
+
+	return upload, nil
+}
+
+// Read returns the session and the uploaded file, it fails with ErrUploadIncomplete if the
+// upload hasn't reached its declared length
+func (us *UploadSessions) Read(id string) (Upload, []byte, error) {
+	unlock, err := us.lock(id)
+	if err != nil {
+		return Upload{}, nil, err
+	}
+	defer unlock()
+
+	upload, err := us.readInfo(id)
+	if err != nil {
+		return Upload{}, nil, err
+	}
+	if upload.Length >= 0 && upload.Offset != upload.Length {
+		return upload, nil, fmt.Errorf("%w: %d of %d bytes uploaded", ErrUploadIncomplete, upload.Offset, upload.Length)
+	}
+
+	content, err := ioutil.ReadFile(us.path(id, uploadPartSuffix))
+	if err != nil {
+		return upload, nil, fmt.Errorf("failed to read upload: %v", err)
+	}
+
+	return upload, content, nil
+}
+
+// Delete removes an upload session and its file
+func (us *UploadSessions) Delete(id string) error {
+	unlock, err := us.lock(id)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	if _, err := os.Stat(us.path(id, uploadInfoSuffix)); os.IsNotExist(err) {
+		return ErrUploadNotFound
+	}
+	return us.remove(id)
+}
+
+// RemoveExpired deletes the sessions that expired before now and returns the number of sessions removed.
+// Part files left without a description by a crash are removed once they are older than TTL.
+func (us *UploadSessions) RemoveExpired(now time.Time) (int, error) {
+	entries, err := ioutil.ReadDir(us.Dir)
+	if err != nil {
+		return 0, fmt.Errorf("failed to list uploads: %v", err)
+	}
+
+	removed := 0
+	for _, entry := range entries {
+		var id string
+		switch {
+		case strings.HasSuffix(entry.Name(), uploadInfoSuffix):
+			id = strings.TrimSuffix(entry.Name(), uploadInfoSuffix)
+		case strings.HasSuffix(entry.Name(), uploadPartSuffix) && entry.ModTime().Add(us.TTL).Before(now):
+			id = strings.TrimSuffix(entry.Name(), uploadPartSuffix)
+		default:
+			continue
+		}
+
+		unlock, err := us.lock(id)
+		if err != nil {
+			continue
+		}
+		expired, err := us.expired(id, now)
+		if err == nil && expired {
+			err = us.remove(id)
+			if err == nil {
+				removed++
+			}
+		}
+		unlock()
+		if err != nil {
+			return removed, err
+		}
+	}
+
+	return removed, nil
+}
+
+// RemoveTempFiles deletes the temp files left behind by descriptions that were being written when
+// the server crashed. Like FileStore.RemoveTempFiles it must run before the sessions are used.
+func (us *UploadSessions) RemoveTempFiles() (int, error) {
+	return removeTempFiles(us.Dir)
+}
+
+// usage returns the number of sessions in progress and the size uploaded to them
+func (us *UploadSessions) usage() (int, int64, error) {
+	entries, err := ioutil.ReadDir(us.Dir)
+	if err != nil {
+		return 0, 0, fmt.Errorf("failed to list uploads: %v", err)
+	}
+
+	sessions := 0
+	var size int64
+	for _, entry := range entries {
+		switch {
+		case strings.HasPrefix(entry.Name(), tempFilePrefix):
+		case strings.HasSuffix(entry.Name(), uploadInfoSuffix):
+			sessions++
+		case strings.HasSuffix(entry.Name(), uploadPartSuffix):
+			size += entry.Size()
+		}
+	}
+
+	return sessions, size, nil
+}
+
+// expired reports whether a session expired before now, a part file without a description is expired
+func (us *UploadSessions) expired(id string, now time.Time) (bool, error) {
+	upload, err := us.readDescription(id)
+	if errors.Is(err, ErrUploadNotFound) {
+		// Only the part file is left, unless it was removed along with its session
+		_, err := os.Stat(us.path(id, uploadPartSuffix))
+		if os.IsNotExist(err) {
+			return false, nil
+		}
+		return err == nil, err
+	}
+	if err != nil {
+		return false, err
+	}
+
+	return upload.ExpiresAt.Before(now), nil
+}
+
+// lock locks an upload session and returns the function unlocking it
+func (us *UploadSessions) lock(id string) (func(), error) {
+	if !validUploadID(id) {
+		return nil, ErrUploadNotFound
+	}
+
+	us.mu.Lock()
+	lock, ok := us.locks[id]
+	if !ok {
+		lock = &uploadLock{}
+		us.locks[id] = lock
+	}
+	lock.refs++
+	us.mu.Unlock()
+
+	lock.Lock()
+	return func() {
+		lock.Unlock()
+
+		us.mu.Lock()
+		lock.refs--
+		if lock.refs == 0 {
+			delete(us.locks, id)
+		}
+		us.mu.Unlock()
+	}, nil
+}
+
+// readInfo reads the description of a session and the size of its file, expired sessions are not found
+func (us *UploadSessions) readInfo(id string) (Upload, error) {
+	upload, err := us.readDescription(id)
+	if err != nil {
+		return Upload{}, err
+	}
+	if upload.ExpiresAt.Before(time.Now()) {
+		return Upload{}, ErrUploadNotFound
+	}
+
+	info, err := os.Stat(us.path(id, uploadPartSuffix))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return Upload{}, ErrUploadNotFound
+		}
+		return Upload{}, fmt.Errorf("failed to stat upload: %v", err)
+	}
+	upload.Offset = info.Size()
+
+	return upload, nil
+}
+
+// readDescription reads the description file of a session
+func (us *UploadSessions) readDescription(id string) (Upload, error) {
+	content, err := ioutil.ReadFile(us.path(id, uploadInfoSuffix))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return Upload{}, ErrUploadNotFound
+		}
+		return Upload{}, fmt.Errorf("failed to read upload: %v", err)
+	}
+
+	var upload Upload
+	err = json.Unmarshal(content, &upload)
+	if err != nil {
+		return Upload{}, fmt.Errorf("failed to parse upload '%s': %v", id, err)
+	}
+
+	return upload, nil
+}
+
+// writeInfo atomically replaces the description of a session
+func (us *UploadSessions) writeInfo(upload Upload) error {
+	content, err := json.Marshal(upload)
+	if err != nil {
+		return fmt.Errorf("failed to encode upload: %v", err)
+	}
+
+	err = replaceFileAtomic(us.Dir, us.path(upload.ID, uploadInfoSuffix), content)
+	if err != nil {
+		return fmt.Errorf("failed to save upload: %v", err)
+	}
+
+	return nil
+}
+
+// remove deletes the files of a session, the description last so a crash leaves a session that expires
+func (us *UploadSessions) remove(id string) error {
+	err := os.Remove(us.path(id, uploadPartSuffix))
+	if err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to remove upload: %v", err)
+	}
+	err = os.Remove(us.path(id, uploadInfoSuffix))
+	if err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to remove upload: %v", err)
+	}
+
+	return nil
+}
+
+// path returns the path of a file of a session
+func (us *UploadSessions) path(id string, suffix string) string {
+	return filepath.Join(us.Dir, id+suffix)
+}
+
+// validUploadID reports whether id has the format of the IDs generated by Create, so it can't name
+// files outside the upload directory
+func validUploadID(id string) bool {
+	if len(id) != 32 {
+		return false
+	}
+	_, err := hex.DecodeString(id)
+	return err == nil && strings.ToLower(id) == id
+}
@@ -0,0 +1,220 @@
+package storage
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"example.com/levo_app/schemaname"
+)
+
+func TestUploadSessions(t *testing.T) {
+	uploads, err := NewUploadSessions(t.TempDir(), time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	upload, err := uploads.Create("openapi.json", "openapi.json", "application/json", 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	upload, err = uploads.Append(upload.ID, 0, strings.NewReader("01234"), 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if upload.Offset != 5 {
+		t.Errorf("expected offset 5 but got %d", upload.Offset)
+	}
+
+	// A chunk resent after a lost response doesn't start at the offset
+	if _, err := uploads.Append(upload.ID, 0, strings.NewReader("01234"), 100); !errors.Is(err, ErrUploadOffsetMismatch) {
+		t.Errorf("expected ErrUploadOffsetMismatch but got %v", err)
+	}
+	if _, _, err := uploads.Read(upload.ID); !errors.Is(err, ErrUploadIncomplete) {
+		t.Errorf("expected ErrUploadIncomplete but got %v", err)
+	}
+
+	// A chunk past the declared length is dropped entirely
+	if _, err := uploads.Append(upload.ID, 5, strings.NewReader("567890"), 100); !errors.Is(err, ErrUploadTooLarge) {
+		t.Errorf("expected ErrUploadTooLarge but got %v", err)
+	}
+	if upload, err = uploads.Get(upload.ID); err != nil || upload.Offset != 5 {
+		t.Errorf("expected the upload to stay at offset 5 but got %d (%v)", upload.Offset, err)
+	}
+
+	if _, err := uploads.Append(upload.ID, 5, strings.NewReader("56789"), 100); err != nil {
+		t.Fatal(err)
+	}
+	upload, content, err := uploads.Read(upload.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(content) != "0123456789" || upload.Name != "openapi.json" || upload.ContentType != "application/json" {
+		t.Errorf("unexpected upload %+v with content '%s'", upload, content)
+	}
+
+	if err := uploads.Delete(upload.ID); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := uploads.Get(upload.ID); !errors.Is(err, ErrUploadNotFound) {
+		t.Errorf("expected ErrUploadNotFound after delete but got %v", err)
+	}
+
+	for _, id := range []string{"", "../openapi", strings.Repeat("A", 32)} {
+		if _, err := uploads.Get(id); !errors.Is(err, ErrUploadNotFound) {
+			t.Errorf("expected ErrUploadNotFound for ID '%s' but got %v", id, err)
+		}
+	}
+	if _, err := uploads.Create("../openapi.json", "", "", -1); !errors.Is(err, schemaname.ErrInvalidName) {
+		t.Errorf("expected ErrInvalidName but got %v", err)
+	}
+}
+
+func TestUploadSessionsMaxSize(t *testing.T) {
+	uploads, err := NewUploadSessions(t.TempDir(), time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Without a declared length, the upload is complete whenever it is read
+	upload, err := uploads.Create("openapi.yaml", "", "", -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := uploads.Append(upload.ID, 0, strings.NewReader("0123"), 4); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := uploads.Append(upload.ID, 4, strings.NewReader("4"), 4); !errors.Is(err, ErrUploadTooLarge) {
+		t.Errorf("expected ErrUploadTooLarge but got %v", err)
+	}
+	if _, content, err := uploads.Read(upload.ID); err != nil || string(content) != "0123" {
+		t.Errorf("expected content '0123' but got '%s' (%v)", content, err)
+	}
+}
+
+func TestUploadSessionsExpiry(t *testing.T) {
+	dir := t.TempDir()
+	uploads, err := NewUploadSessions(dir, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The abandoned session is created with a shorter TTL, so it expires first
+	uploads.TTL = time.Minute
+	abandoned, err := uploads.Create("openapi.json", "", "", -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	uploads.TTL = time.Hour
+	active, err := uploads.Create("openapi.json", "", "", -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A part file left by a crash between the writes of Create
+	orphan := filepath.Join(dir, strings.Repeat("0", 32)+uploadPartSuffix)
+	if err := ioutil.WriteFile(orphan, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	old := time.Now().Add(-2 * time.Hour)
+	if err := os.Chtimes(orphan, old, old); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := uploads.Append(active.ID, 0, strings.NewReader("{}"), 100); err != nil {
+		t.Fatal(err)
+	}
+	removed, err := uploads.RemoveExpired(time.Now().Add(2 * time.Minute))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if removed != 2 {
+		t.Errorf("expected 2 removed sessions but got %d", removed)
+	}
+	if _, err := uploads.Get(abandoned.ID); !errors.Is(err, ErrUploadNotFound) {
+		t.Errorf("expected the abandoned session to be removed but got %v", err)
+	}
+	if _, err := uploads.Get(active.ID); err != nil {
+		t.Errorf("expected the active session to be kept: %v", err)
+	}
+	if entries, _ := ioutil.ReadDir(dir); len(entries) != 2 {
+		t.Errorf("expected only the files of the active session to be left but got %d files", len(entries))
+	}
+}
+
+func TestUploadSessionsLimits(t *testing.T) {
+	uploads, err := NewUploadSessions(t.TempDir(), time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	uploads.MaxSessions = 2
+	uploads.MaxBytes = 8
+
+	first, err := uploads.Create("openapi.json", "", "", -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := uploads.Create("openapi.json", "", "", -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := uploads.Create("openapi.json", "", "", -1); !errors.Is(err, ErrUploadLimit) {
+		t.Errorf("expected ErrUploadLimit past the maximum number of sessions but got %v", err)
+	}
+
+	// The chunks of all the sessions share MaxBytes, a chunk past it is dropped
+	if _, err := uploads.Append(first.ID, 0, strings.NewReader("01234"), 100); err != nil {
+		t.Fatal(err)
+	}
+	upload, err := uploads.Append(second.ID, 0, strings.NewReader("01234"), 100)
+	if !errors.Is(err, ErrUploadLimit) {
+		t.Errorf("expected ErrUploadLimit past the maximum size but got %v", err)
+	}
+	if upload.Offset != 0 {
+		t.Errorf("expected the chunk past the limit to be dropped but the offset is %d", upload.Offset)
+	}
+	if _, err := uploads.Append(second.ID, 0, strings.NewReader("012"), 100); err != nil {
+		t.Errorf("expected a chunk within the limit to be added but got %v", err)
+	}
+
+	// Finished sessions make room for new ones
+	if err := uploads.Delete(first.ID); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := uploads.Create("openapi.json", "", "", -1); err != nil {
+		t.Errorf("expected a session to be created once another is removed but got %v", err)
+	}
+}
+
+func TestUploadSessionsRemoveTempFiles(t *testing.T) {
+	dir := t.TempDir()
+	uploads, err := NewUploadSessions(dir, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	upload, err := uploads.Create("openapi.json", "", "", -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A description that was being replaced when the server crashed
+	if err := ioutil.WriteFile(filepath.Join(dir, tempFilePrefix+upload.ID+uploadInfoSuffix+"-123"), []byte("{"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	removed, err := uploads.RemoveTempFiles()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if removed != 1 {
+		t.Errorf("expected 1 temp file to be removed but got %d", removed)
+	}
+	if _, err := uploads.Get(upload.ID); err != nil {
+		t.Errorf("expected the session to be kept but got %v", err)
+	}
+}